@@ -0,0 +1,69 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"k8s.io/utils/mount"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// diagnoseCommand is the subcommand printing the NVMe state of the node
+const diagnoseCommand = "diagnose"
+
+// runDiagnose prints util.Diagnose in the --output-format and returns the exit code
+func runDiagnose(args []string) int {
+	flags := flag.NewFlagSet(diagnoseCommand, flag.ContinueOnError)
+	outputFormat := flags.String("output-format", "text", "Output format, text or json")
+	stagingRoot := flags.String("staging-root", "/var/lib/kubelet/plugins/kubernetes.io/csi/"+driverName, "Kubelet dir of the staging paths of the driver")
+	resolver := flags.String("device-resolver", util.DeviceResolverByID, "How the devices of staged volumes are resolved, by-id or nvme-list, as the node plugin does")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *outputFormat != "text" && *outputFormat != "json" {
+		fmt.Fprintf(os.Stderr, "invalid --output-format %q, expected text or json\n", *outputFormat)
+		return 2
+	}
+	if err := util.ValidateDeviceResolver(*resolver); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --device-resolver: %v\n", err)
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	diagnosis := util.Diagnose(ctx, *stagingRoot, *resolver, mount.New(""))
+	var err error
+	if *outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(diagnosis)
+	} else {
+		err = diagnosis.WriteText(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write the diagnosis: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -18,7 +18,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"k8s.io/klog"
 
@@ -35,22 +38,133 @@ var conf = util.Config{
 	DriverVersion: driverVersion,
 }
 
+// print the configuration and exit, see util.Config.Dump
+var printConfig bool
+
+// -command-prefix, split into conf.CommandPrefix
+var commandPrefix string
+
 func init() {
 	flag.StringVar(&conf.DriverName, "drivername", driverName, "Name of the driver")
 	flag.StringVar(&conf.Endpoint, "endpoint", "unix://tmp/nvmeofcsi.sock", "CSI endpoint")
-	flag.StringVar(&conf.NodeID, "nodeid", "", "node id")
+	flag.StringVar(&conf.NodeID, "nodeid", "", "node id, taken from the NODE_ID or KUBE_NODE_NAME environment variable if empty")
 	flag.BoolVar(&conf.IsControllerServer, "controller", true, "Start controller server")
 	flag.BoolVar(&conf.IsNodeServer, "node", false, "Start node server")
+	flag.StringVar(&conf.GatewayAddress, "gateway-address", "10.242.64.32:5500", "NVMe-oF gateway gRPC address for volumes without a clusterID")
+	flag.StringVar(&conf.ClustersFile, "clusters-file", "", "JSON file mapping clusterID to the gateway gRPC address and the optional TLS CA, client certificate and key files of the gateway connection")
+	flag.StringVar(&conf.DebugAddress, "debug-address", "", "Serve node debug endpoints on this address, e.g. localhost:9810 (disabled if empty)")
+	flag.StringVar(&conf.PprofAddress, "pprof-address", "", "Serve pprof profiles on this address, e.g. localhost:6060 (disabled if empty)")
+	flag.StringVar(&conf.MetricsAddress, "metrics-address", "", "Serve prometheus metrics on this address, e.g. 0.0.0.0:9811 (disabled if empty)")
+	flag.StringVar(&conf.HealthAddress, "health-address", "", "Listen address of the controller /healthz endpoint, failing while the default gateway or one of -clusters-file is unreachable, e.g. 0.0.0.0:9808 for kubelet probes, an address without host is bound to localhost (disabled if empty)")
+	flag.DurationVar(&conf.HealthGatewayThreshold, "health-gateway-threshold", time.Minute, "How long a gateway must be unreachable for /healthz to fail")
+	flag.StringVar(&conf.SubsystemStateFile, "subsystem-state-file", "", "Keep the namespaces in use of each subsystem in this file, so subsystems shared by volumes survive restarts (in memory if empty)")
+	flag.IntVar(&conf.MaxControllers, "max-controllers", 0, "Refuse to stage volumes needing a new NVMe controller once the node has this many (unlimited if 0)")
+	flag.StringVar(&conf.DefaultFsType, "default-fstype", "ext4", "Filesystem of volumes whose capability has no fsType, ext4 or xfs")
+	flag.DurationVar(&conf.FormatTimeout, "format-timeout", 0, "Abort mkfs of a filesystem volume taking longer than this, the device is wiped so the retry formats it again (disabled if 0)")
+	flag.IntVar(&conf.MkfsRetries, "mkfs-retries", 0, "Run mkfs again up to this many times when it fails on a device not ready for IO yet, once the device reads fine and is still blank; other mkfs failures aren't retried")
+	flag.DurationVar(&conf.StageTimeout, "stage-timeout", 0, "Fail NodeStageVolume with DeadlineExceeded when connecting, waiting for the device and mounting take longer than this overall, undoing what was done; the RPC deadline applies if earlier (disabled if 0)")
+	flag.DurationVar(&conf.MountTimeout, "mount-timeout", 0, "Fail mount, unmount and mount point check calls of the node with DeadlineExceeded after this long, e.g. on a device without live path; the call itself can't be cancelled and keeps running (disabled if 0)")
+	flag.DurationVar(&conf.DeviceIOCheckTimeout, "device-io-check-timeout", 0, "Read the device of a volume before staging it, retrying this long while it fails or reports size 0, to catch devices not ready for IO yet (disabled if 0)")
+	flag.BoolVar(&conf.DeviceAlias, "device-alias", false, "Link the device of each staged volume at /dev/nvmeof-csi/<volume ID>, \"/\" replaced by \"_\", a path independent of device enumeration order")
+	conf.MountDirMode, conf.BlockFileMode = 0o750, 0o600
+	flag.Func("mount-dir-mode", "Octal mode of the mount point directories created at stage and publish (default 0750)", func(value string) (err error) {
+		conf.MountDirMode, err = util.ParseFileMode(value)
+		return err
+	})
+	flag.Func("block-file-mode", "Octal mode of the target files block volumes are bind mounted on (default 0600)", func(value string) (err error) {
+		conf.BlockFileMode, err = util.ParseFileMode(value)
+		return err
+	})
+	flag.DurationVar(&conf.UdevSettleTimeout, "udev-settle-timeout", 0, "Wait up to this long for udevadm settle after connecting, before resolving the device (disabled if 0)")
+	flag.StringVar(&conf.DeviceResolver, "device-resolver", util.DeviceResolverByID, "How the device of a volume is found after connecting: by-id uses the udev /dev/disk/by-id links, nvme-list matches the namespace uuid of the devices listed by nvme list without needing udev")
+	flag.StringVar(&commandPrefix, "command-prefix", "", "Run the nvme and udevadm commands behind this command, e.g. \"nsenter --target 1 --mount --net --\" to use the tooling of the host, /run/nvmeof-csi must then be shared with the host for connectMode config")
+	flag.DurationVar(&conf.DisconnectCheckDelay, "disconnect-check-delay", 0, "Wait this long after nvme disconnect before checking the device and controllers are gone, the kernel tears them down asynchronously")
+	flag.DurationVar(&conf.DisconnectStableTime, "disconnect-stable-time", 2*time.Second, "Require the device link and controllers to stay gone this long before a disconnect is confirmed")
+	conf.TransportDefaults = map[string]map[string]string{}
+	flag.Func("transport-default", "Connect parameters of a transport used when the StorageClass doesn't set them, <transport>:<key>=<value>[,...] with keys hdrDigest, dataDigest, nrPollQueues and ctrlLossTmo, e.g. tcp:nrPollQueues=2,ctrlLossTmo=600; repeat for each transport", func(value string) error {
+		return util.ParseTransportDefault(value, conf.TransportDefaults)
+	})
+	flag.StringVar(&conf.ExtraConnectArgsAllowlist, "extra-connect-args-allowlist", "", "Comma separated nvme connect long options, e.g. keep-alive-tmo,duplicate-connect, the extraConnectArgs StorageClass parameter may use (none if empty)")
+	flag.IntVar(&conf.GatewayBreakerThreshold, "gateway-breaker-threshold", 5, "Consecutive gateway failures after which gateway calls fail fast with Unavailable (disabled if 0)")
+	flag.DurationVar(&conf.GatewayBreakerCooldown, "gateway-breaker-cooldown", 30*time.Second, "How long gateway calls fail fast before a call probes the gateway again")
+	flag.DurationVar(&conf.ExpandVerifyTimeout, "expand-verify-timeout", time.Minute, "Wait this long for the gateway to report the new size of an expanded volume, and on the node for its device to grow before growing the filesystem")
+	flag.StringVar(&conf.NQNPrefix, "nqn-prefix", util.DefaultNQNPrefix, "Prefix of the subsystem NQNs of StorageClasses with subsystemName instead of SubsystemNqn, the NQN is <prefix>:<subsystemName>")
+	flag.IntVar(&conf.NamespaceAddRetries, "namespace-add-retries", 3, "Retry a transiently failing namespace_add this many times when creating a volume")
+	flag.IntVar(&conf.MaxLoggedOutput, "max-logged-output", 4096, "Truncate the logged output of nvme and udevadm commands to this many bytes, the driver still uses all of it (unlimited if 0)")
+	flag.BoolVar(&conf.AllowLocalDevice, "allow-local-device", false, "Development and csi-sanity only: stage the block device named by device_path in the publish context as is, without connecting to a target")
+	flag.StringVar(&conf.KeepVolumeContext, "keep-volume-context", "", "Debugging only: archive the volume context of each unstaged volume below this dir instead of just deleting it (disabled if empty)")
+	flag.IntVar(&conf.KeepVolumeContextCount, "keep-volume-context-count", 5, fmt.Sprintf("Archived volume contexts kept per volume with -keep-volume-context, at most %d", util.MaxArchivedContexts))
+	flag.StringVar(&conf.ContextDir, "context-dir", "", "Stash the volume context and device of staged volumes in a dir per volume ID below this dir instead of the staging dir, e.g. when the kubelet dir is on tmpfs; must be absolute (the staging dir if empty)")
+	flag.StringVar(&conf.OrphanStagingRoot, "orphan-staging-root", "", "At startup, clean up the staging dirs below this kubelet dir, e.g. /var/lib/kubelet/plugins/kubernetes.io/csi/csi.nvmeof.io, whose volumes aren't mounted anymore, disconnecting their subsystems; can't be used with -context-dir (disabled if empty)")
+	flag.DurationVar(&conf.WatchdogInterval, "watchdog-interval", 0, "Check the controllers of staged volumes this often, connecting again subsystems left without any (disabled if 0)")
+	flag.IntVar(&conf.WatchdogMaxReconnects, "watchdog-max-reconnects", 0, "Failed connects of a subsystem left without controller after which the watchdog gives up until the volume is restaged (unlimited if 0)")
+	flag.DurationVar(&conf.WatchdogReconnectBackoff, "watchdog-reconnect-backoff", 30*time.Second, "Wait after the first failed watchdog connect of a subsystem, doubling with each failure up to 10m")
+	flag.DurationVar(&conf.ForceUnstageTimeout, "force-unstage-timeout", 0, "Report NodeUnstageVolume successful when nvme disconnect hangs for longer than this; the disconnect goes on in the background, retried until it succeeds, and the subsystem can't be staged meanwhile (disabled if 0)")
+	flag.DurationVar(&conf.WarmDisconnectDelay, "warm-disconnect-delay", 0, "Keep a subsystem connected this long after its last volume is unstaged, so a quick restage reuses the connection (disabled if 0)")
+
+	flag.IntVar(&conf.InitiatorLogLevel, "v-initiator", -1, "Log verbosity of the initiator, -v is used when negative")
+	flag.IntVar(&conf.NodeLogLevel, "v-node", -1, "Log verbosity of the node server, -v is used when negative")
+	flag.IntVar(&conf.ControllerLogLevel, "v-controller", -1, "Log verbosity of the controller server, -v is used when negative")
+
+	flag.BoolVar(&printConfig, "print-config", false, "Print the effective configuration, credentials redacted, and exit")
 
 	klog.InitFlags(nil)
 	if err := flag.Set("logtostderr", "true"); err != nil {
 		klog.Exitf("failed to set logtostderr flag: %v", err)
 	}
+	// nvmeofcsi diagnose [--output-format text|json], see runDiagnose
+	if len(os.Args) > 1 && os.Args[1] == diagnoseCommand {
+		os.Exit(runDiagnose(os.Args[2:]))
+	}
 	flag.Parse()
+	util.SetLogLevels(&conf)
+	var err error
+	if conf.CommandPrefix, err = util.ParseCommandPrefix(commandPrefix); err != nil {
+		klog.Exitf("invalid -command-prefix: %v", err)
+	}
+	util.SetInitiatorConfig(&conf)
+
+	if err := util.ValidateDeviceResolver(conf.DeviceResolver); err != nil {
+		klog.Exitf("invalid -device-resolver: %v", err)
+	}
+	if err := util.ValidateFsType(conf.DefaultFsType); err != nil {
+		klog.Exitf("invalid -default-fstype: %v", err)
+	}
+	if err := util.ValidateNQNPrefix(conf.NQNPrefix); err != nil {
+		klog.Exitf("invalid -nqn-prefix: %v", err)
+	}
+	if conf.ContextDir != "" && !filepath.IsAbs(conf.ContextDir) {
+		klog.Exitf("invalid -context-dir %q, it must be an absolute path", conf.ContextDir)
+	}
+	if conf.ContextDir != "" && conf.OrphanStagingRoot != "" {
+		// the reaper finds staging dirs by their stashed volume context, which isn't there with -context-dir
+		klog.Exitf("-orphan-staging-root can't be used with -context-dir")
+	}
+	if conf.KeepVolumeContext != "" && (conf.KeepVolumeContextCount < 1 || conf.KeepVolumeContextCount > util.MaxArchivedContexts) {
+		klog.Exitf("invalid -keep-volume-context-count %d, it must be between 1 and %d", conf.KeepVolumeContextCount, util.MaxArchivedContexts)
+	}
+
+	if err := conf.ResolveNodeID(); err != nil {
+		klog.Exitf("invalid node ID: %v", err)
+	}
+	klog.Infof("Using node ID %s", conf.NodeID)
+
+	if err := conf.LoadControllerClusters(); err != nil {
+		klog.Exitf("failed to load clusters: %v", err)
+	}
 }
 
 func main() {
+	dump, err := conf.Dump()
+	if err != nil {
+		klog.Exitf("%v", err)
+	}
+	if printConfig {
+		fmt.Println(dump)
+		os.Exit(0)
+	}
 	klog.Infof("Starting NvmeOF-CSI driver: %v version: %v", conf.DriverName, driverVersion)
+	klog.Infof("Configuration: %s", dump)
 
 	driver.Run(&conf)
 
@@ -0,0 +1,152 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+// circuitBreaker fast-fails calls to a gateway in a brownout, so retries of
+// pending volumes don't slow down its recovery. After threshold consecutive
+// failures it opens for cooldown, then lets a single probe through, which
+// closes it again on success.
+type circuitBreaker struct {
+	name      string
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    uint64
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown}
+}
+
+// allow tells if a call may go to the gateway
+func (b *circuitBreaker) allow() error {
+	if b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if wait := b.cooldown - time.Since(b.openedAt); wait > 0 {
+			return status.Errorf(codes.Unavailable, "gateway %s is failing, circuit breaker open for another %v",
+				b.name, wait.Round(time.Second))
+		}
+		klog.Infof("gateway %s circuit breaker half-open, probing", b.name)
+		b.state = breakerHalfOpen
+		b.probing = true
+		return nil
+	case breakerHalfOpen:
+		if b.probing {
+			return status.Errorf(codes.Unavailable, "gateway %s is failing, circuit breaker probing", b.name)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// done records the result of a call allowed by allow
+func (b *circuitBreaker) done(err error) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !isGatewayFailure(err) {
+		if b.state != breakerClosed {
+			klog.Infof("gateway %s recovered, circuit breaker closed", b.name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			b.trips++
+		}
+		klog.Warningf("gateway %s failed %d times in a row, circuit breaker open for %v: %v",
+			b.name, b.failures, b.cooldown, err)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+	}
+}
+
+// snapshot returns the state and the number of times the breaker opened
+func (b *circuitBreaker) snapshot() (breakerState, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state, b.trips
+}
+
+// unaryInterceptor guards every call on a gateway connection with b
+func (b *circuitBreaker) unaryInterceptor(ctx context.Context, method string, req, reply any,
+	cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption,
+) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	b.done(err)
+	return err
+}
+
+// isGatewayFailure tells if err means the gateway is unhealthy, rather than
+// refusing a request
+func isGatewayFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
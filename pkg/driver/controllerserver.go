@@ -20,7 +20,10 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -39,16 +42,32 @@ import (
 type controllerServer struct {
 	csi.UnimplementedControllerServer
 	defaultImpl   *csicommon.DefaultControllerServer
-	gatewayClient gatewaypb.GatewayClient
+	gatewayClient gatewaypb.GatewayClient // gateway of volumes without a clusterID, see newGatewayClient
 	grpcConn      *grpc.ClientConn
-	volumeLocks   *util.VolumeLocks
+	// CreateVolume and DeleteVolume lock the volume name, publish and unpublish
+	// the volume ID like the node server, which may share these locks
+	volumeLocks *util.VolumeLocks
+	clusters    map[string]util.ClusterInfo
+	// gateways of the configured clusters, connected on first use, clusterID -> gatewaypb.GatewayClient
+	clusterGateways sync.Map
+	// circuit breaker of each gateway, clusterID -> *circuitBreaker, "" for the default gateway
+	breakers         sync.Map
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// retries of a transiently failing namespace_add in CreateVolume
+	namespaceAddRetries int
+	// of the subsystems named by subsystemName, see util.SubsystemNQN
+	nqnPrefix string
+	// wait for the gateway to report the new size in ControllerExpandVolume
+	expandVerifyTimeout time.Duration
 }
 
 // VolumeIdentifier represents the structured data encoded in VolumeID
 type VolumeIdentifier struct {
 	NSID       uint32 `json:"nsid"`
 	NQN        string `json:"nqn"`
-	VolumeName string `json:"volume_name"` // Original PVC name for consistent locking
+	VolumeName string `json:"volume_name"`          // Original PVC name for consistent locking
+	ClusterID  string `json:"cluster_id,omitempty"` // routes gateway calls, empty for the default gateway
 }
 
 // Helper function to encode VolumeIdentifier into VolumeID
@@ -76,14 +95,65 @@ func decodeVolumeID(volumeID string) (*VolumeIdentifier, error) {
 	return &identifier, nil
 }
 
-func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if err := util.ValidateVolumeCapabilities(req.GetVolumeCapabilities(),
+		cs.defaultImpl.Driver.GetVolumeCapabilityAccessModes()); err != nil {
+		return nil, err
+	}
+
+	if _, _, err := util.ParseDigests(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := util.ParseNrPollQueues(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := util.ParseCtrlLossTmo(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, _, err := util.ParseConnectMode(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := util.ParseMinPaths(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := util.ParseExtraConnectArgs(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := util.ParsePreferredTraddr(req.GetParameters()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the layout is fixed at image creation, namespace_add creates the image
+	// with the defaults of the cluster and has no field for another one
+	layout, err := util.ParseImageLayout(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !layout.IsDefault() {
+		return nil, status.Errorf(codes.InvalidArgument, "image layout %+v isn't supported, the gateway creates images with %d byte objects and no striping",
+			layout, util.DefaultObjectSize)
+	}
+	nqn, err := util.SubsystemNQN(req.GetParameters(), cs.nqnPrefix)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// the gateway API can't clone or restore an image, an empty volume
+	// mustn't be handed out as a copy of its source
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "creating a volume from a snapshot or volume isn't supported")
+	}
+
 	volumeName := req.GetName()
+	owner := util.ParseK8sObjects(req.GetParameters())
+	klog.Infof("CreateVolume called for volume %s (%s)", volumeName, owner)
 	unlock := cs.volumeLocks.Lock(volumeName)
 	defer unlock()
 
-	csiVolume, err := cs.createVolume(req)
+	csiVolume, err := cs.createVolume(ctx, req, nqn)
 	if err != nil {
 		klog.Errorf("failed to create volume, volumeID: %s err: %v", volumeName, err)
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
@@ -94,14 +164,34 @@ func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolum
 	for k, v := range req.GetParameters() {
 		csiVolume.VolumeContext[k] = v
 	}
-	klog.Infof("Volume created successfully: %s with VolumeID: %s", volumeName, csiVolume.VolumeId)
+	klog.Infof("Volume created successfully: %s (%s) with VolumeID: %s", volumeName, owner, csiVolume.VolumeId)
+	logAccessEnforcement(volumeName, nqn, req.GetVolumeCapabilities())
 	return &csi.CreateVolumeResponse{Volume: csiVolume}, nil
 }
 
+// logAccessEnforcement tells that single node access modes aren't enforced by
+// the gateway. Restricting a namespace to one host takes adding it with
+// no_auto_visible and then the host NQN to it, the gateway API has no call for
+// the latter, and the host isn't known before ControllerPublishVolume anyway.
+// The namespace is left visible to every host allowed on the subsystem.
+func logAccessEnforcement(volumeName, nqn string, caps []*csi.VolumeCapability) {
+	for _, capability := range caps {
+		switch mode := capability.GetAccessMode().GetMode(); mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+			klog.Infof("volume %s is %s, enforced by the CO only: the gateway has no per namespace host ACL, "+
+				"every host allowed on subsystem %s can connect it", volumeName, mode, nqn)
+			return
+		}
+	}
+}
+
 // createVolume handles the actual creation logic, including communication with the Gateway
-func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*csi.Volume, error) {
+func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest, nqn string) (*csi.Volume, error) {
 	var (
-		resp *gatewaypb.NsidStatus
+		nsid uint32
 		err  error
 	)
 	size := req.GetCapacityRange().GetRequiredBytes()
@@ -110,14 +200,17 @@ func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*csi.Vol
 		size = 1 * 200 * 1024 * 1024 // 200MB
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	clusterID := req.GetParameters()["clusterID"]
+	gateway, err := cs.gatewayFor(clusterID)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build namespace_add_req
 	nsReq := &gatewaypb.NamespaceAddReq{
 		RbdPoolName:       req.GetParameters()["RbdPoolName"],
 		RbdImageName:      req.GetName(),
-		SubsystemNqn:      req.GetParameters()["SubsystemNqn"],
+		SubsystemNqn:      nqn,
 		BlockSize:         4096,
 		CreateImage:       proto.Bool(true),
 		Size:              proto.Uint64(uint64(size)),
@@ -125,20 +218,36 @@ func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*csi.Vol
 		DisableAutoResize: proto.Bool(false),
 	}
 
-	// Call Gateway
-	resp, err = cs.gatewayClient.NamespaceAdd(ctx, nsReq)
+	// CreateVolume is idempotent on the volume name, a retry after a crash
+	// finds the namespace created by the previous attempt on the gateway
+	existing, err := cs.findNamespace(ctx, gateway, nsReq)
 	if err != nil {
-		return nil, fmt.Errorf("gateway NamespaceAdd failed: %w", err)
+		return nil, err
 	}
-	if resp.GetStatus() != 0 {
-		return nil, fmt.Errorf("gateway NamespaceAdd returned error: %s", resp.GetErrorMessage())
+	if existing == nil {
+		if existing, err = cs.addNamespace(ctx, gateway, nsReq); err != nil {
+			return nil, err
+		}
+	} else {
+		klog.Infof("volume %s already exists as namespace %d of %s", req.GetName(), existing.GetNsid(), nsReq.SubsystemNqn)
+	}
+	// an image found on the gateway may be smaller than requested
+	if existing.GetRbdImageSize() != 0 && existing.GetRbdImageSize() < uint64(size) {
+		return nil, status.Errorf(codes.AlreadyExists,
+			"volume %s already exists with size %d, smaller than the requested %d",
+			req.GetName(), existing.GetRbdImageSize(), size)
+	}
+	nsid = existing.GetNsid()
+	if existing.GetRbdImageSize() != 0 {
+		size = int64(existing.GetRbdImageSize())
 	}
 
 	// Create structured volume identifier
 	volumeIdentifier := VolumeIdentifier{
-		NSID:       resp.GetNsid(),
+		NSID:       nsid,
 		NQN:        nsReq.SubsystemNqn,
 		VolumeName: req.GetName(), // Store original volume name for locking
+		ClusterID:  clusterID,
 	}
 
 	// Encode to create VolumeID
@@ -152,30 +261,145 @@ func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*csi.Vol
 		VolumeId:      volumeID, // contains NSID, NQN, and volume name
 		CapacityBytes: size,
 		VolumeContext: map[string]string{
-			"nqn":       nsReq.SubsystemNqn,
-			"traddr":    req.GetParameters()["traddr"],
-			"trsvcid":   req.GetParameters()["trsvcid"],
-			"transport": req.GetParameters()["transport"],
-			"image":     nsReq.RbdImageName,
+			"nqn":        nsReq.SubsystemNqn,
+			"traddr":     req.GetParameters()["traddr"],
+			"trsvcid":    req.GetParameters()["trsvcid"],
+			"transport":  req.GetParameters()["transport"],
+			"image":      nsReq.RbdImageName,
+			util.NsidKey: strconv.FormatUint(uint64(nsid), 10),
 		},
-		ContentSource: req.GetVolumeContentSource(),
 	}
 	return vol, nil
 }
 
-func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	// make sure we support all requested caps
-	for _, cap := range req.VolumeCapabilities {
-		supported := false
-		for _, accessMode := range cs.defaultImpl.Driver.GetVolumeCapabilityAccessModes() {
-			if cap.GetAccessMode().GetMode() == accessMode.GetMode() {
-				supported = true
-				break
+// findVolumeByName returns the namespace of subsystemNQN backed by the named
+// image in poolName, or nil when the gateway has no such namespace
+func (cs *controllerServer) findVolumeByName(ctx context.Context, gateway gatewaypb.GatewayClient, subsystemNQN, poolName, name string) (*gatewaypb.NamespaceCli, error) {
+	resp, err := gateway.ListNamespaces(ctx, &gatewaypb.ListNamespacesReq{Subsystem: subsystemNQN})
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range resp.GetNamespaces() {
+		if ns.GetRbdImageName() == name && ns.GetRbdPoolName() == poolName {
+			return ns, nil
+		}
+	}
+	return nil, nil
+}
+
+// findNamespace returns the namespace of the image of nsReq, nil if there's none
+func (cs *controllerServer) findNamespace(ctx context.Context, gateway gatewaypb.GatewayClient, nsReq *gatewaypb.NamespaceAddReq) (*gatewaypb.NamespaceCli, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return cs.findVolumeByName(ctx, gateway, nsReq.GetSubsystemNqn(), nsReq.GetRbdPoolName(), nsReq.GetRbdImageName())
+}
+
+// addNamespace creates the image of nsReq and maps it as a namespace, the
+// namespace_add of the gateway does both. Transient failures are retried up to
+// namespaceAddRetries times, each retry first looking for a namespace added by
+// an attempt whose reply got lost. An image left by an attempt whose mapping
+// failed is mapped as is. Once ctx is done it gives up without a rollback, the
+// provisioner retrying the volume finds what the attempts added.
+func (cs *controllerServer) addNamespace(ctx context.Context, gateway gatewaypb.GatewayClient, nsReq *gatewaypb.NamespaceAddReq) (*gatewaypb.NamespaceCli, error) {
+	image := nsReq.GetRbdPoolName() + "/" + nsReq.GetRbdImageName()
+	var err error
+	for attempt := 0; attempt <= cs.namespaceAddRetries; attempt++ {
+		if attempt > 0 {
+			delay := time.Duration(attempt) * time.Second
+			klog.Warningf("adding a namespace for image %s failed, retrying in %v: %v", image, delay, err)
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, status.FromContextError(ctx.Err()).Err()
+			case <-timer.C:
+			}
+			if existing, findErr := cs.findNamespace(ctx, gateway, nsReq); findErr == nil && existing != nil {
+				return existing, nil
 			}
 		}
-		if !supported {
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: ""}, nil
+		var nsid uint32
+		nsid, err = namespaceAdd(ctx, gateway, nsReq)
+		if err == nil {
+			if !nsReq.GetCreateImage() {
+				// the size of an existing image is checked by the caller
+				return cs.findNamespace(ctx, gateway, nsReq)
+			}
+			return &gatewaypb.NamespaceCli{Nsid: nsid, RbdImageSize: nsReq.GetSize()}, nil
+		}
+		switch status.Code(err) {
+		case codes.AlreadyExists:
+			// the image is there, created by an earlier attempt whose mapping failed
+			klog.Infof("image %s already exists, mapping it as is", image)
+			nsReq.CreateImage = proto.Bool(false)
+		case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Internal:
+		default:
+			return nil, err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if status.Code(err) == codes.Aborted {
+		// still in progress on the gateway, the provisioner retries once it's done
+		return nil, err
+	}
+	cs.rollbackImage(gateway, nsReq)
+	return nil, err
+}
+
+// namespaceAdd runs a single namespace_add and returns the nsid
+func namespaceAdd(ctx context.Context, gateway gatewaypb.GatewayClient, nsReq *gatewaypb.NamespaceAddReq) (uint32, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	resp, err := gateway.NamespaceAdd(ctx, nsReq)
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetNsid(), nil
+}
+
+// rollbackImage cleans up after addNamespace gave up, best effort. A namespace
+// added though its reply was lost is deleted. The gateway API can't delete an
+// image without a namespace, one an attempt may have created is only logged.
+func (cs *controllerServer) rollbackImage(gateway gatewaypb.GatewayClient, nsReq *gatewaypb.NamespaceAddReq) {
+	image := nsReq.GetRbdPoolName() + "/" + nsReq.GetRbdImageName()
+	existing, err := cs.findNamespace(context.Background(), gateway, nsReq)
+	if err != nil {
+		klog.Errorf("rollback: failed to look up the namespace of image %s, it may be left behind: %v", image, err)
+		return
+	}
+	if existing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = gateway.NamespaceDelete(ctx, &gatewaypb.NamespaceDeleteReq{
+			Nsid:         existing.GetNsid(),
+			SubsystemNqn: nsReq.GetSubsystemNqn(),
+		})
+		if err != nil {
+			klog.Errorf("rollback: failed to delete namespace %d of image %s: %v", existing.GetNsid(), image, err)
+			return
 		}
+		klog.Infof("rollback: deleted namespace %d of image %s", existing.GetNsid(), image)
+	}
+	klog.Errorf("rollback: image %s may be left without a namespace, remove it with rbd rm once the gateway recovers", image)
+}
+
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing in request")
+	}
+	// static PVs name namespaces created out of band, make sure it's there
+	if _, _, err := cs.lookupVolume(ctx, req.GetVolumeId(), req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+	// make sure we support all requested caps
+	if err := util.ValidateVolumeCapabilities(req.GetVolumeCapabilities(),
+		cs.defaultImpl.Driver.GetVolumeCapabilityAccessModes()); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
 	}
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
@@ -184,33 +408,76 @@ func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 	}, nil
 }
 
-func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	klog.Infof("Publishing volume %s to node %s", req.VolumeId, req.NodeId)
-	nqn := req.VolumeContext["nqn"]
-	nsListReq := &gatewaypb.ListNamespacesReq{ //TODO - maybe i can create by Nsid and not Nqn
-		Subsystem: nqn,
+// lookupVolume resolves the gateway namespace of volumeID, returning it with
+// the subsystem NQN it belongs to. The volume context wins over the volume ID,
+// static PVs may carry either or both. A static PV whose volume handle isn't
+// an ID of this driver is resolved by the nqn and image of its volume context.
+func (cs *controllerServer) lookupVolume(ctx context.Context, volumeID string, volumeContext map[string]string) (*gatewaypb.NamespaceCli, string, error) {
+	identifier, err := decodeVolumeID(volumeID)
+	if err != nil {
+		if volumeContext["nqn"] == "" || volumeContext["image"] == "" {
+			return nil, "", status.Errorf(codes.NotFound, "volume %s not found: %v", volumeID, err)
+		}
+		identifier = &VolumeIdentifier{}
 	}
-
-	nsListResp, err := cs.gatewayClient.ListNamespaces(ctx, nsListReq)
+	nqn := volumeContext["nqn"]
+	if nqn == "" {
+		nqn = identifier.NQN
+	}
+	clusterID := volumeContext["clusterID"]
+	if clusterID == "" {
+		clusterID = identifier.ClusterID
+	}
+	gateway, err := cs.gatewayFor(clusterID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+		return nil, "", err
 	}
 
-	var targetUUID string
-	imageName := req.VolumeContext["image"]
-	for _, ns := range nsListResp.GetNamespaces() {
-		// print the ns
-		klog.Infof("Found namespace: %s, UUID: %s, Image: %s", ns.GetNsSubsystemNqn(), ns.GetUuid(), ns.GetRbdImageName())
-		if ns.GetRbdImageName() == imageName {
-			targetUUID = ns.GetUuid()
-			break
+	gwCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if imageName := volumeContext["image"]; imageName != "" {
+		nsListResp, err := gateway.ListNamespaces(gwCtx, &gatewaypb.ListNamespacesReq{Subsystem: nqn})
+		if err != nil {
+			return nil, "", err
+		}
+		for _, ns := range nsListResp.GetNamespaces() {
+			util.V(util.LogController, 4).Infof("Found namespace: %s, UUID: %s, Image: %s", ns.GetNsSubsystemNqn(), ns.GetUuid(), ns.GetRbdImageName())
+			if ns.GetRbdImageName() == imageName {
+				return ns, nqn, nil
+			}
 		}
+		return nil, "", status.Errorf(codes.NotFound, "image %s of volume %s not found in %s", imageName, volumeID, nqn)
+	}
+
+	ns, err := util.LookupNamespace(gwCtx, gateway, nqn, identifier.NSID)
+	if errors.Is(err, util.ErrNamespaceNotFound) {
+		return nil, "", status.Errorf(codes.NotFound, "volume %s: %v", volumeID, err)
+	}
+	if err != nil {
+		return nil, "", err // the gateway's status error
+	}
+	return ns, nqn, nil
+}
+
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	klog.Infof("Publishing volume %s to node %s", req.VolumeId, req.NodeId)
+	unlock, ok := cs.volumeLocks.TryAcquire(req.GetVolumeId())
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetVolumeId())
 	}
+	defer unlock()
+	ns, nqn, err := cs.lookupVolume(ctx, req.GetVolumeId(), req.GetVolumeContext())
+	if err != nil {
+		return nil, err
+	}
+	targetUUID := ns.GetUuid()
 	if targetUUID == "" {
-		return nil, fmt.Errorf("UUID not found for volume %s", req.VolumeId)
+		return nil, status.Errorf(codes.NotFound, "UUID not found for volume %s", req.VolumeId)
 	}
 
-	// You could now "notify" the node, or embed the UUID in context for NodePublishVolume
+	// the gateway API doesn't list the listeners of a subsystem, the address
+	// and transport are taken from the volume context, a static PV must set
+	// traddr, trsvcid and transport, or discovery_traddr, as the StorageClass does
 	publishContext := map[string]string{
 		"uuid":      targetUUID,
 		"nqn":       nqn,
@@ -218,6 +485,19 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 		"trsvcid":   req.VolumeContext["trsvcid"],
 		"transport": req.VolumeContext["transport"],
 	}
+	if nsid := ns.GetNsid(); nsid != 0 {
+		// lets the node tell the device apart by nsid too
+		publishContext[util.NsidKey] = strconv.FormatUint(uint64(nsid), 10)
+	}
+	for k, v := range util.ConnectPublishContext(req.VolumeContext) {
+		publishContext[k] = v
+	}
+	for k, v := range util.DiscoveryPublishContext(req.VolumeContext) {
+		publishContext[k] = v
+	}
+	if hostAddr := req.VolumeContext["host_traddr"]; hostAddr != "" {
+		publishContext["host_traddr"] = hostAddr
+	}
 
 	klog.Infof("Volume published successfully: %s with UUID: %s", req.VolumeId, targetUUID)
 	return &csi.ControllerPublishVolumeResponse{
@@ -227,6 +507,11 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	klog.Infof("Unpublishing volume %s from node %s", req.VolumeId, req.NodeId)
+	unlock, ok := cs.volumeLocks.TryAcquire(req.GetVolumeId())
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, req.GetVolumeId())
+	}
+	defer unlock()
 
 	// For NVMe-oF, unpublishing is typically handled at the node level
 	// Controller just acknowledges the request
@@ -249,47 +534,101 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 
 	klog.Infof("Deleting volume: %s (NSID: %d, NQN: %s)", identifier.VolumeName, identifier.NSID, identifier.NQN)
 
+	gateway, err := cs.gatewayFor(identifier.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+
 	nsDelReq := &gatewaypb.NamespaceDeleteReq{
 		Nsid:         identifier.NSID,
 		SubsystemNqn: identifier.NQN,
 	}
 	gwCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	resp, err := cs.gatewayClient.NamespaceDelete(gwCtx, nsDelReq)
+	_, err = gateway.NamespaceDelete(gwCtx, nsDelReq)
+	if status.Code(err) == codes.NotFound {
+		// DeleteVolume is idempotent, a retry finds the namespace gone
+		klog.Infof("Volume %s already deleted: %v", identifier.VolumeName, err)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 	if err != nil {
 		klog.Errorf("gateway NamespaceDelete failed for volume %s: %v", identifier.VolumeName, err)
-		return nil, status.Errorf(codes.Internal, "gateway NamespaceRemove failed: %v", err)
-	}
-	if resp.GetStatus() != 0 {
-		klog.Errorf("gateway returned error for volume %s: %s", identifier.VolumeName, resp.GetErrorMessage())
-		return nil, status.Errorf(codes.Internal, "gateway returned error: %s", resp.GetErrorMessage())
+		return nil, err
 	}
 
 	klog.Infof("Volume deleted successfully: %s", identifier.VolumeName)
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
+func newControllerServer(d *csicommon.CSIDriver, conf *util.Config, volumeLocks *util.VolumeLocks) (*controllerServer, error) {
 	// Connect to Gateway gRPC server
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	conn, err := grpc.DialContext(ctx, "10.242.64.32:5500", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	server := &controllerServer{
+		defaultImpl:         csicommon.NewDefaultControllerServer(d),
+		volumeLocks:         volumeLocks,
+		clusters:            conf.Clusters,
+		breakerThreshold:    conf.GatewayBreakerThreshold,
+		breakerCooldown:     conf.GatewayBreakerCooldown,
+		namespaceAddRetries: conf.NamespaceAddRetries,
+		expandVerifyTimeout: conf.ExpandVerifyTimeout,
+		nqnPrefix:           conf.NQNPrefix,
+	}
+
+	conn, err := grpc.DialContext(ctx, conf.GatewayAddress, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(),
+		grpc.WithUnaryInterceptor(server.breakerFor("", conf.GatewayAddress).unaryInterceptor))
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to Gateway gRPC server: %w", err)
 	}
+	server.grpcConn = conn
+	server.gatewayClient = newGatewayClient(conn)
 
-	server := &controllerServer{
-		defaultImpl:   csicommon.NewDefaultControllerServer(d),
-		grpcConn:      conn,
-		gatewayClient: gatewaypb.NewGatewayClient(conn),
-		volumeLocks:   util.NewVolumeLocks(),
+	return server, nil
+}
+
+// breakerFor returns the circuit breaker of the gateway of clusterID
+func (cs *controllerServer) breakerFor(clusterID, address string) *circuitBreaker {
+	name := address
+	if clusterID != "" {
+		name = fmt.Sprintf("%s (cluster %s)", address, clusterID)
 	}
+	b, _ := cs.breakers.LoadOrStore(clusterID, newCircuitBreaker(name, cs.breakerThreshold, cs.breakerCooldown))
+	return b.(*circuitBreaker) //nolint:errcheck // only *circuitBreaker is stored
+}
 
-	return server, nil
+// gatewayFor returns the gateway client serving clusterID, the default
+// gateway serves volumes without a clusterID
+func (cs *controllerServer) gatewayFor(clusterID string) (gatewaypb.GatewayClient, error) {
+	if clusterID == "" {
+		return cs.gatewayClient, nil
+	}
+	if client, ok := cs.clusterGateways.Load(clusterID); ok {
+		return client.(gatewaypb.GatewayClient), nil //nolint:errcheck // only GatewayClient is stored
+	}
+
+	cluster, ok := cs.clusters[clusterID]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown clusterID %s", clusterID)
+	}
+	creds, err := gatewayCredentials(cluster)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load gateway credentials of cluster %s: %v", clusterID, err)
+	}
+	conn, err := grpc.NewClient(cluster.GatewayAddress, creds,
+		grpc.WithUnaryInterceptor(cs.breakerFor(clusterID, cluster.GatewayAddress).unaryInterceptor))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create gateway client for cluster %s: %v", clusterID, err)
+	}
+	klog.Infof("Using gateway %s for cluster %s", cluster.GatewayAddress, clusterID)
+	client, loaded := cs.clusterGateways.LoadOrStore(clusterID, newGatewayClient(conn))
+	if loaded {
+		conn.Close()
+	}
+	return client.(gatewaypb.GatewayClient), nil //nolint:errcheck // only GatewayClient is stored
 }
 
 func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
-	klog.V(4).Info("Forwarding ControllerGetCapabilities to defaultImpl")
+	util.V(util.LogController, 4).Info("Forwarding ControllerGetCapabilities to defaultImpl")
 	return cs.defaultImpl.ControllerGetCapabilities(ctx, req)
 }
@@ -0,0 +1,273 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	csicommon "github.com/ceph/ceph-nvmeof-csi/pkg/csi-common"
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+	gatewaypb "github.com/ceph/ceph-nvmeof-csi/proto"
+)
+
+// TestCreateVolumeImageLayout checks the layout parameters are refused
+// before the gateway is called, the boundaries are covered by
+// TestParseImageLayout of package util
+func TestCreateVolumeImageLayout(t *testing.T) {
+	d := csicommon.NewCSIDriver("csi.nvmeof.io", "test", "node1")
+	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	cs := &controllerServer{
+		defaultImpl: csicommon.NewDefaultControllerServer(d),
+		volumeLocks: util.NewVolumeLocks(),
+	}
+
+	tests := []struct {
+		name    string
+		layout  map[string]string
+		wantErr string
+	}{
+		{"incoherent", map[string]string{"objectSize": "4096", "stripeUnit": "8192", "stripeCount": "2"}, "invalid stripeUnit"},
+		{"striped", map[string]string{"stripeUnit": "65536", "stripeCount": "16"}, "isn't supported"},
+		{"larger objects", map[string]string{"objectSize": "8388608"}, "isn't supported"},
+		// passes on to the gateway lookup, which fails on the unknown cluster
+		{"default", map[string]string{"objectSize": "4194304", "stripeUnit": "4194304", "stripeCount": "1"}, "unknown clusterID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := map[string]string{"SubsystemNqn": "nqn.2016-06.io.spdk:cnode1", "clusterID": "unknown"}
+			for k, v := range tt.layout {
+				params[k] = v
+			}
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+				Name: "vol1",
+				VolumeCapabilities: []*csi.VolumeCapability{{
+					AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				}},
+				Parameters: params,
+			})
+			if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("CreateVolume: %v, want InvalidArgument with %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeCert signs a certificate for 127.0.0.1 with parent, self signed if nil,
+// and writes it and its key as PEM files in dir
+func writeCert(t *testing.T, dir, name string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// TestGatewayForTLS checks the gateway of a cluster is reached with the TLS
+// files of the cluster, a gateway requiring client certificates refusing
+// a plaintext one
+func TestGatewayForTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	writeCert(t, dir, "gateway", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeCert(t, dir, "controller", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "gateway.crt"), filepath.Join(dir, "gateway.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})))
+	gatewaypb.RegisterGatewayServer(server, gatewaypb.UnimplementedGatewayServer{})
+	go server.Serve(listener) //nolint:errcheck // ends with Stop
+	t.Cleanup(server.Stop)
+
+	address := listener.Addr().String()
+	cs := &controllerServer{clusters: map[string]util.ClusterInfo{
+		"ceph-a": {
+			ClusterID:       "ceph-a",
+			GatewayAddress:  address,
+			GatewayCAFile:   filepath.Join(dir, "ca.crt"),
+			GatewayCertFile: filepath.Join(dir, "controller.crt"),
+			GatewayKeyFile:  filepath.Join(dir, "controller.key"),
+		},
+		"plaintext": {ClusterID: "plaintext", GatewayAddress: address},
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	listNamespaces := func(clusterID string) error {
+		gateway, err := cs.gatewayFor(clusterID)
+		if err != nil {
+			t.Fatalf("gatewayFor(%s): %v", clusterID, err)
+		}
+		_, err = gateway.ListNamespaces(ctx, &gatewaypb.ListNamespacesReq{Subsystem: "nqn.2016-06.io.spdk:cnode1"})
+		return err
+	}
+	// the gateway answers, Unimplemented by the test server
+	if err := listNamespaces("ceph-a"); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ListNamespaces over TLS: %v, want Unimplemented from the gateway", err)
+	}
+	if err := listNamespaces("plaintext"); status.Code(err) != codes.Unavailable {
+		t.Errorf("ListNamespaces in plaintext: %v, want Unavailable", err)
+	}
+}
+
+// unavailableGateway fails every namespace_add as if the gateway were
+// restarting, counting the calls
+type unavailableGateway struct {
+	gatewaypb.UnimplementedGatewayServer
+	adds    atomic.Int32
+	deletes atomic.Int32
+}
+
+func (g *unavailableGateway) NamespaceAdd(context.Context, *gatewaypb.NamespaceAddReq) (*gatewaypb.NsidStatus, error) {
+	g.adds.Add(1)
+	return nil, status.Error(codes.Unavailable, "gateway restarting")
+}
+
+func (g *unavailableGateway) NamespaceDelete(context.Context, *gatewaypb.NamespaceDeleteReq) (*gatewaypb.ReqStatus, error) {
+	g.deletes.Add(1)
+	return &gatewaypb.ReqStatus{}, nil
+}
+
+func (g *unavailableGateway) ListNamespaces(context.Context, *gatewaypb.ListNamespacesReq) (*gatewaypb.NamespacesInfo, error) {
+	return &gatewaypb.NamespacesInfo{}, nil
+}
+
+// TestCreateVolumeContextDone checks the namespace_add retries stop once the
+// provisioner's deadline passes, without a rollback
+func TestCreateVolumeContextDone(t *testing.T) {
+	gateway := &unavailableGateway{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	gatewaypb.RegisterGatewayServer(server, gateway)
+	go server.Serve(listener) //nolint:errcheck // ends with Stop
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	d := csicommon.NewCSIDriver("csi.nvmeof.io", "test", "node1")
+	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER})
+	cs := &controllerServer{
+		defaultImpl:         csicommon.NewDefaultControllerServer(d),
+		volumeLocks:         util.NewVolumeLocks(),
+		gatewayClient:       newGatewayClient(conn),
+		namespaceAddRetries: 5, // 15s of backoff in total
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol1",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: map[string]string{"SubsystemNqn": "nqn.2016-06.io.spdk:cnode1", "RbdPoolName": "rbd"},
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("CreateVolume past its deadline: %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("CreateVolume returned after %v, want it to stop at the deadline", elapsed)
+	}
+	if adds := gateway.adds.Load(); adds != 1 {
+		t.Errorf("namespace_add called %d times, want 1 before the deadline", adds)
+	}
+	if deletes := gateway.deletes.Load(); deletes != 0 {
+		t.Errorf("namespace_delete called %d times, want no rollback", deletes)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// bound of the disconnect/connect cycle of /reconnect
+const debugReconnectTimeout = 2 * time.Minute
+
+// debugServer serves node local troubleshooting endpoints over plain http,
+// it should only be bound to localhost
+type debugServer struct {
+	ns *nodeServer
+}
+
+func newDebugHandler(ns *nodeServer) http.Handler {
+	ds := &debugServer{ns: ns}
+
+	mux := http.NewServeMux()
+	// POST /reconnect?volume_id=<volumeID>
+	mux.HandleFunc("/reconnect", ds.handleReconnect)
+	// GET /volumes
+	mux.HandleFunc("/volumes", ds.handleVolumes)
+	// GET /pause, POST /pause?paused=<true|false>
+	mux.HandleFunc("/pause", ds.handlePause)
+	return mux
+}
+
+// volumeStatus is a staged volume as listed by /volumes
+type volumeStatus struct {
+	VolumeID          string   `json:"volumeID"`
+	NQN               string   `json:"nqn"`
+	DevicePath        string   `json:"devicePath"`
+	ControllerStates  []string `json:"controllerStates"`
+	Connected         bool     `json:"connected"`
+	StagingParentPath string   `json:"stagingPath"`
+	TargetPaths       []string `json:"targetPaths"`
+}
+
+func (ds *debugServer) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	volumes := []volumeStatus{}
+	ds.ns.stagedVolumes.Range(func(key, value any) bool {
+		vol, _ := value.(*stagedVolume) //nolint:errcheck // only *stagedVolume is stored
+		volumeID, _ := key.(string)     //nolint:errcheck // only string keys are stored
+		nqn := vol.publishContext["nqn"]
+		states, err := util.ControllerStates(nqn)
+		if err != nil {
+			klog.Warningf("failed to read the controllers of %s: %v", nqn, err)
+		}
+
+		vol.mu.Lock()
+		status := volumeStatus{
+			VolumeID:          volumeID,
+			NQN:               nqn,
+			DevicePath:        vol.devicePath,
+			ControllerStates:  states,
+			Connected:         slices.Contains(states, "live"),
+			StagingParentPath: vol.stagingParentPath,
+			TargetPaths:       []string{},
+		}
+		for targetPath := range vol.targetPaths {
+			status.TargetPaths = append(status.TargetPaths, targetPath)
+		}
+		vol.mu.Unlock()
+		sort.Strings(status.TargetPaths)
+		volumes = append(volumes, status)
+		return true
+	})
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].VolumeID < volumes[j].VolumeID })
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(volumes); err != nil {
+		klog.Warningf("failed to write /volumes response: %v", err)
+	}
+}
+
+func (ds *debugServer) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	volumeID := r.URL.Query().Get("volume_id")
+	if volumeID == "" {
+		http.Error(w, "volume_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// a client going away between the disconnect and the connect of the cycle
+	// would leave the staged volume disconnected
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), debugReconnectTimeout)
+	defer cancel()
+	devicePath, err := ds.ns.reconnectVolume(ctx, volumeID)
+	if err != nil {
+		klog.Errorf("debug reconnect of volume %s failed: %v", volumeID, err)
+		code := http.StatusInternalServerError
+		switch status.Code(err) {
+		case codes.NotFound:
+			code = http.StatusNotFound
+		case codes.FailedPrecondition, codes.Aborted:
+			code = http.StatusConflict
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	fmt.Fprintf(w, "volume %s reconnected at %s\n", volumeID, devicePath)
+}
+
+func (ds *debugServer) handlePause(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		paused, err := strconv.ParseBool(r.URL.Query().Get("paused"))
+		if err != nil {
+			http.Error(w, "paused must be true or false", http.StatusBadRequest)
+			return
+		}
+		ds.ns.setPaused(paused, "the debug endpoint")
+	default:
+		http.Error(w, "only GET and POST are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "node server %s\n", pausedState(ds.ns.paused.Load()))
+}
+
+// newPprofHandler serves the net/http/pprof profiles under /debug/pprof/
+func newPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startHTTPServer serves handler on address in the background. An address
+// without host, e.g. ":6060", is bound to localhost.
+func startHTTPServer(name, address string, handler http.Handler) *http.Server {
+	if host, port, err := net.SplitHostPort(address); err == nil && host == "" {
+		address = net.JoinHostPort("localhost", port)
+	}
+	server := &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		klog.Infof("Serving %s on %s", name, address)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("%s server failed: %v", name, err)
+		}
+	}()
+	return server
+}
+
+// stopHTTPServers gracefully shuts down servers started by startHTTPServer
+func stopHTTPServers(servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Warningf("failed to shutdown http server on %s: %v", server.Addr, err)
+		}
+	}
+}
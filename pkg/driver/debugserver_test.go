@@ -0,0 +1,144 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// stageForReconnect stages volumeID on the namespace uuid of the subsystem
+// nqn through the fake initiator, with secrets
+func stageForReconnect(t *testing.T, ns *nodeServer, volumeID, nqn, uuid string, secrets map[string]string) {
+	t.Helper()
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId: volumeID,
+		PublishContext: map[string]string{
+			"nqn":       nqn,
+			"uuid":      uuid,
+			"traddr":    "192.168.1.10",
+			"trsvcid":   "4420",
+			"transport": "tcp",
+		},
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		Secrets: secrets,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume of %s: %v", volumeID, err)
+	}
+}
+
+func TestReconnectVolumeRefused(t *testing.T) {
+	const (
+		nqn  = "nqn.2016-06.io.spdk:cnode1"
+		uuid = "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c"
+	)
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, ns *nodeServer, initiator *fakeInitiator)
+		wantCode codes.Code
+	}{
+		{"not staged", func(*testing.T, *nodeServer, *fakeInitiator) {}, codes.NotFound},
+		{"volume busy", func(t *testing.T, ns *nodeServer, initiator *fakeInitiator) {
+			stageForReconnect(t, ns, "vol-1", nqn, uuid, nil)
+			unlock := ns.volumeLocks.Lock("vol-1")
+			t.Cleanup(unlock)
+		}, codes.Aborted},
+		{"authenticated", func(t *testing.T, ns *nodeServer, initiator *fakeInitiator) {
+			stageForReconnect(t, ns, "vol-1", nqn, uuid, map[string]string{"dhchapSecret": "DHHC-1:00:c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0c2VjcmV0:"})
+		}, codes.FailedPrecondition},
+		{"shared subsystem", func(t *testing.T, ns *nodeServer, initiator *fakeInitiator) {
+			stageForReconnect(t, ns, "vol-1", nqn, uuid, nil)
+			initiator.devicePath = fakeDevice(t)
+			stageForReconnect(t, ns, "vol-2", nqn, "1b2c3d4e-5f60-4718-8a9b-0c1d2e3f4a5b", nil)
+		}, codes.FailedPrecondition},
+		{"preexisting subsystem", func(t *testing.T, ns *nodeServer, initiator *fakeInitiator) {
+			stageForReconnect(t, ns, "vol-1", nqn, uuid, nil)
+			ns.preexistingNQNs = map[string]struct{}{nqn: {}}
+		}, codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, _ := newTestNodeServer(t, &util.Config{})
+			initiator := &fakeInitiator{devicePath: fakeDevice(t)}
+			initiator.use(ns)
+			tt.setup(t, ns, initiator)
+
+			_, err := ns.reconnectVolume(context.Background(), "vol-1")
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("reconnectVolume: %v, want code %v", err, tt.wantCode)
+			}
+			if initiator.disconnects != 0 {
+				t.Errorf("refused reconnect disconnected %d times", initiator.disconnects)
+			}
+		})
+	}
+}
+
+func TestReconnectVolume(t *testing.T) {
+	ns, _ := newTestNodeServer(t, &util.Config{})
+	initiator := &fakeInitiator{devicePath: fakeDevice(t)}
+	initiator.use(ns)
+	stageForReconnect(t, ns, "vol-1", "nqn.2016-06.io.spdk:cnode1", "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c", nil)
+
+	// the controller comes back with another device
+	reconnected := fakeDevice(t)
+	initiator.mu.Lock()
+	initiator.devicePath = reconnected
+	initiator.mu.Unlock()
+
+	// the handler goes on with the cycle when the client is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recorder := httptest.NewRecorder()
+	newDebugHandler(ns).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/reconnect?volume_id=vol-1", nil).WithContext(ctx))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("/reconnect: %d %s", recorder.Code, recorder.Body)
+	}
+	if initiator.disconnects != 1 || initiator.connects != 2 {
+		t.Errorf("%d disconnects and %d connects, want the stage and one cycle", initiator.disconnects, initiator.connects)
+	}
+	vol := ns.lookupStagedVolume("vol-1")
+	if vol.devicePath != reconnected {
+		t.Errorf("device %s after the reconnect, want %s", vol.devicePath, reconnected)
+	}
+	stashed, err := util.LookupDevicePath(ns.stashDir("vol-1", vol.stagingParentPath))
+	if err != nil || filepath.Clean(stashed) != reconnected {
+		t.Errorf("stashed device %s, %v, want %s", stashed, err, reconnected)
+	}
+
+	unlock := ns.volumeLocks.Lock("vol-1")
+	recorder = httptest.NewRecorder()
+	newDebugHandler(ns).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/reconnect?volume_id=vol-1", nil))
+	unlock()
+	if recorder.Code != http.StatusConflict {
+		t.Errorf("/reconnect of a busy volume: %d %s, want 409", recorder.Code, recorder.Body)
+	}
+}
@@ -17,8 +17,16 @@ limitations under the License.
 package driver
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog"
+	"k8s.io/utils/mount"
 
 	csicommon "github.com/ceph/ceph-nvmeof-csi/pkg/csi-common"
 
@@ -26,25 +34,84 @@ import (
 )
 
 func Run(conf *util.Config) {
+	if conf.IsNodeServer && conf.NodeID == "" {
+		klog.Fatalln("The node server needs a node ID, NodeGetInfo would report an empty one, see util.Config.ResolveNodeID")
+	}
+	ids, cs, ns, err := newServers(conf, nil)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+	if ns != nil {
+		ns.handlePauseSignal()
+	}
+
+	var httpServers []*http.Server
+	if conf.DebugAddress != "" {
+		if ns == nil {
+			klog.Warningf("debug endpoints are only served by the node server, ignoring -debug-address")
+		} else {
+			httpServers = append(httpServers, startHTTPServer("debug endpoints", conf.DebugAddress, newDebugHandler(ns)))
+		}
+	}
+	if conf.PprofAddress != "" {
+		httpServers = append(httpServers, startHTTPServer("pprof", conf.PprofAddress, newPprofHandler()))
+	}
+	if conf.HealthAddress != "" {
+		if cs == nil {
+			klog.Warningf("the health endpoint is only served by the controller server, ignoring -health-address")
+		} else {
+			handler, err := newHealthHandler(conf, conf.HealthGatewayThreshold)
+			if err != nil {
+				klog.Fatalln(err)
+			}
+			httpServers = append(httpServers, startHTTPServer("health endpoint", conf.HealthAddress, handler))
+		}
+	}
+	if conf.MetricsAddress != "" {
+		httpServers = append(httpServers, startHTTPServer("metrics", conf.MetricsAddress, newMetricsHandler(ns, cs)))
+	}
+
+	s := csicommon.NewNonBlockingGRPCServer()
+	s.Start(conf.Endpoint, ids, cs, ns)
+
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		klog.Infof("Received %v, stopping", <-sigCh)
+		s.Stop()
+	}()
+	s.Wait()
+	stopHTTPServers(httpServers)
+}
+
+// newServers creates the servers enabled by conf, the node server mounting
+// with mounter (the host mounter if nil)
+func newServers(conf *util.Config, mounter mount.Interface) (*identityServer, *controllerServer, *nodeServer, error) {
 	var (
 		cd  *csicommon.CSIDriver
 		ids *identityServer
 		cs  *controllerServer
 		ns  *nodeServer
+		err error
 
 		controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		}
+		// SINGLE_NODE_WRITER is kept for COs predating the split, it behaves as single writer
 		volumeModes = []csi.VolumeCapability_AccessMode_Mode{
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
 		}
 	)
 
 	cd = csicommon.NewCSIDriver(conf.DriverName, conf.DriverVersion, conf.NodeID)
 	if cd == nil {
-		klog.Fatalln("Failed to initialize CSI Driver.")
+		return nil, nil, nil, errors.New("failed to initialize CSI Driver")
 	}
 	if conf.IsControllerServer {
 		cd.AddControllerServiceCapabilities(controllerCaps)
@@ -53,23 +120,25 @@ func Run(conf *util.Config) {
 
 	ids = newIdentityServer(cd)
 
+	// shared by the servers, so operations on a volume serialize when both run in this process
+	volumeLocks := util.NewVolumeLocks()
+
 	if conf.IsNodeServer {
-		var err error
-		ns, err = newNodeServer(cd)
+		ns, err = newNodeServer(cd, conf, volumeLocks, mounter)
 		if err != nil {
-			klog.Fatalf("failed to create node server: %s", err)
+			return nil, nil, nil, fmt.Errorf("failed to create node server: %w", err)
 		}
 	}
 
+	// the controller server is the only one dialing the gateway, the node
+	// server connects from the publish context alone, so -controller=false
+	// keeps node staging working through a gateway outage
 	if conf.IsControllerServer {
-		var err error
-		cs, err = newControllerServer(cd)
+		cs, err = newControllerServer(cd, conf, volumeLocks)
 		if err != nil {
-			klog.Fatalf("failed to create controller server: %s", err)
+			return nil, nil, nil, fmt.Errorf("failed to create controller server: %w", err)
 		}
 	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(conf.Endpoint, ids, cs, ns)
-	s.Wait()
+	return ids, cs, ns, nil
 }
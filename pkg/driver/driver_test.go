@@ -0,0 +1,68 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/utils/mount"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// a node-only plugin must start while the gateway is unreachable, it doesn't
+// dial the gateway
+func TestNodeOnlyServers(t *testing.T) {
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gateway.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		if conn, err := gateway.Accept(); err == nil {
+			conn.Close()
+			dialed <- struct{}{}
+		}
+	}()
+
+	conf := &util.Config{
+		DriverName:     "csi.nvmeof.io",
+		DriverVersion:  "test",
+		NodeID:         "node1",
+		IsNodeServer:   true,
+		GatewayAddress: gateway.Addr().String(),
+		DefaultFsType:  "ext4",
+	}
+	ids, cs, ns, err := newServers(conf, mount.NewFakeMounter(nil))
+	if err != nil {
+		t.Fatalf("newServers: %v", err)
+	}
+	if ids == nil || ns == nil {
+		t.Errorf("identity server %v, node server %v, want both", ids, ns)
+	}
+	if cs != nil {
+		t.Error("node-only plugin created a controller server")
+	}
+	select {
+	case <-dialed:
+		t.Error("node-only plugin dialed the gateway")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
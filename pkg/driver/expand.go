@@ -0,0 +1,202 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+	utilexec "k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+	gatewaypb "github.com/ceph/ceph-nvmeof-csi/proto"
+)
+
+// the gateway resizes images by whole MiB
+const resizeAlignment = 1 << 20
+
+// ControllerExpandVolume resizes the image and namespace of a volume, then waits
+// for list_namespaces to report the new size, so the node doesn't look for it
+// on the device before the gateway applied it. It's idempotent: a namespace
+// already at least the requested size is left as is. The node always verifies
+// the device size, NodeExpandVolume grows the filesystem of mount volumes.
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	required := req.GetCapacityRange().GetRequiredBytes()
+	if required <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "required bytes of the capacity range are required")
+	}
+	newSize := uint64((required + resizeAlignment - 1) / resizeAlignment * resizeAlignment)
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && newSize > uint64(limit) {
+		return nil, status.Errorf(codes.OutOfRange, "%d bytes rounded up to whole MiB exceed the limit of %d bytes", required, limit)
+	}
+
+	identifier, err := decodeVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to decode volume ID: %v", err)
+	}
+	unlock := cs.volumeLocks.Lock(identifier.VolumeName)
+	defer unlock()
+
+	gateway, err := cs.gatewayFor(identifier.ClusterID)
+	if err != nil {
+		return nil, err
+	}
+	ns, err := cs.lookupNamespace(ctx, gateway, identifier)
+	if err != nil {
+		return nil, err
+	}
+	if ns.GetRbdImageSize() >= newSize {
+		klog.Infof("Volume %s is already %d bytes, requested %d", identifier.VolumeName, ns.GetRbdImageSize(), newSize)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(ns.GetRbdImageSize()), NodeExpansionRequired: true}, nil
+	}
+
+	klog.Infof("Expanding volume %s (NSID: %d, NQN: %s) from %d to %d bytes",
+		identifier.VolumeName, identifier.NSID, identifier.NQN, ns.GetRbdImageSize(), newSize)
+	gwCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err = gateway.NamespaceResize(gwCtx, &gatewaypb.NamespaceResizeReq{
+		SubsystemNqn: identifier.NQN,
+		Nsid:         identifier.NSID,
+		NewSize:      newSize,
+	})
+	if err != nil {
+		klog.Errorf("gateway NamespaceResize failed for volume %s: %v", identifier.VolumeName, err)
+		return nil, err
+	}
+
+	size := ns.GetRbdImageSize()
+	err = util.PollWithBackoff(ctx, cs.expandVerifyTimeout, func() (bool, error) {
+		ns, err := cs.lookupNamespace(ctx, gateway, identifier)
+		if err != nil {
+			return false, err
+		}
+		size = ns.GetRbdImageSize()
+		return size >= newSize, nil
+	})
+	if errors.Is(err, util.ErrPollTimedOut) {
+		return nil, status.Errorf(codes.DeadlineExceeded, "gateway still reports volume %s at %d bytes %v after resizing it to %d",
+			identifier.VolumeName, size, cs.expandVerifyTimeout, newSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("Volume expanded successfully: %s to %d bytes", identifier.VolumeName, size)
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: int64(size), NodeExpansionRequired: true}, nil
+}
+
+// lookupNamespace returns the namespace of a volume, NotFound if there's none
+func (cs *controllerServer) lookupNamespace(ctx context.Context, gateway gatewaypb.GatewayClient, identifier *VolumeIdentifier) (*gatewaypb.NamespaceCli, error) {
+	gwCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	nsid := identifier.NSID
+	resp, err := gateway.ListNamespaces(gwCtx, &gatewaypb.ListNamespacesReq{Subsystem: identifier.NQN, Nsid: &nsid})
+	if err != nil {
+		return nil, err
+	}
+	for _, ns := range resp.GetNamespaces() {
+		if ns.GetNsid() == nsid {
+			return ns, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "volume %s has no namespace %d in subsystem %s", identifier.VolumeName, nsid, identifier.NQN)
+}
+
+// NodeExpandVolume waits for the device of a staged volume to reach the
+// requested size, the kernel picks up the resize done by the controller with a
+// lag, then grows the filesystem of mount volumes. Growing a filesystem already
+// at the size of its device is a no-op, so retries are safe.
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer unlock()
+
+	devicePath, err := ns.stagedDevicePath(volumeID, req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
+	}
+	size, err := util.WaitForDeviceSize(ctx, devicePath, req.GetCapacityRange().GetRequiredBytes(), ns.expandVerifyTimeout)
+	if err != nil {
+		klog.Errorf("device %s of volume %s didn't grow: %v", devicePath, volumeID, err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, status.Error(codes.DeadlineExceeded, err.Error())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	block := req.GetVolumeCapability().GetBlock() != nil
+	if req.GetVolumeCapability() == nil {
+		info, err := os.Stat(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.NotFound, "failed to stat volume path %s: %v", volumePath, err)
+		}
+		block = !info.IsDir()
+	}
+	if block {
+		klog.Infof("Block volume %s expanded to %d bytes", volumeID, size)
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
+	}
+
+	formatter := &mount.SafeFormatAndMount{Interface: ns.mounter, Exec: utilexec.New()}
+	fsType, err := formatter.GetDiskFormat(devicePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to probe the filesystem of device %s: %v", devicePath, err)
+	}
+	if err := util.ResizeFilesystem(ctx, fsType, devicePath, volumePath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	klog.Infof("Filesystem of volume %s expanded to %d bytes", volumeID, size)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
+}
+
+// stagedDevicePath returns the device of a staged volume, the stash in
+// stagingParentPath, or below -context-dir, tells it after a restart
+func (ns *nodeServer) stagedDevicePath(volumeID, stagingParentPath string) (string, error) {
+	if vol := ns.lookupStagedVolume(volumeID); vol != nil {
+		vol.mu.Lock()
+		defer vol.mu.Unlock()
+		return vol.devicePath, nil
+	}
+	if stagingParentPath == "" && ns.contextDir == "" {
+		return "", status.Errorf(codes.NotFound, "volume %s isn't staged on this node", volumeID)
+	}
+	devicePath, err := util.LookupDevicePath(ns.stashDir(volumeID, stagingParentPath))
+	if err != nil {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("volume %s isn't staged on this node: %v", volumeID, err))
+	}
+	return devicePath, nil
+}
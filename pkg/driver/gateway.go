@@ -0,0 +1,148 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+	gatewaypb "github.com/ceph/ceph-nvmeof-csi/proto"
+)
+
+// gatewayClient returns the failures of the gateway as gRPC status errors with
+// the CSI code matching the cause, keeping the gateway's message, so the
+// provisioner and users see why an operation failed. A reply with a non zero
+// status is returned as an error.
+type gatewayClient struct {
+	client gatewaypb.GatewayClient
+}
+
+// gatewayCredentials returns the transport credentials of the connections to
+// the gateway of cluster, plaintext unless it has TLS files
+func gatewayCredentials(cluster util.ClusterInfo) (grpc.DialOption, error) {
+	tlsConfig, err := cluster.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), nil
+}
+
+func newGatewayClient(cc grpc.ClientConnInterface) gatewaypb.GatewayClient {
+	return &gatewayClient{client: gatewaypb.NewGatewayClient(cc)}
+}
+
+func (g *gatewayClient) NamespaceAdd(ctx context.Context, in *gatewaypb.NamespaceAddReq, opts ...grpc.CallOption) (*gatewaypb.NsidStatus, error) {
+	resp, err := g.client.NamespaceAdd(ctx, in, opts...)
+	if err := gatewayError("namespace_add", err, resp.GetStatus(), resp.GetErrorMessage()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *gatewayClient) NamespaceResize(ctx context.Context, in *gatewaypb.NamespaceResizeReq, opts ...grpc.CallOption) (*gatewaypb.ReqStatus, error) {
+	resp, err := g.client.NamespaceResize(ctx, in, opts...)
+	if err := gatewayError("namespace_resize", err, resp.GetStatus(), resp.GetErrorMessage()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *gatewayClient) NamespaceDelete(ctx context.Context, in *gatewaypb.NamespaceDeleteReq, opts ...grpc.CallOption) (*gatewaypb.ReqStatus, error) {
+	resp, err := g.client.NamespaceDelete(ctx, in, opts...)
+	if err := gatewayError("namespace_delete", err, resp.GetStatus(), resp.GetErrorMessage()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (g *gatewayClient) ListNamespaces(ctx context.Context, in *gatewaypb.ListNamespacesReq, opts ...grpc.CallOption) (*gatewaypb.NamespacesInfo, error) {
+	resp, err := g.client.ListNamespaces(ctx, in, opts...)
+	if err := gatewayError("list_namespaces", err, resp.GetStatus(), resp.GetErrorMessage()); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// gatewayError returns the status error of a gateway call, nil if it succeeded.
+// err is the error of the call itself, gwStatus and message the reply's.
+func gatewayError(op string, err error, gwStatus int32, message string) error {
+	if err != nil {
+		// the gateway's own code, e.g. NotFound or Unavailable, tells the
+		// provisioner whether to retry; Unknown is also what a non status error
+		// converts to
+		st := status.Convert(err)
+		code := st.Code()
+		if code == codes.Unknown {
+			code = codes.Internal
+		}
+		return status.Errorf(code, "gateway %s failed: %s", op, st.Message())
+	}
+	if gwStatus == 0 {
+		return nil
+	}
+	return status.Errorf(gatewayCode(gwStatus, message), "gateway %s failed: %s (status %d)", op, message, gwStatus)
+}
+
+// gatewayCode maps the status of a gateway reply, an errno, to a CSI code.
+// Some failures come with a generic status, their message tells the cause.
+func gatewayCode(gwStatus int32, message string) codes.Code {
+	lower := strings.ToLower(message)
+	// whatever the status, e.g. EBUSY, a call in progress on the same image
+	// isn't a gateway failure, Aborted has the provisioner retry with backoff
+	if strings.Contains(lower, "in progress") {
+		return codes.Aborted
+	}
+	switch syscall.Errno(gwStatus) {
+	case syscall.EEXIST:
+		return codes.AlreadyExists
+	case syscall.ENOENT, syscall.ENODEV:
+		return codes.NotFound
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return codes.ResourceExhausted
+	case syscall.EINVAL:
+		return codes.InvalidArgument
+	case syscall.EBUSY, syscall.EAGAIN:
+		return codes.Unavailable
+	case syscall.EINPROGRESS, syscall.EALREADY:
+		// an earlier call on the same image, e.g. of a timed out CreateVolume, is still running
+		return codes.Aborted
+	case syscall.EPERM, syscall.EACCES:
+		return codes.PermissionDenied
+	}
+	switch {
+	case strings.Contains(lower, "already exists"):
+		return codes.AlreadyExists
+	case strings.Contains(lower, "not found"), strings.Contains(lower, "does not exist"), strings.Contains(lower, "can't find"):
+		return codes.NotFound
+	// phrases rather than words, "full" alone matches e.g. "successfully"
+	case strings.Contains(lower, "no space left"), strings.Contains(lower, "quota"),
+		strings.Contains(lower, "pool is full"), strings.Contains(lower, "cluster is full"):
+		return codes.ResourceExhausted
+	}
+	return codes.Internal
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGatewayCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		gwStatus syscall.Errno
+		message  string
+		want     codes.Code
+	}{
+		{"exists", syscall.EEXIST, "", codes.AlreadyExists},
+		{"missing", syscall.ENOENT, "", codes.NotFound},
+		{"no device", syscall.ENODEV, "", codes.NotFound},
+		{"no space", syscall.ENOSPC, "", codes.ResourceExhausted},
+		{"quota", syscall.EDQUOT, "", codes.ResourceExhausted},
+		{"argument list too long", syscall.E2BIG, "", codes.Internal},
+		{"invalid", syscall.EINVAL, "", codes.InvalidArgument},
+		{"busy", syscall.EBUSY, "", codes.Unavailable},
+		{"again", syscall.EAGAIN, "", codes.Unavailable},
+		{"in progress", syscall.EINPROGRESS, "", codes.Aborted},
+		{"already running", syscall.EALREADY, "", codes.Aborted},
+		{"not permitted", syscall.EPERM, "", codes.PermissionDenied},
+		{"access denied", syscall.EACCES, "", codes.PermissionDenied},
+		{"busy message in progress", syscall.EBUSY, "Namespace add for image rbd/img1 is in progress", codes.Aborted},
+		{"generic already exists", syscall.EIO, "Image rbd/img1 already exists", codes.AlreadyExists},
+		{"generic not found", syscall.EIO, "Subsystem nqn.2016-06.io.spdk:cnode1 not found", codes.NotFound},
+		{"generic does not exist", syscall.EIO, "Pool rbd does not exist", codes.NotFound},
+		{"generic can't find", syscall.EIO, "Can't find namespace 3", codes.NotFound},
+		{"generic no space left", syscall.EIO, "Failure creating image: no space left on device", codes.ResourceExhausted},
+		{"generic quota", syscall.EIO, "Pool rbd exceeded its quota", codes.ResourceExhausted},
+		{"generic pool is full", syscall.EIO, "Failure creating image: pool is full", codes.ResourceExhausted},
+		{"generic cluster is full", syscall.EIO, "Failure creating image: cluster is full", codes.ResourceExhausted},
+		{"generic successfully", syscall.EIO, "Namespace was successfully added but the listener failed", codes.Internal},
+		{"generic unknown", syscall.EIO, "Failure adding namespace", codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gatewayCode(int32(tt.gwStatus), tt.message); got != tt.want {
+				t.Errorf("gatewayCode(%d, %q) = %v, want %v", tt.gwStatus, tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGatewayError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		gwStatus int32
+		message  string
+		want     codes.Code
+	}{
+		{"success", nil, 0, "", codes.OK},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), 0, "", codes.Unavailable},
+		{"deadline", status.Error(codes.DeadlineExceeded, "deadline exceeded"), 0, "", codes.DeadlineExceeded},
+		{"canceled", status.Error(codes.Canceled, "canceled"), 0, "", codes.Canceled},
+		{"resource exhausted", status.Error(codes.ResourceExhausted, "too many requests"), 0, "", codes.ResourceExhausted},
+		{"not found", status.Error(codes.NotFound, "no such subsystem"), 0, "", codes.NotFound},
+		{"already exists", status.Error(codes.AlreadyExists, "image exists"), 0, "", codes.AlreadyExists},
+		{"invalid argument", status.Error(codes.InvalidArgument, "bad pool name"), 0, "", codes.InvalidArgument},
+		{"permission denied", status.Error(codes.PermissionDenied, "not allowed"), 0, "", codes.PermissionDenied},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "bad certificate"), 0, "", codes.Unauthenticated},
+		{"unimplemented", status.Error(codes.Unimplemented, "unknown method"), 0, "", codes.Unimplemented},
+		{"failed precondition", status.Error(codes.FailedPrecondition, "subsystem is not ready"), 0, "", codes.FailedPrecondition},
+		{"aborted", status.Error(codes.Aborted, "conflict"), 0, "", codes.Aborted},
+		{"internal", status.Error(codes.Internal, "gateway bug"), 0, "", codes.Internal},
+		{"unknown", status.Error(codes.Unknown, "exception in handler"), 0, "", codes.Internal},
+		{"not a status", errors.New("broken pipe"), 0, "", codes.Internal},
+		{"reply status", nil, int32(syscall.EEXIST), "Image rbd/img1 already exists", codes.AlreadyExists},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := gatewayError("namespace_add", tt.err, tt.gwStatus, tt.message)
+			if got := status.Code(err); got != tt.want {
+				t.Errorf("gatewayError() = %v, want code %v", err, tt.want)
+			}
+		})
+	}
+}
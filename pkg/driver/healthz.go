@@ -0,0 +1,157 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"k8s.io/klog"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+	gatewaypb "github.com/ceph/ceph-nvmeof-csi/proto"
+)
+
+const (
+	// a probe reuses the result of a gateway ping this recent
+	healthCacheTTL = 10 * time.Second
+	// bound of a gateway ping
+	healthPingTimeout = 3 * time.Second
+	// subsystem listed by the ping, any reply but a transport failure means the gateway is up
+	healthPingSubsystem = "nqn.2014-08.org.nvmexpress.discovery"
+)
+
+// gatewayHealth tracks whether the controller reaches a gateway, pinging it
+// at most once per healthCacheTTL whatever the probe rate
+type gatewayHealth struct {
+	name    string
+	gateway gatewaypb.GatewayClient
+	// how long the gateway must be unreachable for the controller to be unhealthy
+	threshold time.Duration
+
+	mu           sync.Mutex
+	lastPing     time.Time
+	failingSince time.Time // zero while the gateway answers
+	lastErr      error
+}
+
+// newHealthHandler checks the default gateway and those of -clusters-file.
+// The pings go over connections of their own: through the circuit breaker of
+// the gateway calls an open breaker would fail them without reaching the
+// gateway, and the pings would count as gateway calls of the breaker.
+func newHealthHandler(conf *util.Config, threshold time.Duration) (http.Handler, error) {
+	clusters := map[string]util.ClusterInfo{conf.GatewayAddress: {GatewayAddress: conf.GatewayAddress}}
+	for clusterID, cluster := range conf.Clusters {
+		clusters[fmt.Sprintf("%s (cluster %s)", cluster.GatewayAddress, clusterID)] = cluster
+	}
+	names := make([]string, 0, len(clusters))
+	for name := range clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var gateways []*gatewayHealth
+	for _, name := range names {
+		creds, err := gatewayCredentials(clusters[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the credentials of gateway %s: %w", name, err)
+		}
+		conn, err := grpc.NewClient(clusters[name].GatewayAddress, creds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the health client of gateway %s: %w", name, err)
+		}
+		gateways = append(gateways, &gatewayHealth{name: name, gateway: newGatewayClient(conn), threshold: threshold})
+	}
+	mux := http.NewServeMux()
+	// GET /healthz, 503 once a gateway has been unreachable for longer than threshold
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		handleHealthz(w, r, gateways)
+	})
+	return mux, nil
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request, gateways []*gatewayHealth) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := checkGateways(r.Context(), gateways); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// checkGateways checks the gateways concurrently, so a probe takes a single
+// ping timeout however many are unreachable
+func checkGateways(ctx context.Context, gateways []*gatewayHealth) error {
+	errs := make([]error, len(gateways))
+	var wg sync.WaitGroup
+	for i, h := range gateways {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = h.check(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// check pings the gateway unless the last ping is recent, failing once it has
+// been unreachable for longer than threshold
+func (h *gatewayHealth) check(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if now.Sub(h.lastPing) >= healthCacheTTL {
+		h.lastPing = now
+		h.lastErr = h.ping(ctx)
+		switch {
+		case h.lastErr == nil:
+			if !h.failingSince.IsZero() {
+				klog.Infof("gateway %s is reachable again after %v", h.name, now.Sub(h.failingSince))
+			}
+			h.failingSince = time.Time{}
+		case h.failingSince.IsZero():
+			klog.Warningf("gateway %s is unreachable: %v", h.name, h.lastErr)
+			h.failingSince = now
+		}
+	}
+	if !h.failingSince.IsZero() && now.Sub(h.failingSince) > h.threshold {
+		return fmt.Errorf("gateway %s unreachable for %v: %w", h.name, now.Sub(h.failingSince).Round(time.Second), h.lastErr)
+	}
+	return nil
+}
+
+// ping lists the namespaces of a subsystem, a refusal from the gateway counts
+// as reachable
+func (h *gatewayHealth) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthPingTimeout)
+	defer cancel()
+	_, err := h.gateway.ListNamespaces(ctx, &gatewaypb.ListNamespacesReq{Subsystem: healthPingSubsystem})
+	if err != nil && isGatewayFailure(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+	gatewaypb "github.com/ceph/ceph-nvmeof-csi/proto"
+)
+
+// startGateway serves a gateway answering every call with Unimplemented, a
+// reply the health ping counts as reachable
+func startGateway(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	gatewaypb.RegisterGatewayServer(server, gatewaypb.UnimplementedGatewayServer{})
+	go server.Serve(listener) //nolint:errcheck // ends with Stop
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+// unreachableAddress is an address nothing listens on
+func unreachableAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestHealthzClusters(t *testing.T) {
+	conf := &util.Config{
+		GatewayAddress: startGateway(t),
+		Clusters: map[string]util.ClusterInfo{
+			"ceph-a": {ClusterID: "ceph-a", GatewayAddress: startGateway(t)},
+		},
+	}
+	healthz := func(handler http.Handler) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil).WithContext(context.Background()))
+		return recorder
+	}
+	newHandler := func() http.Handler {
+		handler, err := newHealthHandler(conf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return handler
+	}
+
+	if recorder := healthz(newHandler()); recorder.Code != http.StatusOK {
+		t.Errorf("healthz with every gateway up: %d %s, want 200", recorder.Code, recorder.Body)
+	}
+
+	// the default gateway is up, the failing one is named
+	conf.Clusters["ceph-b"] = util.ClusterInfo{ClusterID: "ceph-b", GatewayAddress: unreachableAddress(t)}
+	handler := newHandler()
+	// the first failed ping starts the unreachable time, the second probe
+	// finds it past the threshold of 0
+	healthz(handler)
+	recorder := healthz(handler)
+	if recorder.Code != http.StatusServiceUnavailable || !strings.Contains(recorder.Body.String(), "cluster ceph-b") {
+		t.Errorf("healthz with the gateway of ceph-b down: %d %s, want 503 naming ceph-b", recorder.Code, recorder.Body)
+	}
+	if strings.Contains(recorder.Body.String(), "cluster ceph-a") {
+		t.Errorf("healthz with the gateway of ceph-b down: %s, want ceph-a healthy", recorder.Body)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// bound of a disconnect by the idle reaper
+const idleDisconnectTimeout = 2 * time.Minute
+
+// idleSubsystem is a subsystem left connected after its last volume was unstaged
+type idleSubsystem struct {
+	volumeID       string // last volume unstaged, its lock guards the disconnect
+	publishContext map[string]string
+	since          time.Time
+}
+
+// runIdleReaper disconnects the subsystems left connected at unstage once
+// they've been idle for delay. Idle subsystems are only known in memory, the
+// ones left after a restart of the node server are kept like any subsystem
+// connected before it started.
+func (ns *nodeServer) runIdleReaper(delay time.Duration) {
+	klog.Infof("Keeping subsystems connected for %v after their last volume is unstaged", delay)
+	ticker := time.NewTicker(max(delay/2, time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		ns.idleSubsystems.Range(func(key, value any) bool {
+			nqn, _ := key.(string)            //nolint:errcheck // only string keys are stored
+			idle, _ := value.(*idleSubsystem) //nolint:errcheck // only *idleSubsystem is stored
+			if time.Since(idle.since) >= delay {
+				ns.disconnectIdle(nqn, idle)
+			}
+			return true
+		})
+	}
+}
+
+// disconnectIdle disconnects nqn unless it got staged again meanwhile
+func (ns *nodeServer) disconnectIdle(nqn string, idle *idleSubsystem) {
+	// a stage of the volume in progress may reuse the connection, retry at the next round
+	unlock, ok := ns.volumeLocks.TryAcquire(idle.volumeID)
+	if !ok {
+		return
+	}
+	defer unlock()
+	unlockNQN := ns.nqnLocks.Lock(nqn)
+	defer unlockNQN()
+	if !ns.idleSubsystems.CompareAndDelete(nqn, idle) {
+		return // staged again, or another volume of it unstaged since
+	}
+	if ns.subsystemInUse(nqn) {
+		return
+	}
+	initiator, err := ns.newInitiator(idle.volumeID, idle.publishContext, nil)
+	if err != nil {
+		klog.Errorf("failed to disconnect idle subsystem %s: %v", nqn, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), idleDisconnectTimeout)
+	defer cancel()
+	klog.Infof("Disconnecting subsystem %s, idle since %v", nqn, idle.since.Format(time.RFC3339))
+	// the stash went at unstage, nothing to clean up after an abandoned disconnect
+	err = ns.disconnect(ctx, initiator, nqn, func() error { return nil })
+	if errors.Is(err, errDisconnectTimedOut) {
+		klog.Errorf("disconnect of idle subsystem %s hung for more than %v, it goes on in the background", nqn, ns.forceUnstageTimeout)
+	} else if err != nil {
+		klog.Errorf("failed to disconnect idle subsystem %s, retrying: %v", nqn, err)
+		ns.idleSubsystems.LoadOrStore(nqn, idle)
+	}
+}
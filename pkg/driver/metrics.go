@@ -0,0 +1,276 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+const metricsNamespace = "nvmeof_csi"
+
+// newMetricsHandler serves the prometheus metrics of the servers running in
+// this process, ns or cs is nil when that server isn't running
+func newMetricsHandler(ns *nodeServer, cs *controllerServer) http.Handler {
+	registry := prometheus.NewRegistry()
+	if ns != nil {
+		registry.MustRegister(newNodeCollectors(ns)...)
+		registry.MustRegister(newPathCollector(ns))
+		registry.MustRegister(newControllerStateCollector())
+	}
+	if cs != nil {
+		registry.MustRegister(newBreakerCollector(cs))
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func newNodeCollectors(ns *nodeServer) []prometheus.Collector {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "nvme_controllers",
+			Help:      "NVMe controllers present on the node.",
+		}, func() float64 {
+			count, err := util.CountControllers()
+			if err != nil {
+				klog.Warningf("failed to count nvme controllers: %v", err)
+				return -1
+			}
+			return float64(count)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "nvme_controllers_limit",
+			Help:      "NVMe controllers above which volumes are no longer staged, 0 if unlimited.",
+		}, func() float64 {
+			return float64(ns.maxControllers)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "watchdog_paths_down_total",
+			Help:      "Checks of the path watchdog finding a subsystem without live controller.",
+		}, func() float64 {
+			return float64(ns.watchdogPathsDown.Load())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "watchdog_reconnects_total",
+			Help:      "Subsystems connected again by the path watchdog.",
+		}, func() float64 {
+			return float64(ns.watchdogReconnects.Load())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "watchdog_reconnect_failures_total",
+			Help:      "Failed attempts of the path watchdog to connect a subsystem again.",
+		}, func() float64 {
+			return float64(ns.watchdogReconnectFailures.Load())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "watchdog_reconnects_given_up_total",
+			Help:      "Subsystems the path watchdog stopped connecting again after -watchdog-max-reconnects failures.",
+		}, func() float64 {
+			return float64(ns.watchdogReconnectsGivenUp.Load())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "paused",
+			Help:      "1 while the node server is paused, by SIGUSR1 or the debug endpoint, and refuses to stage new volumes.",
+		}, func() float64 {
+			if ns.paused.Load() {
+				return 1
+			}
+			return 0
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "node",
+			Name:      "paused_stage_rejections_total",
+			Help:      "NodeStageVolume calls refused with Unavailable while the node server was paused.",
+		}, func() float64 {
+			return float64(ns.pausedRejects.Load())
+		}),
+	}
+	if m := ns.timeoutMounter; m != nil {
+		collectors = append(collectors,
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "node",
+				Name:      "mount_timeouts_total",
+				Help:      "Mount, unmount and mount point check calls abandoned after -mount-timeout.",
+			}, func() float64 {
+				return float64(m.timeouts.Load())
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace: metricsNamespace,
+				Subsystem: "node",
+				Name:      "mount_calls_hung",
+				Help:      "Abandoned mount, unmount and mount point check calls that haven't returned yet, each holding a goroutine.",
+			}, func() float64 {
+				return float64(m.hung.Load())
+			}))
+	}
+	return collectors
+}
+
+var (
+	subsystemControllersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "node", "subsystem_controllers"),
+		"Controllers of the subsystems of staged volumes, by controller state, e.g. live or connecting.",
+		[]string{"nqn", "state"}, nil)
+	volumeLivePathsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "node", "volume_live_paths"),
+		"Live controllers of the subsystem of a staged volume, fewer than expected means degraded multipath.",
+		[]string{"volume_id", "nqn"}, nil)
+)
+
+// pathCollector reports the controllers of the staged volumes, read from
+// sysfs at each scrape
+type pathCollector struct {
+	ns *nodeServer
+}
+
+func newPathCollector(ns *nodeServer) prometheus.Collector {
+	return &pathCollector{ns: ns}
+}
+
+func (c *pathCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- subsystemControllersDesc
+	ch <- volumeLivePathsDesc
+}
+
+func (c *pathCollector) Collect(ch chan<- prometheus.Metric) {
+	volumes := map[string]string{} // volumeID -> nqn
+	c.ns.stagedVolumes.Range(func(key, value any) bool {
+		vol, _ := value.(*stagedVolume) //nolint:errcheck // only *stagedVolume is stored
+		volumeID, _ := key.(string)     //nolint:errcheck // only string keys are stored
+		volumes[volumeID] = vol.publishContext["nqn"]
+		return true
+	})
+
+	livePaths := map[string]int{} // nqn -> live controllers
+	for _, nqn := range volumes {
+		if _, ok := livePaths[nqn]; ok {
+			continue
+		}
+		states, err := util.ControllerStates(nqn)
+		if err != nil {
+			klog.Warningf("failed to read the controllers of %s: %v", nqn, err)
+			continue
+		}
+		byState := map[string]int{}
+		for _, state := range states {
+			byState[state]++
+		}
+		for state, count := range byState {
+			ch <- prometheus.MustNewConstMetric(subsystemControllersDesc, prometheus.GaugeValue, float64(count), nqn, state)
+		}
+		livePaths[nqn] = byState["live"]
+	}
+	for volumeID, nqn := range volumes {
+		if live, ok := livePaths[nqn]; ok {
+			ch <- prometheus.MustNewConstMetric(volumeLivePathsDesc, prometheus.GaugeValue, float64(live), volumeID, nqn)
+		}
+	}
+}
+
+var controllerStatesDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(metricsNamespace, "node", "nvme_controller_states"),
+	"NVMe controllers present on the node by state, controllers stuck connecting point at the gateway or the network.",
+	[]string{"state"}, nil)
+
+// states always reported, 0 if no controller is in them, so alerts on them
+// don't depend on the series showing up
+var reportedControllerStates = []string{"live", "connecting", "resetting", "deleting"}
+
+// controllerStateCollector reports the states of all the NVMe controllers of
+// the node, read from sysfs at each scrape
+type controllerStateCollector struct{}
+
+func newControllerStateCollector() prometheus.Collector {
+	return controllerStateCollector{}
+}
+
+func (controllerStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- controllerStatesDesc
+}
+
+func (controllerStateCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := util.CountControllerStates()
+	if err != nil {
+		klog.Warningf("failed to read the states of nvme controllers: %v", err)
+		return
+	}
+	for _, state := range reportedControllerStates {
+		if _, ok := counts[state]; !ok {
+			counts[state] = 0
+		}
+	}
+	for state, count := range counts {
+		ch <- prometheus.MustNewConstMetric(controllerStatesDesc, prometheus.GaugeValue, float64(count), state)
+	}
+}
+
+var (
+	breakerStateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "controller", "gateway_breaker_state"),
+		"Circuit breaker of the gateway, 0 closed, 1 open and failing calls, 2 half-open and probing.",
+		[]string{"cluster"}, nil)
+	breakerTripsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "controller", "gateway_breaker_trips_total"),
+		"Times the circuit breaker of the gateway opened.",
+		[]string{"cluster"}, nil)
+)
+
+// breakerCollector reports the circuit breakers of the gateways in use, the
+// default gateway has an empty cluster label
+type breakerCollector struct {
+	cs *controllerServer
+}
+
+func newBreakerCollector(cs *controllerServer) prometheus.Collector {
+	return &breakerCollector{cs: cs}
+}
+
+func (c *breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+	ch <- breakerTripsDesc
+}
+
+func (c *breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	c.cs.breakers.Range(func(key, value any) bool {
+		clusterID := key.(string)    //nolint:errcheck // only string keys are stored
+		b := value.(*circuitBreaker) //nolint:errcheck // only *circuitBreaker is stored
+		state, trips := b.snapshot()
+		ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, float64(state), clusterID)
+		ch <- prometheus.MustNewConstMetric(breakerTripsDesc, prometheus.CounterValue, float64(trips), clusterID)
+		return true
+	})
+}
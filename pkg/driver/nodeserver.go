@@ -18,39 +18,238 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
+	utilexec "k8s.io/utils/exec"
 	"k8s.io/utils/mount"
 
 	csicommon "github.com/ceph/ceph-nvmeof-csi/pkg/csi-common"
 	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
 )
 
+// what mount.SafeFormatAndMount.GetDiskFormat reports for a device with a partition table
+const partitionedDiskFormat = "unknown data, probably partitions"
+
+// wait for the device to serve IO again before a mkfs retry, see -mkfs-retries
+const mkfsRetryReadyTimeout = 30 * time.Second
+
+var errDisconnectTimedOut = errors.New("nvme disconnect timed out")
+
+// first wait before an abandoned disconnect that failed is run again, doubling
+// with each failure up to maxDisconnectRetryBackoff
+const (
+	disconnectRetryBackoff    = 30 * time.Second
+	maxDisconnectRetryBackoff = 10 * time.Minute
+)
+
 type nodeServer struct {
 	csi.UnimplementedNodeServer
 	defaultImpl *csicommon.DefaultNodeServer
 	mounter     mount.Interface
-	volumeLocks *util.VolumeLocks
+	// runs blkid, fsck and mkfs when staging filesystem volumes
+	exec utilexec.Interface
+	// returns the initiator connecting a volume, util.NewNvmeofCsiInitiator
+	newInitiator func(volumeID string, publishContext, secrets map[string]string) (util.NvmeofCsiInitiator, error)
+	// ns.mounter if -mount-timeout is set, for its metrics and mount point checks, nil otherwise
+	timeoutMounter *timeoutMounter
+	volumeLocks    *util.VolumeLocks
+	// nvme connect-all/disconnect act on the whole subsystem, serialize them per NQN
+	nqnLocks *util.KeyMutex
+	// volumes staged by this node server, volumeID -> *stagedVolume, see registerVolume
+	stagedVolumes sync.Map
+	// namespaces in use of each subsystem, a subsystem is only disconnected once it has none
+	subsystems *util.SubsystemManager
+	// resolved block devices in use, devicePath -> volumeID
+	deviceClaims sync.Map
+	// subsystems connected before the node server started, their other users are unknown
+	preexistingNQNs map[string]struct{}
+	// NVMe controllers above which staging is refused, unlimited if 0
+	maxControllers int
+	// bound of mkfs at stage, disabled if 0
+	formatTimeout time.Duration
+	// mkfs runs again after a failure on a device not ready yet, see formatAndMount
+	mkfsRetries int
+	// fsType of mount capabilities without one
+	defaultFsType string
+	// bound of the read of the device before staging it, disabled if 0
+	deviceIOCheckTimeout time.Duration
+	// archive of the volume contexts of unstaged volumes, see cleanUpStash
+	contextArchiveDir   string
+	contextArchiveCount int
+	// durable dir of the stashes of staged volumes, the staging dir if empty, see stashDir
+	contextDir string
+	// bound of a whole NodeStageVolume, disabled if 0
+	stageTimeout time.Duration
+	// wait for the device to grow in NodeExpandVolume
+	expandVerifyTimeout time.Duration
+	// link the device of staged volumes at util.DeviceAliasPath
+	deviceAlias bool
+	// modes of the mount points created by createMountPoint
+	mountDirMode  os.FileMode
+	blockFileMode os.FileMode
+	// abandon a hung disconnect at unstage after this long, disabled if 0
+	forceUnstageTimeout time.Duration
+	// subsystems whose abandoned disconnect hasn't succeeded yet, nqn -> struct{},
+	// staging them is refused, see disconnect
+	pendingDisconnects sync.Map
+	// first wait before retrying a failed abandoned disconnect, disconnectRetryBackoff
+	disconnectRetryBackoff time.Duration
+	// keep subsystems connected this long after their last volume is unstaged, disabled if 0
+	warmDisconnectDelay time.Duration
+	// subsystems kept connected after unstage, nqn -> *idleSubsystem, see runIdleReaper
+	idleSubsystems sync.Map
+
+	// counters of the path watchdog, see runWatchdog
+	watchdogPathsDown         atomic.Uint64
+	watchdogReconnects        atomic.Uint64
+	watchdogReconnectFailures atomic.Uint64
+	watchdogReconnectsGivenUp atomic.Uint64
+	// retry policy of the watchdog connects, see runWatchdog
+	watchdogMaxReconnects    int
+	watchdogReconnectBackoff time.Duration
+	// subsystems the watchdog is connecting again, nqn -> *reconnectState, only used by the watchdog
+	reconnectStates map[string]*reconnectState
+
+	// new volumes aren't staged while paused, see setPaused
+	paused        atomic.Bool
+	pausedRejects atomic.Uint64
+}
+
+// stagedVolume keeps what's needed to act on a staged volume outside of the CSI calls
+type stagedVolume struct {
+	publishContext    map[string]string
+	stagingParentPath string
+	authenticated     bool
+
+	// written under the volume lock, mu is for readers not holding it
+	mu          sync.Mutex
+	devicePath  string
+	targetPaths map[string]struct{}
+}
+
+// addTarget records a path the volume is published at
+func (vol *stagedVolume) addTarget(targetPath string) {
+	vol.mu.Lock()
+	defer vol.mu.Unlock()
+	if vol.targetPaths == nil {
+		vol.targetPaths = map[string]struct{}{}
+	}
+	vol.targetPaths[targetPath] = struct{}{}
+}
+
+// removeTarget forgets a path the volume was published at
+func (vol *stagedVolume) removeTarget(targetPath string) {
+	vol.mu.Lock()
+	defer vol.mu.Unlock()
+	delete(vol.targetPaths, targetPath)
+}
+
+// otherTarget returns a path other than targetPath the volume is published at, "" if none
+func (vol *stagedVolume) otherTarget(targetPath string) string {
+	vol.mu.Lock()
+	defer vol.mu.Unlock()
+	for path := range vol.targetPaths {
+		if path != targetPath {
+			return path
+		}
+	}
+	return ""
+}
+
+// isSingleWriter tells if mode allows a single publish of the volume on the node
+func isSingleWriter(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER ||
+		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
 }
 
-func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
+// lookupStagedVolume returns the registry entry of volumeID, nil if not staged by this node server
+func (ns *nodeServer) lookupStagedVolume(volumeID string) *stagedVolume {
+	value, ok := ns.stagedVolumes.Load(volumeID)
+	if !ok {
+		return nil
+	}
+	vol, _ := value.(*stagedVolume) //nolint:errcheck // only *stagedVolume is stored
+	return vol
+}
+
+// newNodeServer returns the node server mounting through mounter, the mounter
+// of the host if nil. Tests pass a mount.FakeMounter.
+func newNodeServer(d *csicommon.CSIDriver, conf *util.Config, volumeLocks *util.VolumeLocks, mounter mount.Interface) (*nodeServer, error) {
+	if mounter == nil {
+		mounter = mount.New("")
+	}
+	subsystems, err := util.NewSubsystemManager(conf.SubsystemStateFile)
+	if err != nil {
+		return nil, err
+	}
+	preexistingNQNs, err := util.ConnectedSubsystems()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list connected subsystems: %w", err)
+	}
+	for nqn := range preexistingNQNs {
+		// the persisted references tell who uses subsystems connected before a restart
+		if subsystems.InUse(nqn) {
+			delete(preexistingNQNs, nqn)
+		}
+	}
 	ns := &nodeServer{
-		defaultImpl: csicommon.NewDefaultNodeServer(d),
-		mounter:     mount.New(""),
-		volumeLocks: util.NewVolumeLocks(),
+		defaultImpl:            csicommon.NewDefaultNodeServer(d),
+		mounter:                mounter,
+		exec:                   utilexec.New(),
+		newInitiator:           util.NewNvmeofCsiInitiator,
+		volumeLocks:            volumeLocks,
+		nqnLocks:               util.NewKeyMutex(),
+		subsystems:             subsystems,
+		preexistingNQNs:        preexistingNQNs,
+		maxControllers:         conf.MaxControllers,
+		formatTimeout:          conf.FormatTimeout,
+		mkfsRetries:            conf.MkfsRetries,
+		defaultFsType:          conf.DefaultFsType,
+		deviceIOCheckTimeout:   conf.DeviceIOCheckTimeout,
+		expandVerifyTimeout:    conf.ExpandVerifyTimeout,
+		stageTimeout:           conf.StageTimeout,
+		contextArchiveDir:      conf.KeepVolumeContext,
+		contextArchiveCount:    conf.KeepVolumeContextCount,
+		contextDir:             conf.ContextDir,
+		deviceAlias:            conf.DeviceAlias,
+		mountDirMode:           conf.MountDirMode,
+		blockFileMode:          conf.BlockFileMode,
+		forceUnstageTimeout:    conf.ForceUnstageTimeout,
+		disconnectRetryBackoff: disconnectRetryBackoff,
+		warmDisconnectDelay:    conf.WarmDisconnectDelay,
+	}
+	if conf.MountTimeout > 0 {
+		ns.timeoutMounter = newTimeoutMounter(ns.mounter, conf.MountTimeout)
+		ns.mounter = ns.timeoutMounter
+	}
+	if conf.OrphanStagingRoot != "" {
+		ns.reapOrphanedStaging(conf.OrphanStagingRoot)
+	}
+	if conf.WatchdogInterval > 0 {
+		ns.watchdogMaxReconnects = conf.WatchdogMaxReconnects
+		ns.watchdogReconnectBackoff = conf.WatchdogReconnectBackoff
+		ns.reconnectStates = map[string]*reconnectState{}
+		go ns.runWatchdog(conf.WatchdogInterval)
+	}
+	if conf.WarmDisconnectDelay > 0 {
+		go ns.runIdleReaper(conf.WarmDisconnectDelay)
 	}
 
 	return ns, nil
 }
 
-func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 
 	var err error
 	if err = util.ValidateNodeStageVolumeRequest(req); err != nil {
@@ -58,130 +257,658 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 	}
 
 	volumeID := req.GetVolumeId()
-	unlock := ns.volumeLocks.Lock(volumeID)
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
 	defer unlock()
 
 	stagingParentPath := req.GetStagingTargetPath()
 	stagingTargetPath := stagingParentPath + "/" + volumeID // use this directory to persistently store VolumeContext
 
-	klog.Infof("NodeStageVolume called for volume %s, stagingTargetPath: %s", volumeID, stagingTargetPath)
+	klog.Infof("NodeStageVolume called for volume %s (%s), stagingTargetPath: %s",
+		volumeID, util.ParseK8sObjects(req.GetVolumeContext()), stagingTargetPath)
+	ctx = util.WithK8sObjects(ctx, req.GetVolumeContext())
+	if ns.stageTimeout > 0 {
+		// bounds connect, device wait and mount as a whole, the RPC deadline still applies if earlier
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ns.stageTimeout)
+		defer cancel()
+	}
 
 	isStaged, err := ns.isStaged(stagingTargetPath)
 	if err != nil {
 		klog.Errorf("failed to check isStaged, targetPath: %s err: %v", stagingTargetPath, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(mountErrorCode(err), err.Error())
+	}
+	if !isStaged && ns.paused.Load() {
+		ns.pausedRejects.Add(1)
+		klog.Warningf("node server is paused, not staging volume %s", volumeID)
+		return nil, status.Errorf(codes.Unavailable, "node server is paused for storage maintenance, volume %s isn't staged", volumeID)
 	}
+	access := util.StageAccess(req.GetVolumeCapability())
 	if isStaged {
+		// stashes of older versions don't record the access, they're taken as compatible
+		stashed, err := util.LookupVolumeContext(ns.stashDir(volumeID, stagingParentPath))
+		if recorded := stashed[util.StagedAccessKey]; err == nil && recorded != "" && recorded != access {
+			klog.Errorf("volume %s is staged %s at %s, refusing to stage it %s", volumeID, recorded, stagingTargetPath, access)
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is already staged %s at %s, not %s",
+				volumeID, recorded, stagingTargetPath, access)
+		}
 		klog.Warning("volume already staged")
+		if _, ok := ns.stagedVolumes.Load(volumeID); !ok {
+			// staged before a restart of the node server, its device is claimed again
+			devicePath, err := ns.claimStashedDevice(volumeID, stagingParentPath)
+			if err != nil {
+				return nil, err
+			}
+			err = ns.registerVolume(volumeID, &stagedVolume{
+				publishContext:    req.GetPublishContext(),
+				devicePath:        devicePath,
+				stagingParentPath: stagingParentPath,
+				authenticated:     util.HasAuthSecrets(req.GetSecrets()),
+			})
+			if err != nil {
+				ns.releaseDevices(volumeID)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+	exclusive, err := util.ParseExclusiveDevice(req.GetVolumeContext(), req.GetVolumeCapability().GetAccessMode().GetMode())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var fsOpts *fsOptions
+	if !isBlock {
+		fsOpts, err = parseFsOptions(req.GetVolumeCapability().GetMount(), req.GetVolumeContext(), ns.defaultFsType)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
 	var initiator util.NvmeofCsiInitiator
-	initiator, err = util.NewNvmeofCsiInitiator(req.GetPublishContext()) //TODO - make NvmeofCsiInitiator works
+	// secrets are only used for this connect, never stashed nor registered
+	initiator, err = ns.newInitiator(volumeID, req.GetPublishContext(), req.GetSecrets())
 	if err != nil {
 		klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, initiatorStatus(err)
 
 	}
-	devicePath, err := initiator.Connect() // idempotent
+	nqn := req.GetPublishContext()["nqn"]
+	// always taken after the volume lock
+	unlockNQN := ns.nqnLocks.Lock(nqn)
+	if _, pending := ns.pendingDisconnects.Load(nqn); pending {
+		unlockNQN()
+		klog.Warningf("disconnect of subsystem %s is still running, not staging volume %s", nqn, volumeID)
+		return nil, status.Errorf(codes.Unavailable, "subsystem %s is being disconnected, volume %s isn't staged", nqn, volumeID)
+	}
+	if err = ns.checkControllerLimit(nqn); err != nil {
+		unlockNQN()
+		return nil, err
+	}
+	devicePath, err := initiator.Connect(ctx) // idempotent
+	if err == nil {
+		// registered under the NQN lock, a concurrent unstage must see the subsystem in use
+		err = ns.registerVolume(volumeID, &stagedVolume{
+			publishContext:    req.GetPublishContext(),
+			devicePath:        devicePath,
+			stagingParentPath: stagingParentPath,
+			authenticated:     util.HasAuthSecrets(req.GetSecrets()),
+		})
+		// a warm subsystem is reused, the idle reaper must leave it alone
+		ns.idleSubsystems.Delete(nqn)
+	} else if ctx.Err() != nil && !ns.subsystemInUse(nqn) {
+		// the deadline hit midway, e.g. waiting for the device, the subsystem
+		// may be connected already and mustn't be left behind
+		initiator.Disconnect(context.WithoutCancel(ctx)) //nolint:errcheck // ignore error
+	}
+	unlockNQN()
 	if err != nil {
 		klog.Errorf("failed to connect initiator, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, initiatorStatus(err)
 	}
 	defer func() {
 		if err != nil {
-			initiator.Disconnect() //nolint:errcheck // ignore error
+			ns.releaseDevices(volumeID)
+			// clean up even when the failure is ctx being cancelled
+			unlockNQN := ns.nqnLocks.Lock(nqn)
+			ns.unregisterVolume(volumeID, req.GetPublishContext()) //nolint:errcheck // released again at unstage
+			// only the namespace of this volume failed, siblings keep the subsystem connected
+			if !ns.subsystemInUse(nqn) {
+				initiator.Disconnect(context.WithoutCancel(ctx)) //nolint:errcheck // ignore error
+			}
+			unlockNQN()
+			if ns.deviceAlias {
+				util.RemoveDeviceAlias(util.DeviceAliasPath(volumeID)) //nolint:errcheck // ignore error
+			}
+			ns.removeStash(volumeID, stagingParentPath) //nolint:errcheck // may not be stashed yet
 		}
 	}()
-	if err = ns.stageVolume(devicePath, stagingTargetPath); err != nil { // idempotent
+	if err = ns.claimDevice(devicePath, volumeID); err != nil {
+		return nil, err
+	}
+	if ns.deviceIOCheckTimeout > 0 {
+		// a filesystem can't be made on a device of size 0, a raw block one is
+		// checked for IO only
+		if err = util.CheckDeviceIO(ctx, devicePath, !isBlock, ns.deviceIOCheckTimeout); err != nil {
+			klog.Errorf("device of volume %s isn't ready for IO: %v", volumeID, err)
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+	if exclusive {
+		if err = util.CheckDeviceExclusive(devicePath); err != nil {
+			klog.Errorf("device of volume %s isn't available for exclusive use: %v", volumeID, err)
+			if errors.Is(err, util.ErrDeviceBusy) {
+				return nil, status.Error(codes.FailedPrecondition, err.Error())
+			}
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	// needed to disconnect at unstage, also after a restart of the node server
+	stashedContext := make(map[string]string, len(req.GetPublishContext())+3)
+	for k, v := range req.GetPublishContext() {
+		stashedContext[k] = v
+	}
+	// a stage retried with the other access must not find it staged
+	stashedContext[util.StagedAccessKey] = access
+	stashedContext[util.StagedVolumeIDKey] = volumeID
+	if ns.deviceAlias {
+		// recorded before the link is created, so unstage removes it
+		stashedContext[util.DeviceAliasKey] = util.DeviceAliasPath(volumeID)
+	}
+	stashDir := ns.stashDir(volumeID, stagingParentPath)
+	if err = util.StashVolumeContext(stashedContext, stashDir); err != nil {
+		klog.Errorf("failed to stash volume context, volumeID: %s err: %v", volumeID, err)
+		return nil, nodeFileStatus(err, stashDir)
+	}
+	if err = util.StashDevicePath(devicePath, stashDir); err != nil {
+		klog.Errorf("failed to stash device path, volumeID: %s err: %v", volumeID, err)
+		return nil, nodeFileStatus(err, stashDir)
+	}
+	if ns.deviceAlias {
+		if err = util.CreateDeviceAlias(util.DeviceAliasPath(volumeID), devicePath); err != nil {
+			klog.Errorf("failed to create device alias, volumeID: %s err: %v", volumeID, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	// mounting doesn't stop at the deadline, it's not started past it
+	if err = ctx.Err(); err != nil {
+		klog.Errorf("stage of volume %s ran out of time before mounting: %v", volumeID, err)
+		return nil, stageStatus(err)
+	}
+	if isBlock {
+		err = ns.stageVolume(devicePath, stagingTargetPath) // idempotent
+	} else {
+		err = ns.stageFilesystem(ctx, devicePath, stagingTargetPath, fsOpts) // idempotent
+	}
+	if err != nil {
 		klog.Errorf("failed to stage volume, volumeID: %s devicePath:%s err: %v", volumeID, devicePath, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, stageStatus(err)
 	}
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+// NodeUnstageVolume tears a volume down in the reverse order of staging, each
+// step only runs once the previous one succeeded, so a retry after a failure
+// midway picks up where it stopped:
+//  1. unmount and delete the staging mount point
+//  2. confirm it's no longer mounted, the kernel would hold the device and block the disconnect
+//  3. disconnect the initiator, unless other volumes use the subsystem
+//  4. delete the stashed volume context and device path, kept when the disconnect
+//     failed as the retry needs them to disconnect
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if err := util.ValidateNodeUnstageVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
 	volumeID := req.GetVolumeId()
-	unlock := ns.volumeLocks.Lock(volumeID)
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
 	defer unlock()
 
-	stagingTargetPath := req.GetStagingTargetPath() + "/" + volumeID
+	stagingParentPath := req.GetStagingTargetPath()
+	stagingTargetPath := stagingParentPath + "/" + volumeID
 
 	isStaged, err := ns.isStaged(stagingTargetPath)
 	if err != nil {
 		klog.Errorf("failed to check isStaged, targetPath: %s err: %v", stagingTargetPath, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(mountErrorCode(err), err.Error())
 	}
-	if !isStaged {
+	if isStaged {
+		err = ns.deleteMountPoint(stagingTargetPath) // idempotent
+		if err != nil {
+			klog.Errorf("failed to delete mount point, targetPath: %s err: %v", stagingTargetPath, err)
+			return nil, status.Errorf(mountErrorCode(err), "unstage volume %s failed: %s", volumeID, err)
+		}
+	} else {
 		klog.Warning("volume already unstaged")
-		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
+	// stacked mounts leave the path mounted after a single unmount
+	if isStaged, err = ns.isStaged(stagingTargetPath); err != nil || isStaged {
+		klog.Errorf("staging path %s of volume %s is still mounted, not disconnecting: %v", stagingTargetPath, volumeID, err)
+		return nil, status.Errorf(codes.Internal, "unstage volume %s failed: %s is still mounted", volumeID, stagingTargetPath)
+	}
+	ns.releaseDevices(volumeID)
+	// a retry after a failed disconnect finds the volume unmounted but still stashed
+	if err = ns.disconnectVolume(ctx, volumeID, stagingParentPath); err != nil {
+		klog.Errorf("failed to disconnect initiator, volumeID: %s err: %v", volumeID, err)
+		return nil, initiatorStatus(fmt.Errorf("unstage volume %s failed: %w", volumeID, err))
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
 
-	err = ns.deleteMountPoint(stagingTargetPath) // idempotent
+// checkControllerLimit refuses a connect to nqn that would add controllers past
+// maxControllers, so the volume gets scheduled on another node
+func (ns *nodeServer) checkControllerLimit(nqn string) error {
+	if ns.maxControllers <= 0 {
+		return nil
+	}
+	connected, err := util.ConnectedSubsystems()
 	if err != nil {
-		klog.Errorf("failed to delete mount point, targetPath: %s err: %v", stagingTargetPath, err)
-		return nil, status.Errorf(codes.Internal, "unstage volume %s failed: %s", volumeID, err)
-	}
-	//TODO - maybe we should disconnect the initiator here?
-	// volumeContext, err := util.LookupVolumeContext(stagingTargetPath)
-	// if err != nil {
-	// 	klog.Errorf("failed to lookup volume context, volumeID: %s err: %v", volumeID, err)
-	// 	return nil, status.Error(codes.Internal, err.Error())
-	// }
-	// var initiator util.NvmeofCsiInitiator
-	// initiator, err = util.NewNvmeofCsiInitiator(volumeContext)
-	// if err != nil {
-	// 	klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
-	// 	return nil, status.Error(codes.Internal, err.Error())
-	// }
-	// err = initiator.Disconnect() // idempotent
-	// if err != nil {
-	// 	klog.Errorf("failed to disconnect initiator, volumeID: %s err: %v", volumeID, err)
-	// 	return nil, status.Error(codes.Internal, err.Error())
-	// }
-	// if err := util.CleanUpVolumeContext(stagingTargetPath); err != nil {
-	// 	klog.Errorf("failed to clean up volume context, volumeID: %s err: %v", volumeID, err)
-	// 	return nil, status.Error(codes.Internal, err.Error())
-	// }
-	return &csi.NodeUnstageVolumeResponse{}, nil
+		return status.Errorf(codes.Internal, "failed to list connected subsystems: %v", err)
+	}
+	if _, ok := connected[nqn]; ok {
+		return nil // the existing controllers are reused
+	}
+	count, err := util.CountControllers()
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to count nvme controllers: %v", err)
+	}
+	if count >= ns.maxControllers {
+		klog.Warningf("node has %d nvme controllers, limit is %d, refusing to connect to %s", count, ns.maxControllers, nqn)
+		return status.Errorf(codes.ResourceExhausted,
+			"node has %d nvme controllers, limit is %d", count, ns.maxControllers)
+	}
+	return nil
+}
+
+// Node server errors carry the gRPC code telling kubelet whether and how to retry:
+//   - InvalidArgument: malformed request, publish context or StorageClass parameters
+//   - NotFound: the volume or path the request refers to doesn't exist
+//   - FailedPrecondition: the node state conflicts with the request, e.g. publish before stage,
+//     device claimed by another volume, partitioned device
+//   - Aborted: another operation on the volume is in progress
+//   - ResourceExhausted: a node limit, e.g. -max-controllers, is reached
+//   - DeadlineExceeded: an nvme command, the device or mkfs took too long
+//   - Unavailable: the target couldn't be reached
+//   - Unauthenticated: the target refused the host
+//   - Internal: anything else
+
+// message of Aborted errors
+const volumeOperationAlreadyExistsFmt = "an operation with the given volume %s already exists"
+
+// stageStatus maps a staging error to its gRPC code, status errors are kept as is
+func stageStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var mountErr mount.MountError
+	switch {
+	case isNoSpace(err):
+		return status.Errorf(codes.ResourceExhausted, "node filesystem is full: %v", err)
+	case errors.Is(err, util.ErrFormatTimedOut), errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.As(err, &mountErr) && (mountErr.Type == mount.UnformattedReadOnly || mountErr.Type == mount.HasFilesystemErrors):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// isNoSpace tells if err is about the filesystem of a path of the node being
+// full, e.g. the kubelet dir, rather than about the volume
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// nodeFileStatus maps the failure to create or write a file or dir of the node
+// at path, ResourceExhausted if its filesystem is full, DeadlineExceeded if the
+// mount point check was abandoned at -mount-timeout, Internal otherwise
+func nodeFileStatus(err error, path string) error {
+	if isNoSpace(err) {
+		return status.Errorf(codes.ResourceExhausted, "node filesystem of %s is full, free space on the node: %v", path, err)
+	}
+	return status.Error(mountErrorCode(err), err.Error())
+}
+
+// mountErrorCode is DeadlineExceeded for mounts, unmounts and mount point
+// checks abandoned at -mount-timeout, Internal otherwise
+func mountErrorCode(err error) codes.Code {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
+
+// initiatorStatus maps an initiator error to the gRPC code telling the CO whether retrying may help
+func initiatorStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, util.ErrInvalidPublishContext):
+		code = codes.InvalidArgument
+	case errors.Is(err, util.ErrAuthFailed):
+		code = codes.Unauthenticated
+	case errors.Is(err, util.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, util.ErrNoPath):
+		code = codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
+
+// disconnectVolume disconnects the subsystem of an unstaged volume, unless other
+// volumes still use it, from the publish context stashed at stage time
+func (ns *nodeServer) disconnectVolume(ctx context.Context, volumeID, stagingParentPath string) error {
+	stashDir := ns.stashDir(volumeID, stagingParentPath)
+	publishContext, err := util.LookupVolumeContext(stashDir)
+	if errors.Is(err, os.ErrNotExist) {
+		// already disconnected
+		if err := ns.unregisterVolume(volumeID, nil); err != nil {
+			return err
+		}
+		return util.CleanUpDevicePath(stashDir)
+	}
+	if err != nil {
+		return err
+	}
+	initiator, err := ns.newInitiator(volumeID, publishContext, nil)
+	if err != nil {
+		return err
+	}
+	if alias := publishContext[util.DeviceAliasKey]; alias != "" {
+		if err := util.RemoveDeviceAlias(alias); err != nil {
+			return err
+		}
+	}
+
+	nqn := publishContext["nqn"]
+	unlockNQN := ns.nqnLocks.Lock(nqn)
+	defer unlockNQN()
+	if err := ns.unregisterVolume(volumeID, publishContext); err != nil {
+		return err
+	}
+	if ns.subsystemInUse(nqn) {
+		klog.Infof("subsystem %s is still in use, keeping it connected after unstaging volume %s", nqn, volumeID)
+		return ns.cleanUpStash(volumeID, stagingParentPath)
+	}
+	if ns.warmDisconnectDelay > 0 {
+		// the staging dir is removed by the CO, the reaper only keeps the publish context in memory
+		klog.Infof("keeping subsystem %s connected for %v after unstaging volume %s", nqn, ns.warmDisconnectDelay, volumeID)
+		ns.idleSubsystems.Store(nqn, &idleSubsystem{
+			volumeID:       volumeID,
+			publishContext: publishContext,
+			since:          time.Now(),
+		})
+		return ns.cleanUpStash(volumeID, stagingParentPath)
+	}
+	err = ns.disconnect(ctx, initiator, nqn, func() error {
+		return ns.cleanUpStash(volumeID, stagingParentPath)
+	})
+	if errors.Is(err, errDisconnectTimedOut) {
+		// the stash is kept until the abandoned disconnect succeeds
+		klog.Errorf("FORCED UNSTAGE: disconnect of subsystem %s for volume %s hung for more than %v, "+
+			"reporting the volume unstaged, the disconnect goes on in the background and the volume context is kept in %s until it succeeds",
+			nqn, volumeID, ns.forceUnstageTimeout, stashDir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ns.cleanUpStash(volumeID, stagingParentPath)
+}
+
+// cleanUpStash deletes what NodeStageVolume stashed, the volume context last
+// as it's what tells a retried unstage to disconnect. With
+// -keep-volume-context it's archived first, failing that doesn't fail the
+// unstage.
+func (ns *nodeServer) cleanUpStash(volumeID, stagingParentPath string) error {
+	if ns.contextArchiveDir != "" {
+		archived, err := util.ArchiveVolumeContext(ns.stashDir(volumeID, stagingParentPath), ns.contextArchiveDir, volumeID, ns.contextArchiveCount)
+		if err != nil {
+			klog.Warningf("failed to archive the volume context of %s: %v", volumeID, err)
+		} else {
+			klog.Infof("archived the volume context of %s at %s", volumeID, archived)
+		}
+	}
+	return ns.removeStash(volumeID, stagingParentPath)
+}
+
+// stashDir is where the volume context and device of a staged volume are
+// stashed, the staging dir unless -context-dir is set
+func (ns *nodeServer) stashDir(volumeID, stagingParentPath string) string {
+	return util.ContextDir(ns.contextDir, volumeID, stagingParentPath)
+}
+
+// removeStash deletes the stashes of a volume, and its dir below -context-dir
+func (ns *nodeServer) removeStash(volumeID, stagingParentPath string) error {
+	stashDir := ns.stashDir(volumeID, stagingParentPath)
+	if err := util.CleanUpDevicePath(stashDir); err != nil {
+		return err
+	}
+	if err := util.CleanUpVolumeContext(stashDir); err != nil {
+		return err
+	}
+	if ns.contextDir != "" {
+		if err := os.Remove(stashDir); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove context dir %s: %w", stashDir, err)
+		}
+	}
+	return nil
+}
+
+// disconnect runs initiator.Disconnect, giving up after forceUnstageTimeout if
+// set. An abandoned disconnect keeps running in the background, its subsystem
+// pending until it succeeds, so no volume is staged on a controller about to
+// go away. A failed one is run again with backoff, cleanUp is called once it
+// succeeds. The caller holds the NQN lock.
+func (ns *nodeServer) disconnect(ctx context.Context, initiator util.NvmeofCsiInitiator, nqn string, cleanUp func() error) error {
+	if ns.forceUnstageTimeout <= 0 {
+		return initiator.Disconnect(ctx)
+	}
+	done := make(chan error)
+	abandoned := make(chan struct{})
+	go func() {
+		err := initiator.Disconnect(context.WithoutCancel(ctx))
+		select {
+		case done <- err:
+		case <-abandoned:
+			ns.finishDisconnect(initiator, nqn, err, cleanUp)
+		}
+	}()
+	timer := time.NewTimer(ns.forceUnstageTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	// marked before the NQN lock is released, and before the goroutine may unmark it
+	ns.pendingDisconnects.Store(nqn, struct{}{})
+	close(abandoned)
+	return errDisconnectTimedOut
+}
+
+// finishDisconnect runs an abandoned disconnect that returned err again until
+// it succeeds, then cleans up after it and lets the subsystem be staged again
+func (ns *nodeServer) finishDisconnect(initiator util.NvmeofCsiInitiator, nqn string, err error, cleanUp func() error) {
+	backoff := ns.disconnectRetryBackoff
+	for err != nil {
+		klog.Errorf("abandoned disconnect of subsystem %s failed, retrying in %v: %v", nqn, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxDisconnectRetryBackoff)
+		err = initiator.Disconnect(context.Background())
+	}
+	klog.Infof("abandoned disconnect of subsystem %s succeeded", nqn)
+	if err := cleanUp(); err != nil {
+		klog.Errorf("failed to clean up after the disconnect of subsystem %s: %v", nqn, err)
+	}
+	ns.pendingDisconnects.Delete(nqn)
+}
+
+// registerVolume records a staged volume and the reference it holds on its subsystem
+func (ns *nodeServer) registerVolume(volumeID string, vol *stagedVolume) error {
+	if err := ns.subsystems.Acquire(vol.publishContext["nqn"], vol.publishContext["uuid"]); err != nil {
+		return err
+	}
+	ns.stagedVolumes.Store(volumeID, vol)
+	return nil
+}
+
+// unregisterVolume forgets a staged volume and drops the reference of the
+// namespace in publishContext, or the registered one if nil, on its subsystem
+func (ns *nodeServer) unregisterVolume(volumeID string, publishContext map[string]string) error {
+	value, loaded := ns.stagedVolumes.LoadAndDelete(volumeID)
+	if publishContext == nil {
+		if !loaded {
+			return nil
+		}
+		vol, _ := value.(*stagedVolume) //nolint:errcheck // only *stagedVolume is stored
+		publishContext = vol.publishContext
+	}
+	_, err := ns.subsystems.Release(publishContext["nqn"], publishContext["uuid"])
+	return err
+}
+
+// subsystemInUse tells if nqn is referenced by a staged volume, or was connected
+// before the node server started, the caller holds the NQN lock
+func (ns *nodeServer) subsystemInUse(nqn string) bool {
+	if _, ok := ns.preexistingNQNs[nqn]; ok {
+		return true
+	}
+	return ns.subsystems.InUse(nqn)
 }
 
 func (ns *nodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if err := util.ValidateNodePublishVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := filepath.Join(req.GetStagingTargetPath(), volumeID)
 	targetPath := req.GetTargetPath()
+	klog.Infof("NodePublishVolume called for volume %s (%s), targetPath: %s",
+		volumeID, util.ParseK8sObjects(req.GetVolumeContext()), targetPath)
 
 	// Lock per volume
-	unlock := ns.volumeLocks.Lock(volumeID)
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
 	defer unlock()
 
-	if req.GetVolumeCapability().GetBlock() == nil {
-		klog.Errorf("NodePublishVolume called with non-block volume capability, volumeID: %s", volumeID)
-		return nil, status.Errorf(codes.InvalidArgument, "only block volumes supported")
+	if _, err := os.Stat(stagingTargetPath); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found at staging path %s", volumeID, stagingTargetPath)
+	}
+	isStaged, err := ns.isStaged(stagingTargetPath)
+	if err != nil {
+		klog.Errorf("failed to check isStaged, targetPath: %s err: %v", stagingTargetPath, err)
+		return nil, status.Error(mountErrorCode(err), err.Error())
 	}
+	if !isStaged {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is not staged at %s", volumeID, stagingTargetPath)
+	}
+
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
 
-	// Create the target block file for bind-mount
-	if _, err := ns.createMountPoint(targetPath); err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to create target mount point: %v", err)
+	vol := ns.lookupStagedVolume(volumeID)
+	if vol != nil && isSingleWriter(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		if other := vol.otherTarget(targetPath); other != "" {
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume %s is single writer and already published at %s", volumeID, other)
+		}
+	}
+
+	if isBlock {
+		err = ns.publishBlock(stagingTargetPath, targetPath, req.GetReadonly())
+	} else {
+		err = ns.publishFilesystem(stagingTargetPath, targetPath, req.GetReadonly(), req.GetVolumeCapability().GetMount().GetMountFlags())
+	}
+	if err != nil {
+		klog.Errorf("failed to publish volume %s at %s: %v", volumeID, targetPath, err)
+		return nil, err
 	}
-	// Bind-mount the block device to the target path
-	klog.Infof("Binding staging path %s to target path %s for volume %s", stagingTargetPath, targetPath, volumeID)
-	if err := ns.mounter.Mount(stagingTargetPath, targetPath, "", []string{"bind"}); err != nil {
-		return nil, status.Errorf(codes.Internal, "bind mount failed: %v", err)
+	if vol != nil {
+		vol.addTarget(targetPath)
 	}
 	return &csi.NodePublishVolumeResponse{}, nil
 
 }
 
+// publishBlock bind mounts the staged block file at the target file, must be idempotent
+func (ns *nodeServer) publishBlock(stagingPath, targetPath string, readonly bool) error {
+	if info, err := os.Stat(stagingPath); err == nil && info.IsDir() {
+		return status.Errorf(codes.FailedPrecondition, "volume at %s is staged as a filesystem, can't publish it as a block device", stagingPath)
+	}
+	mounted, err := ns.createMountPoint(targetPath, true)
+	if err != nil {
+		return nodeFileStatus(fmt.Errorf("failed to create target mount point: %w", err), targetPath)
+	}
+	if mounted {
+		return nil
+	}
+	return ns.bindMount(stagingPath, targetPath, readonly, nil)
+}
+
+// publishFilesystem bind mounts the staged filesystem directory at the target
+// directory, with the mount flags of the capability, must be idempotent
+func (ns *nodeServer) publishFilesystem(stagingPath, targetPath string, readonly bool, mountFlags []string) error {
+	if info, err := os.Stat(stagingPath); err == nil && !info.IsDir() {
+		return status.Errorf(codes.FailedPrecondition, "volume at %s is staged as a block device, can't publish it as a filesystem", stagingPath)
+	}
+	mounted, err := ns.createMountPoint(targetPath, false)
+	if err != nil {
+		return nodeFileStatus(fmt.Errorf("failed to create target mount point: %w", err), targetPath)
+	}
+	if mounted {
+		return nil
+	}
+	return ns.bindMount(stagingPath, targetPath, readonly, mountFlags)
+}
+
+// bindMount bind mounts stagingPath at targetPath, removing the target again
+// when the mount fails so a retry starts clean
+func (ns *nodeServer) bindMount(stagingPath, targetPath string, readonly bool, mountFlags []string) error {
+	mountOptions := append([]string{"bind"}, mountFlags...)
+	if readonly {
+		mountOptions = append(mountOptions, "ro")
+	}
+	klog.Infof("Binding staging path %s to target path %s, options: %v", stagingPath, targetPath, mountOptions)
+	if err := ns.mounter.Mount(stagingPath, targetPath, "", mountOptions); err != nil {
+		if cleanupErr := ns.deleteMountPoint(targetPath); cleanupErr != nil {
+			klog.Warningf("failed to clean up target path %s: %v", targetPath, cleanupErr)
+		}
+		return status.Errorf(mountErrorCode(err), "bind mount failed: %v", err)
+	}
+	return nil
+}
+
 func (ns *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if err := util.ValidateNodeUnpublishVolumeRequest(req); err != nil {
+		return nil, err
+	}
+
 	volumeID := req.GetVolumeId()
-	unlock := ns.volumeLocks.Lock(volumeID)
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return nil, status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
 	defer unlock()
 
 	err := ns.deleteMountPoint(req.GetTargetPath()) // idempotent
 	if err != nil {
 		klog.Errorf("failed to delete mount point, targetPath: %s err: %v", req.GetTargetPath(), err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(mountErrorCode(err), err.Error())
+	}
+	if vol := ns.lookupStagedVolume(volumeID); vol != nil {
+		vol.removeTarget(req.GetTargetPath())
 	}
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
@@ -196,13 +923,150 @@ func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapab
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
 		},
 	}, nil
 
 }
 
+// reconnectVolume forces a disconnect/connect cycle on a staged volume, e.g. to
+// recover a controller stuck in connecting after gateway maintenance. The cycle
+// acts on the whole subsystem, it's refused while other volumes use it.
+func (ns *nodeServer) reconnectVolume(ctx context.Context, volumeID string) (string, error) {
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return "", status.Errorf(codes.Aborted, volumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer unlock()
+
+	vol := ns.lookupStagedVolume(volumeID)
+	if vol == nil {
+		return "", status.Errorf(codes.NotFound, "volume %s is not staged on this node", volumeID)
+	}
+
+	if vol.authenticated {
+		// the secrets were only held during NodeStageVolume
+		return "", status.Errorf(codes.FailedPrecondition, "volume %s uses DH-HMAC-CHAP, restage it to reconnect", volumeID)
+	}
+	initiator, err := ns.newInitiator(volumeID, vol.publishContext, nil)
+	if err != nil {
+		return "", err
+	}
+	nqn := vol.publishContext["nqn"]
+	unlockNQN := ns.nqnLocks.Lock(nqn)
+	// the disconnect of the cycle would drop the controllers of the sibling namespaces too
+	_, preexisting := ns.preexistingNQNs[nqn]
+	if users := ns.subsystems.Namespaces(nqn); preexisting || users > 1 {
+		unlockNQN()
+		return "", status.Errorf(codes.FailedPrecondition,
+			"subsystem %s of volume %s is used by %d other namespaces or was connected before the node server started, not reconnecting it",
+			nqn, volumeID, max(users-1, 0))
+	}
+	klog.Infof("Reconnecting volume %s", volumeID)
+	devicePath, err := initiator.Reconnect(ctx)
+	unlockNQN()
+	if err != nil {
+		return "", fmt.Errorf("failed to reconnect volume %s: %w", volumeID, err)
+	}
+	if err := ns.updateDevice(volumeID, vol, devicePath); err != nil {
+		return "", err
+	}
+	return devicePath, nil
+}
+
+// updateDevice records the device a staged volume resolved to after a reconnect
+func (ns *nodeServer) updateDevice(volumeID string, vol *stagedVolume, devicePath string) error {
+	ns.releaseDevices(volumeID)
+	if err := ns.claimDevice(devicePath, volumeID); err != nil {
+		return err
+	}
+	if vol.devicePath != "" && vol.devicePath != devicePath {
+		klog.Warningf("volume %s device changed from %s to %s after reconnect, restage may be needed",
+			volumeID, vol.devicePath, devicePath)
+	}
+	vol.mu.Lock()
+	vol.devicePath = devicePath
+	vol.mu.Unlock()
+	if err := util.StashDevicePath(devicePath, ns.stashDir(volumeID, vol.stagingParentPath)); err != nil {
+		klog.Warningf("failed to update device path of volume %s: %v", volumeID, err)
+	}
+	if ns.deviceAlias {
+		if err := util.CreateDeviceAlias(util.DeviceAliasPath(volumeID), devicePath); err != nil {
+			klog.Warningf("failed to update device alias of volume %s: %v", volumeID, err)
+		}
+	}
+	return nil
+}
+
+// claimDevice records devicePath as used by volumeID. Device matching is uuid
+// based, so a gateway reusing a namespace uuid could resolve two volumes to the
+// same device, refuse to stage the second one rather than corrupt data.
+func (ns *nodeServer) claimDevice(devicePath, volumeID string) error {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		klog.Errorf("failed to resolve device %s, volumeID: %s err: %v", devicePath, volumeID, err)
+		return status.Errorf(codes.Internal, "failed to resolve device %s: %v", devicePath, err)
+	}
+	owner, loaded := ns.deviceClaims.LoadOrStore(realPath, volumeID)
+	if loaded && owner != volumeID {
+		klog.Errorf("DEVICE CONFLICT: device %s (%s) is already staged for volume %s, refusing to stage volume %s, "+
+			"check the gateway for namespaces sharing a uuid", realPath, devicePath, owner, volumeID)
+		return status.Errorf(codes.FailedPrecondition,
+			"device %s is already staged for volume %s, refusing to stage volume %s", realPath, owner, volumeID)
+	}
+	return nil
+}
+
+// claimStashedDevice claims the device stashed for volumeID when it was
+// staged, and returns it. Stashes of older versions don't record the device,
+// nothing is claimed for them.
+func (ns *nodeServer) claimStashedDevice(volumeID, stagingParentPath string) (string, error) {
+	devicePath, err := util.LookupDevicePath(ns.stashDir(volumeID, stagingParentPath))
+	if errors.Is(err, os.ErrNotExist) {
+		klog.Warningf("no device stashed for volume %s, it isn't checked for conflicts", volumeID)
+		return "", nil
+	}
+	if err != nil {
+		return "", status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.claimDevice(devicePath, volumeID); err != nil {
+		return "", err
+	}
+	return devicePath, nil
+}
+
+// releaseDevices drops the device claims held by volumeID
+func (ns *nodeServer) releaseDevices(volumeID string) {
+	ns.deviceClaims.Range(func(key, value any) bool {
+		if value == volumeID {
+			ns.deviceClaims.CompareAndDelete(key, value)
+		}
+		return true
+	})
+}
+
 func (ns *nodeServer) stageVolume(devicePath, stagingPath string) error {
-	mounted, err := ns.createMountPoint(stagingPath)
+	mounted, err := ns.createMountPoint(stagingPath, true)
 	if err != nil {
 		return err
 	}
@@ -218,9 +1082,142 @@ func (ns *nodeServer) stageVolume(devicePath, stagingPath string) error {
 	return nil
 }
 
+// fsOptions are how a filesystem volume is formatted and mounted at stage
+type fsOptions struct {
+	fsType     string
+	mountFlags []string
+	fsckMode   util.FsckMode
+	discard    bool
+	mkfsArgs   []string
+}
+
+// parseFsOptions reads the filesystem options from the mount capability and
+// the StorageClass parameters in the volume context, defaultFsType is used
+// when the capability has no fsType
+func parseFsOptions(mnt *csi.VolumeCapability_MountVolume, volumeContext map[string]string, defaultFsType string) (*fsOptions, error) {
+	opts := &fsOptions{
+		fsType:     mnt.GetFsType(),
+		mountFlags: mnt.GetMountFlags(),
+	}
+	if opts.fsType == "" {
+		opts.fsType = defaultFsType
+		klog.Infof("using filesystem %s, the default, the volume capability has no fsType", opts.fsType)
+	} else {
+		klog.Infof("using filesystem %s requested by the volume capability", opts.fsType)
+	}
+	err := util.ValidateFsType(opts.fsType)
+	if err != nil {
+		return nil, err
+	}
+	if opts.fsckMode, err = util.ParseFsckMode(volumeContext); err != nil {
+		return nil, err
+	}
+	if opts.discard, err = util.ParseDiscard(volumeContext); err != nil {
+		return nil, err
+	}
+	if opts.mkfsArgs, err = util.ParseMkfsArgs(volumeContext, opts.fsType); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// stageFilesystem mounts the filesystem of devicePath at stagingPath, the
+// device is only formatted when no filesystem is found on it. A mkfs failing
+// on a device not ready is run again up to mkfsRetries times, each time once
+// the device reads fine and probes blank again.
+func (ns *nodeServer) stageFilesystem(ctx context.Context, devicePath, stagingPath string, opts *fsOptions) error {
+	mounted, err := ns.createMountPoint(stagingPath, false)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return nil
+	}
+
+	fsType := opts.fsType
+	mountOptions := append([]string{}, opts.mountFlags...)
+	if opts.discard {
+		supported, err := util.DeviceSupportsDiscard(devicePath)
+		switch {
+		case err != nil:
+			klog.Warningf("failed to check discard support of device %s, mounting without discard: %v", devicePath, err)
+		case !supported:
+			klog.Warningf("device %s doesn't support discard, mounting without discard, deleted data won't be reclaimed", devicePath)
+		default:
+			mountOptions = append(mountOptions, "discard")
+		}
+	}
+	var formatErr error
+	for attempt := 0; ; attempt++ {
+		formatExec := util.NewFormatExec(ctx, ns.exec, opts.fsckMode, ns.formatTimeout, opts.mkfsArgs)
+		// FormatAndMount turns mount errors into a MountError message, the recorded
+		// one tells a mount abandoned at -mount-timeout
+		recorder := &mountErrorRecorder{Interface: ns.mounter}
+		formatter := &mount.SafeFormatAndMount{
+			Interface: recorder,
+			Exec:      formatExec,
+		}
+		// devices may come with data, e.g. migrated namespaces, they must never be
+		// formatted: mkfs is only allowed once this probe found the device blank
+		existingFormat, err := formatter.GetDiskFormat(devicePath)
+		if err != nil {
+			return fmt.Errorf("failed to probe device %s for a filesystem: %w", devicePath, err)
+		}
+		if formatErr != nil && existingFormat != "" {
+			// the failed mkfs left signatures, mounting or formatting over them is unsafe
+			return fmt.Errorf("device %s has a %s signature after a failed mkfs, not formatting it again: %w",
+				devicePath, existingFormat, formatErr)
+		}
+		switch {
+		case existingFormat == "":
+			formatExec.AllowFormat()
+		case existingFormat == partitionedDiskFormat:
+			return status.Errorf(codes.FailedPrecondition, "device %s has a partition table, refusing to mount it", devicePath)
+		case existingFormat != fsType:
+			klog.Warningf("device %s already has a %s filesystem, mounting it as is instead of the requested %s",
+				devicePath, existingFormat, fsType)
+			fsType = existingFormat
+		}
+		klog.Infof("Mounting %s filesystem of device %s at staging path %s, options: %v", fsType, devicePath, stagingPath, mountOptions)
+		err = formatter.FormatAndMount(devicePath, stagingPath, fsType, mountOptions)
+		if err == nil {
+			return nil
+		}
+		var mountErr mount.MountError
+		formatFailed := errors.As(err, &mountErr) && mountErr.Type == mount.FormatFailed
+		if formatFailed && formatExec.FormatTimedOut() {
+			// a half written filesystem could be picked up by blkid on retry, start over from a blank device
+			if wipeErr := util.WipeDevice(context.WithoutCancel(ctx), devicePath); wipeErr != nil {
+				klog.Errorf("failed to wipe half formatted device %s: %v", devicePath, wipeErr)
+			}
+			return fmt.Errorf("%w: mkfs.%s of device %s: %w", util.ErrFormatTimedOut, fsType, devicePath, err)
+		}
+		if errors.Is(recorder.err, context.DeadlineExceeded) {
+			return fmt.Errorf("failed to mount device: %w", recorder.err)
+		}
+		if !formatFailed || attempt >= ns.mkfsRetries || !util.IsDeviceNotReadyFormatError(devicePath, err) {
+			return fmt.Errorf("failed to format and mount device: %w", err)
+		}
+		klog.Warningf("mkfs.%s of device %s failed on a device not ready, retrying (%d/%d): %v",
+			fsType, devicePath, attempt+1, ns.mkfsRetries, err)
+		formatErr = err
+		if err := util.CheckDeviceIO(ctx, devicePath, true, mkfsRetryReadyTimeout); err != nil {
+			return fmt.Errorf("failed to format and mount device: %w, %w", formatErr, err)
+		}
+	}
+}
+
+// isNotMountPoint is mount.IsNotMountPoint, bounded by -mount-timeout if set
+func (ns *nodeServer) isNotMountPoint(path string) (bool, error) {
+	if ns.timeoutMounter != nil {
+		return ns.timeoutMounter.IsNotMountPoint(path)
+	}
+	return mount.IsNotMountPoint(ns.mounter, path)
+}
+
 // isStaged if stagingPath is a mount point, it means it is already staged, and vice versa
 func (ns *nodeServer) isStaged(stagingPath string) (bool, error) {
-	unmounted, err := mount.IsNotMountPoint(ns.mounter, stagingPath)
+	unmounted, err := ns.isNotMountPoint(stagingPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -231,40 +1228,66 @@ func (ns *nodeServer) isStaged(stagingPath string) (bool, error) {
 	return !unmounted, nil
 }
 
-// create mount point if not exists, return whether already mounted
-func (ns *nodeServer) createMountPoint(path string) (bool, error) {
-	unmounted, err := mount.IsNotMountPoint(ns.mounter, path)
-	if os.IsNotExist(err) {
+// create mount point if not exists, return whether already mounted. Block
+// volumes are mounted on a file, filesystem volumes on a directory. The modes
+// are applied past the umask, so other users on the node can't look into the
+// staging and target paths of volumes.
+func (ns *nodeServer) createMountPoint(path string, isBlock bool) (bool, error) {
+	unmounted, err := ns.isNotMountPoint(path)
+	if os.IsNotExist(err) && !isBlock {
+		unmounted = true
+
+		util.V(util.LogNode, 4).Infof("Creating mount point directory %s", path)
+		if err := ns.makeMountDir(path); err != nil {
+			return false, fmt.Errorf("failed to create mount point dir %s: %w", path, err)
+		}
+		err = nil // reset IsNotExist
+	} else if os.IsNotExist(err) {
 		unmounted = true
 
 		dir := filepath.Dir(path)
-		klog.Infof("Creating mount point %s", dir)
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		util.V(util.LogNode, 4).Infof("Creating mount point %s", dir)
+		if err := ns.makeMountDir(dir); err != nil {
 			return false, fmt.Errorf("failed to create parent dir for %s: %w", path, err)
 		}
 
 		// Create the file if it doesn't exist
 		if _, err := os.Stat(path); os.IsNotExist(err) {
-			klog.Infof("Creating block device target file %s", path)
-			file, err := os.OpenFile(path, os.O_CREATE, 0o600)
+			util.V(util.LogNode, 4).Infof("Creating block device target file %s", path)
+			file, err := os.OpenFile(path, os.O_CREATE, ns.blockFileMode)
 			if err != nil {
 				return false, fmt.Errorf("failed to create block device target file %s: %w", path, err)
 			}
 			file.Close()
+			if err := os.Chmod(path, ns.blockFileMode); err != nil {
+				return false, fmt.Errorf("failed to set the mode of block device target file %s: %w", path, err)
+			}
 		}
 		err = nil // reset IsNotExist
 	}
 	if !unmounted {
-		klog.Infof("%s already mounted", path)
+		util.V(util.LogNode, 4).Infof("%s already mounted", path)
 	}
 	return !unmounted, err
 }
 
+// makeMountDir creates dir with mountDirMode, missing parents are created too.
+// An existing dir, e.g. one created by the kubelet, is left as is.
+func (ns *nodeServer) makeMountDir(dir string) error {
+	if _, err := os.Stat(dir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(dir, ns.mountDirMode); err != nil {
+		return err
+	}
+	return os.Chmod(dir, ns.mountDirMode)
+}
+
 // unmount and delete mount point, must be idempotent
 func (ns *nodeServer) deleteMountPoint(path string) error {
-	unmounted, err := mount.IsNotMountPoint(ns.mounter, path)
+	unmounted, err := ns.isNotMountPoint(path)
 	if os.IsNotExist(err) {
-		klog.Infof("%s already deleted", path)
+		util.V(util.LogNode, 4).Infof("%s already deleted", path)
 		return nil
 	}
 	if err != nil {
@@ -272,32 +1295,36 @@ func (ns *nodeServer) deleteMountPoint(path string) error {
 	}
 
 	if !unmounted {
-		klog.Infof("Unmounting block device at %s", path)
+		util.V(util.LogNode, 4).Infof("Unmounting %s", path)
 		if err := ns.mounter.Unmount(path); err != nil {
 			return fmt.Errorf("failed to unmount: %w", err)
 		}
 	}
 
-	// Delete the block file
-	klog.Infof("Removing mount point file %s", path)
+	// Delete the block file or the empty directory of a filesystem
+	util.V(util.LogNode, 4).Infof("Removing mount point %s", path)
 	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove mount point file %s: %w", path, err)
 	}
 
 	// Optionally remove parent dir if empty
 	dir := filepath.Dir(path)
-	klog.Infof("Removing parent directory %s if empty", dir)
-	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) && !isDirNotEmpty(err) {
+	util.V(util.LogNode, 4).Infof("Removing parent directory %s if empty", dir)
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		if !isDirNotEmpty(err) {
+			return fmt.Errorf("failed to remove parent directory %s: %w", dir, err)
+		}
 		// If the directory is not empty, that's okay — skip silently
-		klog.Infof("Parent directory %s not empty, skipping delete", dir)
+		util.V(util.LogNode, 4).Infof("Parent directory %s not empty, skipping delete", dir)
 	}
 
 	return nil
 }
 
-// Helper to check if the error is "directory not empty"
+// isDirNotEmpty tells if err is rmdir failing on a non-empty directory, some
+// filesystems report EEXIST instead of ENOTEMPTY
 func isDirNotEmpty(err error) bool {
-	return strings.Contains(err.Error(), "directory not empty")
+	return errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
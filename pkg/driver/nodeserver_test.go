@@ -0,0 +1,772 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	utilexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+	"k8s.io/utils/mount"
+
+	csicommon "github.com/ceph/ceph-nvmeof-csi/pkg/csi-common"
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// fakeExec answers blkid with blkidOutput, or exits with blkidStatus when
+// not 0, every other command succeeds. The commands run are recorded.
+type fakeExec struct {
+	blkidOutput string
+	blkidStatus int
+	commands    []string
+}
+
+func (e *fakeExec) Command(cmd string, args ...string) utilexec.Cmd {
+	return e.CommandContext(context.Background(), cmd, args...)
+}
+
+func (e *fakeExec) CommandContext(_ context.Context, cmd string, args ...string) utilexec.Cmd {
+	e.commands = append(e.commands, cmd)
+	action := func() ([]byte, []byte, error) { return nil, nil, nil }
+	switch cmd {
+	case "blkid":
+		action = func() ([]byte, []byte, error) {
+			if e.blkidStatus != 0 {
+				return nil, nil, testingexec.FakeExitError{Status: e.blkidStatus}
+			}
+			return []byte(e.blkidOutput), nil, nil
+		}
+	case "false":
+		action = func() ([]byte, []byte, error) { return nil, nil, testingexec.FakeExitError{Status: 1} }
+	}
+	fake := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{action}}
+	return testingexec.InitFakeCmd(fake, cmd, args...)
+}
+
+func (e *fakeExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// ranMkfs tells if a mkfs command was run, or refused by util.FormatExec
+func (e *fakeExec) ranMkfs() bool {
+	for _, cmd := range e.commands {
+		if strings.HasPrefix(cmd, "mkfs.") || cmd == "false" {
+			return true
+		}
+	}
+	return false
+}
+
+// fakeInitiator connects every volume to devicePath, the calls made are counted.
+// Disconnect blocks until disconnectBlock is closed, if set.
+type fakeInitiator struct {
+	mu              sync.Mutex
+	devicePath      string
+	connectErr      error
+	disconnectErr   error
+	disconnectBlock chan struct{}
+	connects        int
+	disconnects     int
+}
+
+func (i *fakeInitiator) Connect(context.Context) (string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.connects++
+	return i.devicePath, i.connectErr
+}
+
+func (i *fakeInitiator) Disconnect(context.Context) error {
+	i.mu.Lock()
+	block := i.disconnectBlock
+	i.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.disconnects++
+	return i.disconnectErr
+}
+
+func (i *fakeInitiator) Reconnect(ctx context.Context) (string, error) {
+	if err := i.Disconnect(ctx); err != nil {
+		return "", err
+	}
+	return i.Connect(ctx)
+}
+
+// use has ns connect every volume through i
+func (i *fakeInitiator) use(ns *nodeServer) {
+	ns.newInitiator = func(string, map[string]string, map[string]string) (util.NvmeofCsiInitiator, error) {
+		return i, nil
+	}
+}
+
+// newTestNodeServer returns a node server mounting through a fake mounter,
+// keeping its subsystem references in memory
+func newTestNodeServer(t *testing.T, conf *util.Config) (*nodeServer, *mount.FakeMounter) {
+	t.Helper()
+	d := csicommon.NewCSIDriver("csi.nvmeof.io", "test", "node1")
+	mounter := mount.NewFakeMounter(nil)
+	ns, err := newNodeServer(d, conf, util.NewVolumeLocks(), mounter)
+	if err != nil {
+		t.Fatalf("newNodeServer: %v", err)
+	}
+	return ns, mounter
+}
+
+func TestStageFilesystemNeverFormatsData(t *testing.T) {
+	tests := []struct {
+		name        string
+		blkidOutput string
+		blkidStatus int
+		wantCode    codes.Code
+		wantMkfs    bool
+		wantFsType  string
+	}{
+		{
+			name:        "ext4 filesystem",
+			blkidOutput: "DEVNAME=/dev/nvme0n1\nTYPE=ext4\n",
+			wantFsType:  "ext4",
+		},
+		{
+			name:        "xfs filesystem mounted as is",
+			blkidOutput: "DEVNAME=/dev/nvme0n1\nTYPE=xfs\n",
+			wantFsType:  "xfs",
+		},
+		{
+			name:        "partition table",
+			blkidOutput: "DEVNAME=/dev/nvme0n1\nPTTYPE=dos\n",
+			wantCode:    codes.FailedPrecondition,
+		},
+		{
+			name:        "blank device",
+			blkidStatus: 2,
+			wantMkfs:    true,
+			wantFsType:  "ext4",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, mounter := newTestNodeServer(t, &util.Config{})
+			exec := &fakeExec{blkidOutput: tt.blkidOutput, blkidStatus: tt.blkidStatus}
+			ns.exec = exec
+			stagingPath := filepath.Join(t.TempDir(), "staging", "vol")
+
+			err := ns.stageFilesystem(context.Background(), "/dev/nvme0n1", stagingPath, &fsOptions{fsType: "ext4"})
+			if tt.wantCode != codes.OK {
+				if status.Code(err) != tt.wantCode {
+					t.Fatalf("got error %v, want code %v", err, tt.wantCode)
+				}
+			} else if err != nil {
+				t.Fatalf("stageFilesystem: %v", err)
+			}
+			if got := exec.ranMkfs(); got != tt.wantMkfs {
+				t.Errorf("mkfs run: %v, want %v, commands %v", got, tt.wantMkfs, exec.commands)
+			}
+			mounts, _ := mounter.List() //nolint:errcheck // the fake never fails
+			if tt.wantFsType == "" {
+				if len(mounts) != 0 {
+					t.Errorf("device mounted: %v", mounts)
+				}
+				return
+			}
+			if len(mounts) != 1 || mounts[0].Type != tt.wantFsType || mounts[0].Path != stagingPath {
+				t.Errorf("mounts %v, want %s at %s", mounts, tt.wantFsType, stagingPath)
+			}
+		})
+	}
+}
+
+// fakeDevice returns a file standing for the device of a volume
+func fakeDevice(t *testing.T) string {
+	t.Helper()
+	devicePath := filepath.Join(t.TempDir(), "nvme0n1")
+	if err := os.WriteFile(devicePath, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return devicePath
+}
+
+// stagedByPreviousRun leaves volumeID as NodeStageVolume stages it on
+// devicePath, stashed and mounted, without registering it in the node server
+func stagedByPreviousRun(t *testing.T, mounter *mount.FakeMounter, volumeID, stagingParentPath string,
+	publishContext map[string]string, capability *csi.VolumeCapability, devicePath string) {
+	t.Helper()
+	stagingPath := filepath.Join(stagingParentPath, volumeID)
+	if err := os.MkdirAll(stagingPath, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	stashed := map[string]string{util.StagedAccessKey: util.StageAccess(capability)}
+	for k, v := range publishContext {
+		stashed[k] = v
+	}
+	if err := util.StashVolumeContext(stashed, stagingParentPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.StashDevicePath(devicePath, stagingParentPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := mounter.Mount(devicePath, stagingPath, "ext4", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNodeVolumeIdempotent repeats every node call on a volume staged by a
+// previous run of the node server, each repeat must succeed without
+// mounting or unmounting twice
+func TestNodeVolumeIdempotent(t *testing.T) {
+	ns, mounter := newTestNodeServer(t, &util.Config{})
+	// the subsystem is kept connected at unstage, so no nvme-cli runs
+	ns.warmDisconnectDelay = time.Hour
+	volumeID := "vol-1"
+	publishContext := map[string]string{
+		"nqn":       "nqn.2016-06.io.spdk:cnode1",
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	stagingParentPath := filepath.Join(t.TempDir(), "staging")
+	targetPath := filepath.Join(t.TempDir(), "pod", "mount")
+	stagedByPreviousRun(t, mounter, volumeID, stagingParentPath, publishContext, capability, fakeDevice(t))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    publishContext,
+			StagingTargetPath: stagingParentPath,
+			VolumeCapability:  capability,
+		})
+		if err != nil {
+			t.Fatalf("NodeStageVolume #%d: %v", i+1, err)
+		}
+	}
+	if ns.lookupStagedVolume(volumeID) == nil {
+		t.Fatalf("volume %s isn't registered after staging", volumeID)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    publishContext,
+			StagingTargetPath: stagingParentPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  capability,
+		})
+		if err != nil {
+			t.Fatalf("NodePublishVolume #%d: %v", i+1, err)
+		}
+	}
+	mounts, _ := mounter.List() //nolint:errcheck // the fake never fails
+	if len(mounts) != 2 {
+		t.Fatalf("mounts %v, want the staging path and one bind mount", mounts)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: targetPath})
+		if err != nil {
+			t.Fatalf("NodeUnpublishVolume #%d: %v", i+1, err)
+		}
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("target path %s not removed: %v", targetPath, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: volumeID, StagingTargetPath: stagingParentPath})
+		if err != nil {
+			t.Fatalf("NodeUnstageVolume #%d: %v", i+1, err)
+		}
+	}
+	if mounts, _ := mounter.List(); len(mounts) != 0 { //nolint:errcheck // the fake never fails
+		t.Errorf("mounts left after unstaging: %v", mounts)
+	}
+	if _, err := util.LookupVolumeContext(stagingParentPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("volume context still stashed after unstaging: %v", err)
+	}
+	if ns.lookupStagedVolume(volumeID) != nil {
+		t.Errorf("volume %s still registered after unstaging", volumeID)
+	}
+}
+
+// TestStagedDeviceClaimedAfterRestart stages two volumes found staged on the
+// same device after a restart, the second one must be refused
+func TestStagedDeviceClaimedAfterRestart(t *testing.T) {
+	ns, mounter := newTestNodeServer(t, &util.Config{})
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	devicePath := fakeDevice(t)
+	for i, volumeID := range []string{"vol-1", "vol-2"} {
+		publishContext := map[string]string{
+			"nqn":       "nqn.2016-06.io.spdk:cnode1",
+			"uuid":      fmt.Sprintf("8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6%d", i),
+			"traddr":    "192.168.1.10",
+			"trsvcid":   "4420",
+			"transport": "tcp",
+		}
+		stagingParentPath := filepath.Join(t.TempDir(), "staging")
+		stagedByPreviousRun(t, mounter, volumeID, stagingParentPath, publishContext, capability, devicePath)
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			PublishContext:    publishContext,
+			StagingTargetPath: stagingParentPath,
+			VolumeCapability:  capability,
+		})
+		if i == 0 {
+			if err != nil {
+				t.Fatalf("NodeStageVolume %s: %v", volumeID, err)
+			}
+			if vol := ns.lookupStagedVolume(volumeID); vol == nil || vol.devicePath != devicePath {
+				t.Fatalf("volume %s registered as %+v, want device %s", volumeID, vol, devicePath)
+			}
+			continue
+		}
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("NodeStageVolume %s on the device of vol-1: got %v, want FailedPrecondition", volumeID, err)
+		}
+		if ns.lookupStagedVolume(volumeID) != nil {
+			t.Errorf("volume %s registered despite the conflict", volumeID)
+		}
+	}
+}
+
+// TestStageAccessConflict stages a volume staged read-write again with each
+// access, only the same access is accepted
+func TestStageAccessConflict(t *testing.T) {
+	publishContext := map[string]string{
+		"nqn":       "nqn.2016-06.io.spdk:cnode1",
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	capability := func(mode csi.VolumeCapability_AccessMode_Mode, mountFlags ...string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4", MountFlags: mountFlags}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	tests := []struct {
+		name       string
+		staged     *csi.VolumeCapability
+		capability *csi.VolumeCapability
+		wantCode   codes.Code
+	}{
+		{"rw again", capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), codes.OK},
+		{"rw then reader only mode", capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY), codes.AlreadyExists},
+		{"rw then ro flag", capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ro"), codes.AlreadyExists},
+		{"ro then rw", capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), codes.AlreadyExists},
+		{"ro mode then ro flag", capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "ro"), codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, mounter := newTestNodeServer(t, &util.Config{})
+			stagingParentPath := filepath.Join(t.TempDir(), "staging")
+			stagedByPreviousRun(t, mounter, "vol-1", stagingParentPath, publishContext, tt.staged, fakeDevice(t))
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-1",
+				PublishContext:    publishContext,
+				StagingTargetPath: stagingParentPath,
+				VolumeCapability:  tt.capability,
+			})
+			if status.Code(err) != tt.wantCode {
+				t.Errorf("got %v, want code %v", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestIsDirNotEmpty(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	notEmpty := filepath.Join(dir, "not-empty")
+	for _, d := range []string{empty, notEmpty} {
+		if err := os.Mkdir(d, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(notEmpty, "volume-context.json"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		dir  string
+		want bool
+	}{
+		{"empty", empty, false},
+		{"not empty", notEmpty, true},
+		{"missing", filepath.Join(dir, "missing"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.Remove(tt.dir)
+			if got := isDirNotEmpty(err); got != tt.want {
+				t.Errorf("isDirNotEmpty(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestUnstageRetriedAfterFailedDisconnect fails the disconnect of an
+// unstage, the volume context must be kept for the retry to disconnect
+func TestUnstageRetriedAfterFailedDisconnect(t *testing.T) {
+	ns, mounter := newTestNodeServer(t, &util.Config{})
+	initiator := &fakeInitiator{disconnectErr: errors.New("nvme disconnect failed")}
+	initiator.use(ns)
+	publishContext := map[string]string{
+		"nqn":       "nqn.2016-06.io.spdk:cnode1",
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	stagingParentPath := filepath.Join(t.TempDir(), "staging")
+	stagedByPreviousRun(t, mounter, "vol-1", stagingParentPath, publishContext, capability, fakeDevice(t))
+	ctx := context.Background()
+	_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingParentPath,
+		VolumeCapability:  capability,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+	unstage := &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1", StagingTargetPath: stagingParentPath}
+
+	if _, err := ns.NodeUnstageVolume(ctx, unstage); err == nil {
+		t.Fatal("NodeUnstageVolume succeeded with a failed disconnect")
+	}
+	if mounts, _ := mounter.List(); len(mounts) != 0 { //nolint:errcheck // the fake never fails
+		t.Errorf("staging path still mounted: %v", mounts)
+	}
+	if _, err := util.LookupVolumeContext(stagingParentPath); err != nil {
+		t.Fatalf("volume context not kept after the failed disconnect: %v", err)
+	}
+
+	initiator.disconnectErr = nil
+	if _, err := ns.NodeUnstageVolume(ctx, unstage); err != nil {
+		t.Fatalf("retried NodeUnstageVolume: %v", err)
+	}
+	if initiator.disconnects != 2 {
+		t.Errorf("%d disconnects, want the failed one and its retry", initiator.disconnects)
+	}
+	if _, err := util.LookupVolumeContext(stagingParentPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("volume context still stashed after the retry: %v", err)
+	}
+}
+
+// TestForcedUnstageHungDisconnect abandons a hung disconnect at unstage, the
+// subsystem must not be staged again until the disconnect, retried after a
+// failure, succeeds
+func TestForcedUnstageHungDisconnect(t *testing.T) {
+	ns, mounter := newTestNodeServer(t, &util.Config{ForceUnstageTimeout: 50 * time.Millisecond})
+	ns.disconnectRetryBackoff = 10 * time.Millisecond
+	initiator := &fakeInitiator{devicePath: fakeDevice(t)}
+	initiator.use(ns)
+	nqn := "nqn.2016-06.io.spdk:cnode1"
+	publishContext := map[string]string{
+		"nqn":       nqn,
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	stagingParentPath := filepath.Join(t.TempDir(), "staging")
+	stagedByPreviousRun(t, mounter, "vol-1", stagingParentPath, publishContext, capability, fakeDevice(t))
+	ctx := context.Background()
+	_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		PublishContext:    publishContext,
+		StagingTargetPath: stagingParentPath,
+		VolumeCapability:  capability,
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume: %v", err)
+	}
+
+	// the disconnect hangs, then fails once released
+	initiator.mu.Lock()
+	initiator.disconnectBlock = make(chan struct{})
+	initiator.disconnectErr = errors.New("nvme disconnect failed")
+	initiator.mu.Unlock()
+	_, err = ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol-1", StagingTargetPath: stagingParentPath})
+	if err != nil {
+		t.Fatalf("forced NodeUnstageVolume: %v", err)
+	}
+	if _, err := util.LookupVolumeContext(stagingParentPath); err != nil {
+		t.Errorf("volume context not kept during the abandoned disconnect: %v", err)
+	}
+
+	// another namespace of the subsystem would lose its controller to the disconnect
+	otherContext := map[string]string{}
+	for k, v := range publishContext {
+		otherContext[k] = v
+	}
+	otherContext["uuid"] = "1b2c3d4e-5f60-4718-8a9b-0c1d2e3f4a5b"
+	otherStagingPath := t.TempDir()
+	stageOther := func() error {
+		_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-2",
+			PublishContext:    otherContext,
+			StagingTargetPath: otherStagingPath,
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	if err := stageOther(); status.Code(err) != codes.Unavailable {
+		t.Errorf("NodeStageVolume during the abandoned disconnect: %v, want Unavailable", err)
+	}
+
+	close(initiator.disconnectBlock)
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor("the failed disconnect", func() bool {
+		initiator.mu.Lock()
+		defer initiator.mu.Unlock()
+		return initiator.disconnects >= 1
+	})
+	if _, pending := ns.pendingDisconnects.Load(nqn); !pending {
+		t.Error("subsystem not pending after its disconnect failed")
+	}
+	initiator.mu.Lock()
+	initiator.disconnectErr = nil
+	initiator.mu.Unlock()
+	waitFor("the retried disconnect", func() bool {
+		_, pending := ns.pendingDisconnects.Load(nqn)
+		return !pending
+	})
+
+	initiator.mu.Lock()
+	disconnects := initiator.disconnects
+	initiator.mu.Unlock()
+	if disconnects < 2 {
+		t.Errorf("%d disconnects, want the failed one and its retry", disconnects)
+	}
+	if _, err := util.LookupVolumeContext(stagingParentPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("volume context still stashed after the disconnect: %v", err)
+	}
+	if err := stageOther(); err != nil {
+		t.Errorf("NodeStageVolume after the disconnect: %v", err)
+	}
+}
+
+// TestPublishReadonly publishes a staged volume with and without readonly, the
+// bind mount must carry ro only when asked
+func TestPublishReadonly(t *testing.T) {
+	publishContext := map[string]string{
+		"nqn":       "nqn.2016-06.io.spdk:cnode1",
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	filesystem := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	for _, capability := range []*csi.VolumeCapability{block, filesystem} {
+		for _, readonly := range []bool{false, true} {
+			name := fmt.Sprintf("block %v readonly %v", capability.GetBlock() != nil, readonly)
+			t.Run(name, func(t *testing.T) {
+				ns, mounter := newTestNodeServer(t, &util.Config{})
+				stagingParentPath := filepath.Join(t.TempDir(), "staging")
+				stagingPath := filepath.Join(stagingParentPath, "vol-1")
+				if capability.GetBlock() != nil {
+					// staged as a file the device is bound to
+					if err := os.MkdirAll(stagingParentPath, 0o750); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(stagingPath, nil, 0o600); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := os.MkdirAll(stagingPath, 0o750); err != nil {
+					t.Fatal(err)
+				}
+				if err := mounter.Mount("/dev/nvme0n1", stagingPath, "", nil); err != nil {
+					t.Fatal(err)
+				}
+				targetPath := filepath.Join(t.TempDir(), "pod", "volume")
+				_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+					VolumeId:          "vol-1",
+					PublishContext:    publishContext,
+					StagingTargetPath: stagingParentPath,
+					TargetPath:        targetPath,
+					VolumeCapability:  capability,
+					Readonly:          readonly,
+				})
+				if err != nil {
+					t.Fatalf("NodePublishVolume: %v", err)
+				}
+				mounts, _ := mounter.List() //nolint:errcheck // the fake never fails
+				for _, m := range mounts {
+					if m.Path != targetPath {
+						continue
+					}
+					if got := slices.Contains(m.Opts, "ro"); got != readonly {
+						t.Errorf("bind mount options %v, want ro %v", m.Opts, readonly)
+					}
+					return
+				}
+				t.Errorf("%s not mounted: %v", targetPath, mounts)
+			})
+		}
+	}
+}
+
+// TestNodeErrorCodes checks a representative failure of each code the node
+// server documents, see stageStatus
+func TestNodeErrorCodes(t *testing.T) {
+	publishContext := map[string]string{
+		"nqn":       "nqn.2016-06.io.spdk:cnode1",
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	// stage fails connecting with connectErr
+	stage := func(t *testing.T, ns *nodeServer, connectErr error) error {
+		(&fakeInitiator{connectErr: connectErr}).use(ns)
+		_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol-1",
+			PublishContext:    publishContext,
+			StagingTargetPath: t.TempDir(),
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	publish := func(t *testing.T, ns *nodeServer, stagingParentPath string) error {
+		_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:          "vol-1",
+			PublishContext:    publishContext,
+			StagingTargetPath: stagingParentPath,
+			TargetPath:        filepath.Join(t.TempDir(), "pod", "volume"),
+			VolumeCapability:  capability,
+		})
+		return err
+	}
+	tests := []struct {
+		name string
+		call func(t *testing.T, ns *nodeServer) error
+		want codes.Code
+	}{
+		{"InvalidArgument: no capability", func(t *testing.T, ns *nodeServer) error {
+			_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol-1",
+				PublishContext:    publishContext,
+				StagingTargetPath: t.TempDir(),
+			})
+			return err
+		}, codes.InvalidArgument},
+		{"NotFound: not staged at the staging path", func(t *testing.T, ns *nodeServer) error {
+			return publish(t, ns, t.TempDir())
+		}, codes.NotFound},
+		{"FailedPrecondition: staging path not mounted", func(t *testing.T, ns *nodeServer) error {
+			stagingParentPath := t.TempDir()
+			if err := os.WriteFile(filepath.Join(stagingParentPath, "vol-1"), nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			return publish(t, ns, stagingParentPath)
+		}, codes.FailedPrecondition},
+		{"Aborted: operation in progress", func(t *testing.T, ns *nodeServer) error {
+			unlock := ns.volumeLocks.Lock("vol-1")
+			defer unlock()
+			_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "vol-1",
+				TargetPath: filepath.Join(t.TempDir(), "volume"),
+			})
+			return err
+		}, codes.Aborted},
+		{"ResourceExhausted: node filesystem full", func(*testing.T, *nodeServer) error {
+			return stageStatus(&os.PathError{Op: "write", Path: "/var/lib/kubelet", Err: syscall.ENOSPC})
+		}, codes.ResourceExhausted},
+		{"DeadlineExceeded: nvme connect timed out", func(t *testing.T, ns *nodeServer) error {
+			return stage(t, ns, fmt.Errorf("nvme connect-all: %w after 30s", util.ErrTimeout))
+		}, codes.DeadlineExceeded},
+		{"Unavailable: no path to the target", func(t *testing.T, ns *nodeServer) error {
+			return stage(t, ns, fmt.Errorf("nvme connect-all: %w", util.ErrNoPath))
+		}, codes.Unavailable},
+		{"Unauthenticated: host refused", func(t *testing.T, ns *nodeServer) error {
+			return stage(t, ns, fmt.Errorf("nvme connect-all: %w", util.ErrAuthFailed))
+		}, codes.Unauthenticated},
+		{"Canceled: request cancelled", func(*testing.T, *nodeServer) error {
+			return stageStatus(fmt.Errorf("failed to mount: %w", context.Canceled))
+		}, codes.Canceled},
+		{"Internal: anything else", func(t *testing.T, ns *nodeServer) error {
+			return stage(t, ns, errors.New("nvme connect-all failed"))
+		}, codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, _ := newTestNodeServer(t, &util.Config{})
+			if err := tt.call(t, ns); status.Code(err) != tt.want {
+				t.Errorf("got %v, want code %v", err, tt.want)
+			}
+		})
+	}
+}
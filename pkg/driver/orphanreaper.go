@@ -0,0 +1,105 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// levels below the staging root the staging dirs are looked for in, the
+// kubelet stages at <root>/<hash>/globalmount, older ones at <root>/pv/<name>/globalmount
+const orphanSearchDepth = 3
+
+// bound of the disconnect of an orphaned volume
+const orphanDisconnectTimeout = 2 * time.Minute
+
+// reapOrphanedStaging cleans up the staging dirs below root left by volumes
+// that are no longer staged, e.g. after a reboot of a node whose kubelet dir
+// isn't on tmpfs. A staging dir is orphaned when it holds a stashed volume
+// context but none of its volumes is mounted. The subsystem of an orphaned
+// volume is disconnected unless another volume uses it, and the dir is
+// removed. The device of a live volume is claimed, a volume found staged on
+// the device of another one then fails to stage again. It runs before the
+// node server serves any request, failures are only logged.
+func (ns *nodeServer) reapOrphanedStaging(root string) {
+	stagingDirs, err := util.FindStagingDirs(root, orphanSearchDepth)
+	if err != nil {
+		klog.Errorf("orphan reaper: %v", err)
+		return
+	}
+	for _, stagingDir := range stagingDirs {
+		ns.reapStagingDir(stagingDir)
+	}
+}
+
+func (ns *nodeServer) reapStagingDir(stagingDir string) {
+	volumeIDs, err := util.StagedEntries(stagingDir)
+	if err != nil {
+		klog.Errorf("orphan reaper: failed to list staging dir %s: %v", stagingDir, err)
+		return
+	}
+	for _, volumeID := range volumeIDs {
+		mounted, err := ns.isStaged(filepath.Join(stagingDir, volumeID))
+		if err != nil || mounted {
+			// a live volume, or one that can't be told apart from one
+			if err == nil && len(volumeIDs) == 1 {
+				if _, err := ns.claimStashedDevice(volumeID, stagingDir); err != nil {
+					klog.Errorf("orphan reaper: failed to claim the device of volume %s: %v", volumeID, err)
+				}
+			}
+			return
+		}
+	}
+	// stashes of older versions don't record the volume ID, its mount point tells it
+	var volumeID string
+	if stashed, err := util.LookupVolumeContext(stagingDir); err == nil {
+		volumeID = stashed[util.StagedVolumeIDKey]
+	}
+	if volumeID == "" && len(volumeIDs) == 1 {
+		volumeID = volumeIDs[0]
+	}
+	if volumeID == "" {
+		klog.Warningf("orphan reaper: can't tell the volume staged at %s, leaving it", stagingDir)
+		return
+	}
+	klog.Infof("orphan reaper: staging dir %s has no mounted volume, cleaning up volume %s", stagingDir, volumeID)
+	ctx, cancel := context.WithTimeout(context.Background(), orphanDisconnectTimeout)
+	defer cancel()
+	// drops the reference persisted for the volume, and disconnects its subsystem if unused
+	if err := ns.disconnectVolume(ctx, volumeID, stagingDir); err != nil {
+		klog.Errorf("orphan reaper: failed to disconnect volume %s staged at %s: %v", volumeID, stagingDir, err)
+		return
+	}
+	for _, name := range volumeIDs {
+		if err := ns.deleteMountPoint(filepath.Join(stagingDir, name)); err != nil {
+			klog.Errorf("orphan reaper: failed to remove %s: %v", filepath.Join(stagingDir, name), err)
+			return
+		}
+	}
+	if err := os.Remove(stagingDir); err != nil && !os.IsNotExist(err) {
+		klog.Warningf("orphan reaper: failed to remove staging dir %s: %v", stagingDir, err)
+		return
+	}
+	klog.Infof("orphan reaper: removed staging dir %s", stagingDir)
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// TestReapOrphanedStaging runs the reaper over a simulated kubelet staging
+// tree, <root>/<hash>/globalmount as the kubelet stages volumes
+func TestReapOrphanedStaging(t *testing.T) {
+	tests := []struct {
+		name string
+		// entry below the staging dir, none for a staging dir emptied by the kubelet
+		entry   string
+		mounted bool
+		// volume ID recorded in the stash, none for stashes of older versions
+		stashedID  string
+		wantReaped bool
+	}{
+		{name: "live volume", entry: "vol-1", mounted: true, stashedID: "vol-1"},
+		{name: "unmounted volume", entry: "vol-1", stashedID: "vol-1", wantReaped: true},
+		{name: "unmounted volume of an older version", entry: "vol-1", wantReaped: true},
+		{name: "empty staging dir", stashedID: "vol-1", wantReaped: true},
+		{name: "empty staging dir of an older version"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ns, mounter := newTestNodeServer(t, &util.Config{})
+			// the subsystem is kept connected, so no nvme-cli runs
+			ns.warmDisconnectDelay = time.Hour
+			root := t.TempDir()
+			stagingDir := filepath.Join(root, "3f2a9c", "globalmount")
+			nqn := fmt.Sprintf("nqn.2016-06.io.spdk:cnode%d", i)
+			stashed := map[string]string{
+				"nqn":       nqn,
+				"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+				"traddr":    "192.168.1.10",
+				"trsvcid":   "4420",
+				"transport": "tcp",
+			}
+			if tt.stashedID != "" {
+				stashed[util.StagedVolumeIDKey] = tt.stashedID
+			}
+			if err := util.StashVolumeContext(stashed, stagingDir); err != nil {
+				t.Fatal(err)
+			}
+			devicePath := fakeDevice(t)
+			if err := util.StashDevicePath(devicePath, stagingDir); err != nil {
+				t.Fatal(err)
+			}
+			if tt.entry != "" {
+				if err := os.Mkdir(filepath.Join(stagingDir, tt.entry), 0o750); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.mounted {
+				if err := mounter.Mount(devicePath, filepath.Join(stagingDir, tt.entry), "ext4", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ns.reapOrphanedStaging(root)
+
+			_, statErr := os.Stat(stagingDir)
+			_, disconnected := ns.idleSubsystems.Load(nqn)
+			if tt.wantReaped {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("staging dir %s not removed: %v", stagingDir, statErr)
+				}
+				if !disconnected {
+					t.Errorf("subsystem %s not disconnected", nqn)
+				}
+				return
+			}
+			if statErr != nil {
+				t.Errorf("staging dir %s removed: %v", stagingDir, statErr)
+			}
+			if disconnected {
+				t.Errorf("subsystem %s disconnected", nqn)
+			}
+			if _, claimed := ns.deviceClaims.Load(devicePath); claimed != tt.mounted {
+				t.Errorf("device %s claimed: %v, want %v", devicePath, claimed, tt.mounted)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+// setPaused pauses or resumes staging, a paused node server refuses to stage
+// volumes that aren't staged yet with Unavailable, so the CO retries later,
+// everything else, unstage and unpublish included, is served. source tells
+// who asked, for the log.
+func (ns *nodeServer) setPaused(paused bool, source string) {
+	if ns.paused.Swap(paused) == paused {
+		klog.Infof("node server already %s, requested by %s", pausedState(paused), source)
+		return
+	}
+	if paused {
+		klog.Warningf("node server PAUSED by %s: new volumes aren't staged until it's resumed", source)
+	} else {
+		klog.Infof("node server resumed by %s: volumes are staged again", source)
+	}
+}
+
+func pausedState(paused bool) string {
+	if paused {
+		return "paused"
+	}
+	return "running"
+}
+
+// handlePauseSignal toggles the pause of staging on each SIGUSR1
+func (ns *nodeServer) handlePauseSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+	go func() {
+		for range sigCh {
+			ns.setPaused(!ns.paused.Load(), "SIGUSR1")
+		}
+	}()
+}
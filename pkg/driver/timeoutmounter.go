@@ -0,0 +1,142 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+	"k8s.io/utils/mount"
+)
+
+// timeoutMounter bounds the mount and unmount syscalls of a mounter, which
+// block as long as the IO of a device whose paths are all dead, and the stat
+// of mount point checks, which blocks the same on a mounted filesystem. The call keeps
+// running in its goroutine after the timeout, there's no cancelling a syscall,
+// it's only logged and counted when it eventually returns.
+type timeoutMounter struct {
+	mount.Interface
+	timeout time.Duration
+
+	timeouts atomic.Uint64 // calls abandoned after the timeout
+	hung     atomic.Int64  // abandoned calls still running
+}
+
+func newTimeoutMounter(mounter mount.Interface, timeout time.Duration) *timeoutMounter {
+	return &timeoutMounter{Interface: mounter, timeout: timeout}
+}
+
+func (m *timeoutMounter) Mount(source, target, fstype string, options []string) error {
+	return m.run("mount "+source+" at "+target, func() error {
+		return m.Interface.Mount(source, target, fstype, options)
+	})
+}
+
+func (m *timeoutMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	return m.run("mount "+source+" at "+target, func() error {
+		return m.Interface.MountSensitive(source, target, fstype, options, sensitiveOptions)
+	})
+}
+
+func (m *timeoutMounter) Unmount(target string) error {
+	return m.run("unmount "+target, func() error {
+		return m.Interface.Unmount(target)
+	})
+}
+
+func (m *timeoutMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	return m.runBool("mount point check of "+file, func() (bool, error) {
+		return m.Interface.IsLikelyNotMountPoint(file)
+	})
+}
+
+// IsNotMountPoint is mount.IsNotMountPoint bounded as a whole, it stats file
+// and lists the mounts through the wrapped mounter
+func (m *timeoutMounter) IsNotMountPoint(file string) (bool, error) {
+	return m.runBool("mount point check of "+file, func() (bool, error) {
+		return mount.IsNotMountPoint(m.Interface, file)
+	})
+}
+
+// runBool is run for calls returning a bool, false if abandoned
+func (m *timeoutMounter) runBool(operation string, call func() (bool, error)) (bool, error) {
+	result := make(chan bool, 1)
+	err := m.run(operation, func() error {
+		value, err := call()
+		result <- value
+		return err
+	})
+	select {
+	case value := <-result:
+		return value, err
+	default:
+		return false, err
+	}
+}
+
+// run returns the error of call, or one wrapping context.DeadlineExceeded if
+// it didn't return within the timeout
+func (m *timeoutMounter) run(operation string, call func() error) error {
+	const (
+		running int32 = iota
+		returned
+		abandoned
+	)
+	var state atomic.Int32
+	done := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		err := call()
+		if state.CompareAndSwap(running, returned) {
+			done <- err
+			return
+		}
+		m.hung.Add(-1)
+		klog.Warningf("%s returned %v after being abandoned, took %v", operation, err, time.Since(start).Round(time.Second))
+	}()
+
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	// counted before the goroutine may see the call abandoned and uncount it
+	m.hung.Add(1)
+	if !state.CompareAndSwap(running, abandoned) {
+		m.hung.Add(-1)
+		return <-done // returned just now
+	}
+	m.timeouts.Add(1)
+	klog.Errorf("%s didn't return within %v, abandoning it, the device may be stuck", operation, m.timeout)
+	return fmt.Errorf("%w: %s didn't return within %v", context.DeadlineExceeded, operation, m.timeout)
+}
+
+// mountErrorRecorder keeps the error of the last mount through it
+type mountErrorRecorder struct {
+	mount.Interface
+	err error
+}
+
+func (r *mountErrorRecorder) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	r.err = r.Interface.MountSensitive(source, target, fstype, options, sensitiveOptions)
+	return r.err
+}
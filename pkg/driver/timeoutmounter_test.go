@@ -0,0 +1,82 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"k8s.io/utils/mount"
+)
+
+// hangingMounter blocks the mount point checks until released, as the stat of
+// a filesystem on a device without live path does
+type hangingMounter struct {
+	*mount.FakeMounter
+	release chan struct{}
+}
+
+func (m *hangingMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	<-m.release
+	return m.FakeMounter.IsLikelyNotMountPoint(file)
+}
+
+func TestTimeoutMounterMountPointCheck(t *testing.T) {
+	hanging := &hangingMounter{FakeMounter: mount.NewFakeMounter(nil), release: make(chan struct{})}
+	ns := &nodeServer{mounter: hanging}
+	ns.timeoutMounter = newTimeoutMounter(ns.mounter, 50*time.Millisecond)
+	ns.mounter = ns.timeoutMounter
+	path := t.TempDir()
+
+	if _, err := ns.isNotMountPoint(path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("isNotMountPoint of a hanging mount point: %v, want DeadlineExceeded", err)
+	}
+	if _, err := ns.mounter.IsLikelyNotMountPoint(path); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("IsLikelyNotMountPoint of a hanging mount point: %v, want DeadlineExceeded", err)
+	}
+	_, err := ns.isStaged(path)
+	if mountErrorCode(err) != codes.DeadlineExceeded {
+		t.Errorf("isStaged of a hanging mount point: %v, want DeadlineExceeded", err)
+	}
+	if got := ns.timeoutMounter.timeouts.Load(); got != 3 {
+		t.Errorf("%d timeouts counted, want 3", got)
+	}
+
+	close(hanging.release)
+	if err := hanging.Mount("/dev/nvme0n1", path, "ext4", nil); err != nil {
+		t.Fatal(err)
+	}
+	notMounted, err := ns.isNotMountPoint(path)
+	if err != nil || notMounted {
+		t.Errorf("isNotMountPoint of a mount point = %v, %v, want false", notMounted, err)
+	}
+	notMounted, err = ns.isNotMountPoint(t.TempDir())
+	if err != nil || !notMounted {
+		t.Errorf("isNotMountPoint of a dir = %v, %v, want true", notMounted, err)
+	}
+	// the abandoned calls return once released
+	deadline := time.Now().Add(5 * time.Second)
+	for ns.timeoutMounter.hung.Load() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ns.timeoutMounter.hung.Load(); got != 0 {
+		t.Errorf("%d calls still hung after release, want 0", got)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// NodeGetVolumeStats reports the size of block volumes, and the space and
+// inodes of the filesystem of mount volumes as statfs has them, see
+// util.FilesystemStats for how xfs inodes differ from ext4 ones
+func (ns *nodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path missing in request")
+	}
+	info, err := os.Stat(volumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s doesn't exist", volumePath)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stat volume path %s: %v", volumePath, err)
+	}
+
+	if !info.IsDir() {
+		size, err := util.DeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get the size of block volume %s: %v", volumePath, err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: size}},
+		}, nil
+	}
+
+	// statfs of an unmounted dir would report the filesystem of the kubelet
+	notMounted, err := ns.isNotMountPoint(volumePath)
+	if err != nil {
+		return nil, status.Errorf(mountErrorCode(err), "failed to check mount point %s: %v", volumePath, err)
+	}
+	if notMounted {
+		return nil, status.Errorf(codes.NotFound, "volume path %s isn't mounted", volumePath)
+	}
+	stats, err := util.FilesystemStats(volumePath)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	usage := []*csi.VolumeUsage{{
+		Unit:      csi.VolumeUsage_BYTES,
+		Total:     stats.TotalBytes,
+		Available: stats.AvailableBytes,
+		Used:      stats.UsedBytes,
+	}}
+	if stats.TotalInodes > 0 {
+		usage = append(usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     stats.TotalInodes,
+			Available: stats.FreeInodes,
+			Used:      stats.UsedInodes,
+		})
+	}
+	util.V(util.LogNode, 4).Infof("stats of volume %s at %s (xfs: %v): %+v", req.GetVolumeId(), volumePath, stats.XFS, stats)
+	return &csi.NodeGetVolumeStatsResponse{Usage: usage}, nil
+}
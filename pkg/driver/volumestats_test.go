@@ -0,0 +1,69 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// the figures of ext4 and xfs are covered by TestStatfsStats of package util,
+// this checks they reach the response as is
+func TestNodeGetVolumeStats(t *testing.T) {
+	ns, mounter := newTestNodeServer(t, &util.Config{})
+	volumePath := t.TempDir()
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vol1", VolumePath: volumePath}
+
+	// statfs would report the filesystem of the dir below
+	_, err := ns.NodeGetVolumeStats(context.Background(), req)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("NodeGetVolumeStats of an unmounted path: %v, want NotFound", err)
+	}
+
+	if err := mounter.Mount("/dev/nvme0n1", volumePath, "xfs", nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ns.NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("NodeGetVolumeStats: %v", err)
+	}
+	stats, err := util.FilesystemStats(volumePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	units := map[csi.VolumeUsage_Unit]bool{}
+	for _, usage := range resp.GetUsage() {
+		units[usage.GetUnit()] = true
+		// the figures may change between statfs calls, their relations don't
+		if usage.GetUnit() == csi.VolumeUsage_INODES && usage.GetUsed()+usage.GetAvailable() != usage.GetTotal() {
+			t.Errorf("inode usage %v, want used and available adding up to the total", usage)
+		}
+		if usage.GetUnit() == csi.VolumeUsage_BYTES && usage.GetUsed()+usage.GetAvailable() > usage.GetTotal() {
+			t.Errorf("byte usage %v, want used and available within the total", usage)
+		}
+	}
+	// filesystems without an inode limit report no inode usage
+	if !units[csi.VolumeUsage_BYTES] || units[csi.VolumeUsage_INODES] != (stats.TotalInodes > 0) || len(resp.GetUsage()) != len(units) {
+		t.Errorf("usage %v, want bytes and inodes if the filesystem has %d", resp.GetUsage(), stats.TotalInodes)
+	}
+}
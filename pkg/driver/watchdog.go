@@ -0,0 +1,153 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/ceph/ceph-nvmeof-csi/pkg/util"
+)
+
+// bound of a watchdog connect
+const watchdogConnectTimeout = time.Minute
+
+// longest wait between the connect attempts of the watchdog on a subsystem
+const maxWatchdogReconnectBackoff = 10 * time.Minute
+
+// reconnectState tracks the connect attempts of the watchdog on a subsystem
+// without controller, it's dropped once the subsystem has a live one again
+type reconnectState struct {
+	attempts    int
+	nextAttempt time.Time
+	givenUp     bool
+}
+
+// runWatchdog checks every interval that the subsystems of the staged volumes
+// still have a live controller. Controllers reconnecting are left to the
+// kernel, subsystems without any controller, e.g. once ctrl_loss_tmo expired,
+// are connected again. Failed connects are retried with a backoff starting at
+// watchdogReconnectBackoff, up to watchdogMaxReconnects times per outage.
+func (ns *nodeServer) runWatchdog(interval time.Duration) {
+	klog.Infof("Checking the paths of staged volumes every %v", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ns.checkPaths()
+	}
+}
+
+func (ns *nodeServer) checkPaths() {
+	// one volume per subsystem, connect-all brings back all of its namespaces
+	volumes := map[string]string{} // nqn -> volumeID
+	ns.stagedVolumes.Range(func(key, value any) bool {
+		vol, _ := value.(*stagedVolume) //nolint:errcheck // only *stagedVolume is stored
+		volumeID, _ := key.(string)     //nolint:errcheck // only string keys are stored
+		if util.IsLocalDevice(vol.publishContext) {
+			return true // no controller to watch
+		}
+		volumes[vol.publishContext["nqn"]] = volumeID
+		return true
+	})
+	for nqn := range ns.reconnectStates {
+		if _, ok := volumes[nqn]; !ok {
+			delete(ns.reconnectStates, nqn) // unstaged
+		}
+	}
+
+	for nqn, volumeID := range volumes {
+		states, err := util.ControllerStates(nqn)
+		if err != nil {
+			klog.Warningf("watchdog: failed to read the controllers of %s: %v", nqn, err)
+			continue
+		}
+		if slices.Contains(states, "live") {
+			delete(ns.reconnectStates, nqn)
+			continue
+		}
+		ns.watchdogPathsDown.Add(1)
+		if len(states) > 0 {
+			klog.Warningf("watchdog: subsystem %s of volume %s has no live controller %v, the kernel is reconnecting",
+				nqn, volumeID, states)
+			continue
+		}
+		state := ns.reconnectStates[nqn]
+		if state == nil {
+			state = &reconnectState{}
+			ns.reconnectStates[nqn] = state
+		}
+		if state.givenUp || time.Now().Before(state.nextAttempt) {
+			continue
+		}
+		if ns.watchdogMaxReconnects > 0 && state.attempts >= ns.watchdogMaxReconnects {
+			state.givenUp = true
+			ns.watchdogReconnectsGivenUp.Add(1)
+			klog.Errorf("watchdog: giving up on subsystem %s of volume %s after %d failed connects, restage the volume to recover",
+				nqn, volumeID, state.attempts)
+			continue
+		}
+		klog.Errorf("watchdog: subsystem %s of volume %s has no controller left, connecting again", nqn, volumeID)
+		if err := ns.restoreConnection(volumeID); err != nil {
+			ns.watchdogReconnectFailures.Add(1)
+			state.attempts++
+			backoff := maxWatchdogReconnectBackoff
+			if state.attempts <= 16 { // the shift would overflow
+				backoff = min(ns.watchdogReconnectBackoff<<(state.attempts-1), maxWatchdogReconnectBackoff)
+			}
+			state.nextAttempt = time.Now().Add(backoff)
+			klog.Errorf("watchdog: failed to connect subsystem %s again, attempt %d, next one in %v: %v", nqn, state.attempts, backoff, err)
+			continue
+		}
+		ns.watchdogReconnects.Add(1)
+		delete(ns.reconnectStates, nqn)
+	}
+}
+
+// restoreConnection connects a staged volume whose controllers are gone
+func (ns *nodeServer) restoreConnection(volumeID string) error {
+	unlock, ok := ns.volumeLocks.TryAcquire(volumeID)
+	if !ok {
+		return fmt.Errorf("volume %s is busy, retrying at the next check", volumeID)
+	}
+	defer unlock()
+
+	vol := ns.lookupStagedVolume(volumeID)
+	if vol == nil {
+		return nil // unstaged meanwhile
+	}
+	if vol.authenticated {
+		return fmt.Errorf("volume %s uses DH-HMAC-CHAP, restage it to reconnect", volumeID)
+	}
+	initiator, err := ns.newInitiator(volumeID, vol.publishContext, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), watchdogConnectTimeout)
+	defer cancel()
+	unlockNQN := ns.nqnLocks.Lock(vol.publishContext["nqn"])
+	devicePath, err := initiator.Connect(ctx)
+	unlockNQN()
+	if err != nil {
+		return err
+	}
+	return ns.updateDevice(volumeID, vol, devicePath)
+}
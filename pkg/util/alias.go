@@ -0,0 +1,69 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dir of the stable device links of staged volumes, see -device-alias
+const deviceAliasDir = "/dev/nvmeof-csi"
+
+// DeviceAliasKey is the key of the stashed volume context recording the
+// device link of the volume, so it's removed at unstage whatever the flags
+const DeviceAliasKey = "deviceAlias"
+
+// DeviceAliasPath returns the stable device link of volumeID. Volume IDs are
+// base64, whose "/" is replaced by "_", a character base64 doesn't use.
+func DeviceAliasPath(volumeID string) string {
+	return filepath.Join(deviceAliasDir, strings.ReplaceAll(volumeID, "/", "_"))
+}
+
+// CreateDeviceAlias points aliasPath at devicePath, replacing any previous
+// link atomically so readers never miss it
+func CreateDeviceAlias(aliasPath, devicePath string) error {
+	target, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return fmt.Errorf("failed to resolve device %s: %w", devicePath, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(aliasPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(aliasPath), err)
+	}
+	tmp := aliasPath + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale link %s: %w", tmp, err)
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return fmt.Errorf("failed to create link %s: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, aliasPath); err != nil {
+		os.Remove(tmp) //nolint:errcheck // best effort
+		return fmt.Errorf("failed to create device alias %s: %w", aliasPath, err)
+	}
+	return nil
+}
+
+// RemoveDeviceAlias removes the link at aliasPath, if any
+func RemoveDeviceAlias(aliasPath string) error {
+	if err := os.Remove(aliasPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove device alias %s: %w", aliasPath, err)
+	}
+	return nil
+}
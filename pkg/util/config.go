@@ -16,13 +16,249 @@ limitations under the License.
 
 package util
 
-// Config stores parsed command line parameters
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Config stores parsed command line parameters. Fields holding credentials
+// must be tagged `redact:"true"` to be left out of Dump.
 type Config struct {
 	DriverName    string
 	DriverVersion string
 	Endpoint      string
 	NodeID        string
 
+	// gateway used by volumes without a clusterID
+	GatewayAddress string
+	// JSON file listing the gateway of each cluster, see LoadClusters
+	ClustersFile string
+	// gateways of the clusters volumes can be provisioned on, by clusterID
+	Clusters map[string]ClusterInfo
+
+	// listen address of the node debug endpoints, disabled when empty
+	DebugAddress string
+	// listen address of net/http/pprof, disabled when empty
+	PprofAddress string
+	// listen address of the prometheus metrics, disabled when empty
+	MetricsAddress string
+	// listen address of the controller /healthz, disabled when empty
+	HealthAddress string
+	// how long the gateway must be unreachable for /healthz to fail
+	HealthGatewayThreshold time.Duration
+
+	// file keeping the namespaces in use of each subsystem across restarts, not kept when empty
+	SubsystemStateFile string
+
+	// NVMe controllers on the node above which staging is refused, 0 is unlimited
+	MaxControllers int
+
+	// per subsystem log verbosity, negative falls back to -v
+	InitiatorLogLevel  int
+	NodeLogLevel       int
+	ControllerLogLevel int
+
+	// bound of mkfs when staging filesystem volumes, 0 leaves it to the request deadline
+	FormatTimeout time.Duration
+	// times a mkfs failing on a device not ready yet is run again, never if 0
+	MkfsRetries int
+	// filesystem of volumes whose mount capability has no fsType
+	DefaultFsType string
+	// bound of a whole NodeStageVolume, connect to mount, disabled if 0
+	StageTimeout time.Duration
+	// bound of mount and unmount syscalls, which hang on a device without live path, disabled if 0
+	MountTimeout time.Duration
+	// read the device of a volume before staging it, retrying this long, disabled if 0
+	DeviceIOCheckTimeout time.Duration
+	// link the device of staged volumes at /dev/nvmeof-csi/<volume ID>
+	DeviceAlias bool
+	// modes of the mount point directories and block target files created at
+	// stage and publish, only the kubelet, running as root, needs to get through
+	MountDirMode  os.FileMode
+	BlockFileMode os.FileMode
+	// run udevadm settle for up to this long after connecting, disabled if 0
+	UdevSettleTimeout time.Duration
+	// how the device of a namespace is found after connecting, see DeviceResolverByID
+	DeviceResolver string
+	// development only: stage the local device of a device_path publish context as is
+	AllowLocalDevice bool
+	// bytes of the output of nvme and udevadm commands logged, unlimited if 0
+	MaxLoggedOutput int
+	// arguments put before the nvme and udevadm commands, e.g. to nsenter the host
+	CommandPrefix []string
+	// how long the device and its controllers must stay gone before a disconnect is confirmed
+	DisconnectStableTime time.Duration
+	// wait after nvme disconnect before checking the device is gone
+	DisconnectCheckDelay time.Duration
+	// comma separated nvme connect options the extraConnectArgs parameter may use
+	ExtraConnectArgsAllowlist string
+	// connect parameters of each transport used when the StorageClass doesn't set them
+	TransportDefaults map[string]map[string]string
+	// kubelet dir scanned for orphaned staging dirs at startup, disabled when empty
+	OrphanStagingRoot string
+	// debugging: copy the volume context of unstaged volumes below this dir,
+	// keeping the last KeepVolumeContextCount per volume, disabled if empty
+	KeepVolumeContext      string
+	KeepVolumeContextCount int
+	// durable dir of the stashed volume contexts, one dir per volume, the staging dir if empty
+	ContextDir string
+	// how often staged volumes are checked for a live controller, disabled if 0
+	WatchdogInterval time.Duration
+	// failed connects of a subsystem without controller before the watchdog gives up, 0 is unlimited
+	WatchdogMaxReconnects int
+	// wait after the first failed watchdog connect, doubling with each failure
+	WatchdogReconnectBackoff time.Duration
+	// give up waiting on a hung nvme disconnect at unstage after this long, 0 waits forever
+	ForceUnstageTimeout time.Duration
+	// keep a subsystem connected this long after its last volume is unstaged, disabled if 0
+	WarmDisconnectDelay time.Duration
+
+	// consecutive gateway failures opening its circuit breaker, 0 disables it
+	GatewayBreakerThreshold int
+	// how long an open circuit breaker fails gateway calls before probing again
+	GatewayBreakerCooldown time.Duration
+	// prefix of the subsystem NQNs derived from the subsystemName parameter
+	NQNPrefix string
+	// retries of a transiently failing namespace_add when creating a volume
+	NamespaceAddRetries int
+	// wait for the gateway, then the device, to report the new size of an expanded volume
+	ExpandVerifyTimeout time.Duration
+
 	IsControllerServer bool
 	IsNodeServer       bool
 }
+
+// ClusterInfo describes how to reach the NVMe-oF gateway of a Ceph cluster.
+// The gateway holds the Ceph credentials, the controller only authenticates
+// to the gateway, with TLS when any of the PEM files is set.
+type ClusterInfo struct {
+	ClusterID      string `json:"clusterID"`
+	GatewayAddress string `json:"gatewayAddress"`
+	// verifies the certificate of the gateway, the system roots if empty
+	GatewayCAFile string `json:"gatewayCAFile,omitempty"`
+	// client certificate and key of the controller, for gateways enforcing mutual TLS
+	GatewayCertFile string `json:"gatewayCertFile,omitempty"`
+	GatewayKeyFile  string `json:"gatewayKeyFile,omitempty"`
+}
+
+// TLSConfig returns the TLS config of the connection to the gateway, nil if
+// it's plaintext
+func (c ClusterInfo) TLSConfig() (*tls.Config, error) {
+	if c.GatewayCAFile == "" && c.GatewayCertFile == "" && c.GatewayKeyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.GatewayCAFile != "" {
+		ca, err := os.ReadFile(c.GatewayCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the gateway CA: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no PEM certificate in the gateway CA %s", c.GatewayCAFile)
+		}
+	}
+	if (c.GatewayCertFile == "") != (c.GatewayKeyFile == "") {
+		return nil, errors.New("gatewayCertFile and gatewayKeyFile must be set together")
+	}
+	if c.GatewayCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.GatewayCertFile, c.GatewayKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the gateway client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// LoadClusters fills conf.Clusters from fileName, a JSON list of ClusterInfo,
+// checking the TLS files of each can be loaded
+//
+//	[{"clusterID": "ceph-a", "gatewayAddress": "10.0.0.1:5500"},
+//	 {"clusterID": "ceph-b", "gatewayAddress": "10.0.1.1:5500", "gatewayCAFile": "/etc/nvmeof-csi/ceph-b/ca.crt",
+//	  "gatewayCertFile": "/etc/nvmeof-csi/ceph-b/tls.crt", "gatewayKeyFile": "/etc/nvmeof-csi/ceph-b/tls.key"}]
+func (conf *Config) LoadClusters(fileName string) error {
+	var clusters []ClusterInfo
+	if err := ParseJSONFile(fileName, &clusters); err != nil {
+		return fmt.Errorf("failed to parse clusters file %s: %w", fileName, err)
+	}
+
+	conf.Clusters = make(map[string]ClusterInfo, len(clusters))
+	for _, cluster := range clusters {
+		if cluster.ClusterID == "" || cluster.GatewayAddress == "" {
+			return fmt.Errorf("clusters file %s: clusterID and gatewayAddress are required: %+v", fileName, cluster)
+		}
+		if _, err := cluster.TLSConfig(); err != nil {
+			return fmt.Errorf("clusters file %s: cluster %s: %w", fileName, cluster.ClusterID, err)
+		}
+		if _, ok := conf.Clusters[cluster.ClusterID]; ok {
+			return fmt.Errorf("clusters file %s: duplicate clusterID %s", fileName, cluster.ClusterID)
+		}
+		conf.Clusters[cluster.ClusterID] = cluster
+	}
+	return nil
+}
+
+// LoadControllerClusters loads ClustersFile when the controller server runs.
+// Only the controller server talks to the gateways, a node-only plugin stages
+// volumes from the publish context and must start without them.
+func (conf *Config) LoadControllerClusters() error {
+	if conf.ClustersFile == "" {
+		return nil
+	}
+	if !conf.IsControllerServer {
+		klog.Warningf("-clusters-file is only used by the controller server, ignoring it")
+		return nil
+	}
+	return conf.LoadClusters(conf.ClustersFile)
+}
+
+// environment variables the node ID is taken from when -nodeid isn't set,
+// usually filled from spec.nodeName with the downward API
+var nodeIDEnvs = []string{"NODE_ID", "KUBE_NODE_NAME"}
+
+// CSI limits the node ID reported by NodeGetInfo to 256 bytes
+const maxNodeIDLength = 256
+
+// ResolveNodeID fills NodeID from the environment when it isn't set and checks
+// it's usable, an empty node ID would make NodeGetInfo report a broken node
+func (conf *Config) ResolveNodeID() error {
+	// an undefined variable is passed on as is in a $(NODE_ID) container arg
+	if strings.HasPrefix(conf.NodeID, "$(") {
+		conf.NodeID = ""
+	}
+	for _, env := range nodeIDEnvs {
+		if conf.NodeID != "" {
+			break
+		}
+		conf.NodeID = os.Getenv(env)
+	}
+	if conf.NodeID == "" {
+		return fmt.Errorf("node ID is not set, use -nodeid or set one of the environment variables %v", nodeIDEnvs)
+	}
+	if len(conf.NodeID) > maxNodeIDLength {
+		return fmt.Errorf("node ID %q is longer than %d bytes", conf.NodeID, maxNodeIDLength)
+	}
+	return nil
+}
+
+// ParseFileMode parses an octal permission mode like 0750, other mode bits
+// aren't accepted
+func ParseFileMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q, expected an octal mode like 0750: %w", value, err)
+	}
+	if os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("invalid mode %q, only permission bits are allowed", value)
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadControllerClusters(t *testing.T) {
+	clustersFile := filepath.Join(t.TempDir(), "clusters.json")
+	if err := os.WriteFile(clustersFile, []byte(`[{"clusterID": "ceph-a", "gatewayAddress": "10.0.0.1:5500"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := Config{ClustersFile: clustersFile, IsControllerServer: true}
+	if err := conf.LoadControllerClusters(); err != nil {
+		t.Fatalf("LoadControllerClusters: %v", err)
+	}
+	if conf.Clusters["ceph-a"].GatewayAddress != "10.0.0.1:5500" {
+		t.Errorf("clusters %v, want ceph-a at 10.0.0.1:5500", conf.Clusters)
+	}
+
+	conf = Config{ClustersFile: filepath.Join(t.TempDir(), "missing.json"), IsControllerServer: true}
+	if err := conf.LoadControllerClusters(); err == nil {
+		t.Error("LoadControllerClusters of a missing clusters file succeeded")
+	}
+
+	// a node-only plugin starts with a clusters file it can't read, it
+	// doesn't use it
+	conf = Config{ClustersFile: filepath.Join(t.TempDir(), "missing.json"), IsNodeServer: true}
+	if err := conf.LoadControllerClusters(); err != nil {
+		t.Errorf("LoadControllerClusters of a node-only plugin: %v", err)
+	}
+	if conf.Clusters != nil {
+		t.Errorf("node-only plugin loaded clusters %v", conf.Clusters)
+	}
+}
+
+func TestClusterTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := ClusterInfo{ClusterID: "ceph-a", GatewayAddress: "10.0.0.1:5500"}.TLSConfig()
+	if config != nil || err != nil {
+		t.Errorf("TLSConfig without TLS files: %v, %v, want plaintext", config, err)
+	}
+
+	tests := []struct {
+		name    string
+		cluster ClusterInfo
+		wantErr string
+	}{
+		{"missing CA", ClusterInfo{GatewayCAFile: filepath.Join(dir, "missing.pem")}, "failed to read the gateway CA"},
+		{"CA without certificate", ClusterInfo{GatewayCAFile: garbage}, "no PEM certificate"},
+		{"certificate without key", ClusterInfo{GatewayCertFile: garbage}, "must be set together"},
+		{"key without certificate", ClusterInfo{GatewayKeyFile: garbage}, "must be set together"},
+		{"invalid key pair", ClusterInfo{GatewayCertFile: garbage, GatewayKeyFile: garbage}, "failed to load the gateway client certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cluster.TLSConfig(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("TLSConfig: %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the TLS files are checked when the clusters are loaded
+	clustersFile := filepath.Join(dir, "clusters.json")
+	clusters := `[{"clusterID": "ceph-a", "gatewayAddress": "10.0.0.1:5500", "gatewayCAFile": "` + garbage + `"}]`
+	if err := os.WriteFile(clustersFile, []byte(clusters), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	conf := Config{}
+	if err := conf.LoadClusters(clustersFile); err == nil || !strings.Contains(err.Error(), "cluster ceph-a") {
+		t.Errorf("LoadClusters with an invalid CA: %v, want an error naming ceph-a", err)
+	}
+}
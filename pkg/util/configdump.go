@@ -0,0 +1,59 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+)
+
+// value of Config fields tagged `redact:"true"` in Dump
+const redactedValue = "***"
+
+// Dump returns the configuration as a single line of JSON, for logs and
+// -print-config. Fields tagged `redact:"true"`, credentials and the like,
+// only show whether they are set.
+func (conf *Config) Dump() (string, error) {
+	fields := map[string]interface{}{}
+	value := reflect.ValueOf(conf).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldValue := value.Field(i)
+		switch v := fieldValue.Interface().(type) {
+		case time.Duration:
+			fields[field.Name] = v.String()
+		case os.FileMode:
+			fields[field.Name] = fmt.Sprintf("%#o", uint32(v))
+		default:
+			fields[field.Name] = v
+		}
+		if field.Tag.Get("redact") == "true" && !fieldValue.IsZero() {
+			fields[field.Name] = redactedValue
+		}
+	}
+	dump, err := json.Marshal(fields)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the configuration: %w", err)
+	}
+	return string(dump), nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameter, passed on in the publish context, of the paths a
+// connect must bring up for staging to go on, 1 when unset
+const minPathsKey = "minPaths"
+
+// ParseMinPaths reads the minimum number of paths, 1 when unset
+func ParseMinPaths(params map[string]string) (int, error) {
+	value, ok := params[minPathsKey]
+	if !ok {
+		return 1, nil
+	}
+	paths, err := strconv.Atoi(value)
+	if err != nil || paths < 1 {
+		return 0, fmt.Errorf("invalid %s %q, expected a positive integer", minPathsKey, value)
+	}
+	return paths, nil
+}
+
+// a controller created by nvme connect or connect-all, depending on the
+// nvme-cli version: "device: nvme1" or "connecting to device: nvme1"
+var connectedDeviceRe = regexp.MustCompile(`(?m)^(?:connecting to )?device: (nvme[0-9]+)\s*$`)
+
+// connectResult is what nvme connect-all reported for each path of the subsystem
+type connectResult struct {
+	devices          []string // controllers created
+	alreadyConnected int      // paths skipped as already connected
+	failures         []string // lines of the paths that failed
+}
+
+// paths returns the number of paths connected after the command, new or not
+func (r connectResult) paths() int {
+	return len(r.devices) + r.alreadyConnected
+}
+
+// parseConnectOutput splits the output of nvme connect-all in connected and
+// failed paths. connect-all exits with an error as soon as one path fails,
+// even when others connected.
+func parseConnectOutput(output string) connectResult {
+	var result connectResult
+	for _, match := range connectedDeviceRe.FindAllStringSubmatch(output, -1) {
+		result.devices = append(result.devices, match[1])
+	}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		lower := strings.ToLower(line)
+		switch {
+		case strings.Contains(lower, "already connected"):
+			result.alreadyConnected++
+		case strings.Contains(lower, "failed to"), strings.Contains(lower, "could not add new controller"):
+			result.failures = append(result.failures, line)
+		}
+	}
+	return result
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// the fixtures in testdata/connectall are outputs of nvme connect-all to a
+// subsystem with two paths, in the formats of several nvme-cli versions
+func TestParseConnectOutput(t *testing.T) {
+	tests := []struct {
+		fixture          string
+		wantDevices      []string
+		wantAlready      int
+		wantFailureLines int
+		wantPaths        int
+	}{
+		{"nvme-cli-1.16-connected.txt", []string{"nvme1", "nvme2"}, 0, 0, 2},
+		{"nvme-cli-1.16-failed.txt", nil, 0, 1, 0},
+		{"nvme-cli-2.4-connected.txt", []string{"nvme1", "nvme2"}, 0, 0, 2},
+		// one path up, the other refused, reported on two lines
+		{"nvme-cli-2.4-partial.txt", []string{"nvme1"}, 0, 2, 1},
+		{"nvme-cli-2.4-already-connected.txt", nil, 2, 0, 2},
+		{"nvme-cli-2.4-new-path.txt", []string{"nvme3"}, 1, 0, 2},
+		{"nvme-cli-2.4-failed.txt", nil, 0, 4, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", "connectall", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result := parseConnectOutput(string(output))
+			if !slices.Equal(result.devices, tt.wantDevices) {
+				t.Errorf("devices %v, want %v", result.devices, tt.wantDevices)
+			}
+			if result.alreadyConnected != tt.wantAlready {
+				t.Errorf("%d already connected, want %d", result.alreadyConnected, tt.wantAlready)
+			}
+			if len(result.failures) != tt.wantFailureLines {
+				t.Errorf("failures %q, want %d lines", result.failures, tt.wantFailureLines)
+			}
+			if result.paths() != tt.wantPaths {
+				t.Errorf("%d paths, want %d", result.paths(), tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestParseMinPaths(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", 0, true},
+		{"1", 1, false},
+		{"4", 4, false},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"two", 0, true},
+	}
+	if got, err := ParseMinPaths(nil); got != 1 || err != nil {
+		t.Errorf("ParseMinPaths unset = %d, %v, want 1", got, err)
+	}
+	for _, tt := range tests {
+		got, err := ParseMinPaths(map[string]string{minPathsKey: tt.value})
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseMinPaths(%q) = %d, %v, want %d, error %v", tt.value, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxArchivedContexts caps -keep-volume-context-count, the archive of a volume
+// is only pruned when it's archived again
+const MaxArchivedContexts = 100
+
+// suffix of the archived context files, prefixed by the time of the unstage
+const archivedContextSuffix = "-" + volumeContextFileName
+
+// ArchiveVolumeContext copies the volume context and device path stashed at
+// path to archiveDir/<volume ID>/<time>-volume-context.json, keeping the last
+// keep files of the volume, and returns the file written. The stash itself is
+// left for the caller to clean up.
+func ArchiveVolumeContext(path, archiveDir, volumeID string, keep int) (string, error) {
+	volumeContext, err := LookupVolumeContext(path)
+	if err != nil {
+		return "", err
+	}
+	// recorded along, to tell what was staged where
+	if devicePath, err := LookupDevicePath(path); err == nil {
+		volumeContext["devicePath"] = devicePath
+	}
+	volumeContext["stagingPath"] = path
+
+	dir := filepath.Join(archiveDir, strings.ReplaceAll(volumeID, "/", "_"))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create context archive %s: %w", dir, err)
+	}
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + archivedContextSuffix
+	if err := stashContext(volumeContext, dir, name); err != nil {
+		return "", err
+	}
+	pruneArchivedContexts(dir, keep)
+	return filepath.Join(dir, name), nil
+}
+
+// pruneArchivedContexts deletes all but the newest keep contexts of dir, the
+// names sort by time
+func pruneArchivedContexts(dir string, keep int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), archivedContextSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		os.Remove(filepath.Join(dir, names[0])) //nolint:errcheck // retried at the next archive
+		names = names[1:]
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// bytes read by the IO check, a block of any logical block size up to 4k
+const deviceIOCheckSize = 4096
+
+// CheckDeviceIO reads the first block of devicePath, retrying until it works
+// or timeout expires, to catch a device link showing up before the namespace
+// serves IO. With checkSize a device reporting a size of 0 fails too, mkfs
+// would fail on it. Nothing is written to the device.
+func CheckDeviceIO(ctx context.Context, devicePath string, checkSize bool, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		err := readDeviceBlock(devicePath, checkSize)
+		if err == nil {
+			return nil
+		}
+		V(LogInitiator, 4).Infof("device %s isn't ready for IO yet: %v", devicePath, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("device %s not ready for IO after %v: %w", devicePath, timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+func readDeviceBlock(devicePath string, checkSize bool) error {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if checkSize {
+		size, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("failed to get the size: %w", err)
+		}
+		if size == 0 {
+			return fmt.Errorf("size is 0")
+		}
+	}
+	buf := make([]byte, deviceIOCheckSize)
+	if _, err = f.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read the first block: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"k8s.io/utils/mount"
+)
+
+// depth of the staging dirs below the kubelet plugin dir, see FindStagingDirs
+const diagnoseStagingDepth = 3
+
+// Diagnosis is the NVMe state of the node, collected by Diagnose for bug reports
+type Diagnosis struct {
+	Controllers   []ControllerInfo   `json:"controllers"`
+	StagedVolumes []StagedVolumeInfo `json:"stagedVolumes"`
+	Mounts        []mount.MountPoint `json:"mounts"`
+	Errors        []string           `json:"errors,omitempty"`
+}
+
+// ControllerInfo is an NVMe controller as sysfs shows it
+type ControllerInfo struct {
+	Name       string   `json:"name"`
+	NQN        string   `json:"nqn"`
+	State      string   `json:"state"`
+	Transport  string   `json:"transport"`
+	Address    string   `json:"address"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// StagedVolumeInfo is a staging dir with a stashed volume context
+type StagedVolumeInfo struct {
+	StagingPath    string `json:"stagingPath"`
+	NQN            string `json:"nqn"`
+	UUID           string `json:"uuid"`
+	StashedDevice  string `json:"stashedDevice"`
+	ResolvedDevice string `json:"resolvedDevice"`
+	Connected      bool   `json:"connected"`
+}
+
+// Diagnose collects the controllers of the node from sysfs, the volumes
+// staged below stagingRoot with the device each resolves to by resolver, and
+// the mounts of NVMe devices or below stagingRoot. It only reads, it's safe on
+// a live node. What fails to be read is recorded in Errors.
+func Diagnose(ctx context.Context, stagingRoot, resolver string, mounter mount.Interface) *Diagnosis {
+	d := &Diagnosis{Controllers: []ControllerInfo{}, StagedVolumes: []StagedVolumeInfo{}, Mounts: []mount.MountPoint{}}
+
+	controllerDirs, err := filepath.Glob("/sys/class/nvme/nvme*")
+	if err != nil {
+		d.Errors = append(d.Errors, err.Error())
+	}
+	for _, dir := range controllerDirs {
+		namespaces, _ := filepath.Glob(filepath.Join(dir, "nvme*n*")) //nolint:errcheck // fixed pattern
+		for i := range namespaces {
+			namespaces[i] = filepath.Base(namespaces[i])
+		}
+		d.Controllers = append(d.Controllers, ControllerInfo{
+			Name:       filepath.Base(dir),
+			NQN:        readSysfs(dir, "subsysnqn"),
+			State:      readSysfs(dir, "state"),
+			Transport:  readSysfs(dir, "transport"),
+			Address:    readSysfs(dir, "address"),
+			Namespaces: namespaces,
+		})
+	}
+
+	connected, err := ConnectedSubsystems()
+	if err != nil {
+		d.Errors = append(d.Errors, err.Error())
+	}
+	stagingDirs, err := FindStagingDirs(stagingRoot, diagnoseStagingDepth)
+	if err != nil {
+		d.Errors = append(d.Errors, err.Error())
+	}
+	for _, dir := range stagingDirs {
+		volume := StagedVolumeInfo{StagingPath: dir}
+		volumeContext, err := LookupVolumeContext(dir)
+		if err != nil {
+			d.Errors = append(d.Errors, err.Error())
+		}
+		volume.NQN, volume.UUID = volumeContext["nqn"], volumeContext["uuid"]
+		_, volume.Connected = connected[volume.NQN]
+		volume.StashedDevice, _ = LookupDevicePath(dir) //nolint:errcheck // not stashed by older versions
+		if volume.UUID != "" {
+			if volume.ResolvedDevice, err = resolveDevice(ctx, resolver, volume.UUID); err != nil {
+				d.Errors = append(d.Errors, fmt.Sprintf("device of %s: %v", dir, err))
+			}
+		}
+		d.StagedVolumes = append(d.StagedVolumes, volume)
+	}
+
+	mountPoints, err := mounter.List()
+	if err != nil {
+		d.Errors = append(d.Errors, err.Error())
+	}
+	for _, mp := range mountPoints {
+		if strings.HasPrefix(mp.Device, "/dev/nvme") || strings.HasPrefix(mp.Path, stagingRoot) {
+			d.Mounts = append(d.Mounts, mp)
+		}
+	}
+	sort.Slice(d.Mounts, func(i, j int) bool { return d.Mounts[i].Path < d.Mounts[j].Path })
+	return d
+}
+
+// resolveDevice returns the device of the namespace uuid without waiting
+func resolveDevice(ctx context.Context, resolver, uuid string) (string, error) {
+	var devicePath string
+	var err error
+	if resolver == DeviceResolverNvmeList {
+		devicePath, err = findDeviceByUUID(ctx, uuid, 0)
+	} else {
+		devicePath, err = waitForDeviceReady(ctx, fmt.Sprintf("/dev/disk/by-id/nvme-uuid.*%s*", uuid), 0)
+	}
+	if err != nil || devicePath == "" {
+		return devicePath, err
+	}
+	return selectMultipathHead(devicePath), nil
+}
+
+// readSysfs returns the trimmed content of the attribute name of dir, empty if
+// it can't be read
+func readSysfs(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name)) // #nosec - sysfs path from a fixed glob
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// WriteText writes the diagnosis as tables
+func (d *Diagnosis) WriteText(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTROLLER\tSTATE\tTRANSPORT\tADDRESS\tNQN\tNAMESPACES")
+	for _, c := range d.Controllers {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Name, c.State, c.Transport, c.Address, c.NQN, strings.Join(c.Namespaces, ","))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "STAGING PATH\tNQN\tUUID\tCONNECTED\tSTASHED DEVICE\tRESOLVED DEVICE")
+	for _, v := range d.StagedVolumes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\t%s\n", v.StagingPath, v.NQN, v.UUID, v.Connected, v.StashedDevice, v.ResolvedDevice)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "MOUNT PATH\tDEVICE\tTYPE\tOPTIONS")
+	for _, mp := range d.Mounts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", mp.Path, mp.Device, mp.Type, strings.Join(mp.Opts, ","))
+	}
+	if len(d.Errors) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "ERRORS")
+		for _, e := range d.Errors {
+			fmt.Fprintln(w, e)
+		}
+	}
+	return w.Flush()
+}
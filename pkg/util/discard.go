@@ -0,0 +1,54 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameter mounting filesystem volumes with online discard, so
+// deleted data is trimmed from the thin-provisioned RBD image. Block volumes
+// are handed to the application as is, issuing discards is up to it.
+const discardKey = "discard"
+
+// ParseDiscard reads the discard StorageClass parameter from the volume context
+func ParseDiscard(volumeContext map[string]string) (bool, error) {
+	return parseBoolParameter(volumeContext, discardKey)
+}
+
+// DeviceSupportsDiscard tells if the block device behind devicePath accepts
+// discards, i.e. the NVMe namespace advertises deallocate
+func DeviceSupportsDiscard(devicePath string) (bool, error) {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve device %s: %w", devicePath, err)
+	}
+	maxBytesFile := filepath.Join("/sys/class/block", filepath.Base(realPath), "queue/discard_max_bytes")
+	data, err := os.ReadFile(maxBytesFile) // #nosec - sysfs path of a resolved device
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", maxBytesFile, err)
+	}
+	maxBytes, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %w", maxBytesFile, err)
+	}
+	return maxBytes > 0, nil
+}
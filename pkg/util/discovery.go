@@ -0,0 +1,92 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// discoveryLog is the part of nvme discover -o json output used to find a target
+type discoveryLog struct {
+	Records []discoveryRecord `json:"records"`
+}
+
+type discoveryRecord struct {
+	Trtype  string `json:"trtype"`
+	Traddr  string `json:"traddr"`
+	Trsvcid string `json:"trsvcid"`
+	Subnqn  string `json:"subnqn"`
+}
+
+// DiscoveryPublishContext returns the discovery controller parameters set in params, to pass on to the node
+func DiscoveryPublishContext(params map[string]string) map[string]string {
+	discovery := map[string]string{}
+	for _, key := range []string{discoveryTraddrKey, discoveryTrsvcidKey} {
+		if value, ok := params[key]; ok {
+			discovery[key] = value
+		}
+	}
+	return discovery
+}
+
+// discoverTarget asks the discovery controller for the ports of the subsystem
+// and picks the first one of the transport, setting targetAddr and targetPort
+func (nvmf *initiatorNVMf) discoverTarget(ctx context.Context) error {
+	port := nvmf.discoveryPort
+	if port == "" {
+		port = defaultDiscoveryPort
+	}
+	transport := strings.ToLower(nvmf.targetType)
+	cmdLine := []string{"nvme", "discover", "-t", transport, "-a", nvmf.discoveryAddr, "-s", port, "-o", "json"}
+	if nvmf.hostAddr != "" {
+		cmdLine = append(cmdLine, "-w", nvmf.hostAddr)
+	}
+	output, err := execWithTimeout(ctx, cmdLine, 40)
+	if err != nil {
+		return classifyNvmeError(cmdLine, output, err)
+	}
+	var log discoveryLog
+	if err := json.Unmarshal([]byte(output), &log); err != nil {
+		return fmt.Errorf("failed to parse the output of %v: %w", cmdLine, err)
+	}
+	var found *discoveryRecord
+	for i, record := range log.Records {
+		if record.Subnqn != nvmf.nqn || !strings.EqualFold(record.Trtype, transport) {
+			continue
+		}
+		if found == nil || (nvmf.preferredAddr != "" && record.Traddr == nvmf.preferredAddr) {
+			found = &log.Records[i]
+		}
+	}
+	if found != nil {
+		if nvmf.preferredAddr != "" && found.Traddr != nvmf.preferredAddr {
+			klog.Warningf("preferred_traddr %s isn't a port of subsystem %s, using %s", nvmf.preferredAddr, nvmf.nqn, found.Traddr)
+		}
+		klog.Infof("discovery controller %s:%s reports subsystem %s at %s:%s",
+			nvmf.discoveryAddr, port, nvmf.nqn, found.Traddr, found.Trsvcid)
+		nvmf.targetAddr = found.Traddr
+		nvmf.targetPort = found.Trsvcid
+		return nil
+	}
+	return fmt.Errorf("%w: discovery controller %s:%s has no %s port of subsystem %s",
+		ErrNoPath, nvmf.discoveryAddr, port, transport, nvmf.nqn)
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// StorageClass parameter overriding whether staging checks that nothing else
+// holds the device, by default it's done for single writer access modes only
+const exclusiveDeviceKey = "exclusiveDevice"
+
+// ErrDeviceBusy means the device is held exclusively, e.g. mounted, by someone else
+var ErrDeviceBusy = errors.New("device busy")
+
+// ParseExclusiveDevice tells if the device of a volume staged with mode must
+// be checked for other users. Nothing in staging opens the device with O_EXCL
+// otherwise, so multi writer volumes can be shared.
+func ParseExclusiveDevice(volumeContext map[string]string, mode csi.VolumeCapability_AccessMode_Mode) (bool, error) {
+	if _, ok := volumeContext[exclusiveDeviceKey]; ok {
+		return parseBoolParameter(volumeContext, exclusiveDeviceKey)
+	}
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER:
+		return true, nil
+	}
+	return false, nil
+}
+
+// CheckDeviceExclusive opens devicePath with O_EXCL to fail fast when another
+// user, e.g. a mount or device mapper, holds it
+func CheckDeviceExclusive(devicePath string) error {
+	f, err := os.OpenFile(devicePath, os.O_RDONLY|os.O_EXCL, 0)
+	if errors.Is(err, syscall.EBUSY) {
+		return fmt.Errorf("%w: %s is in use", ErrDeviceBusy, devicePath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", devicePath, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestParseExclusiveDevice(t *testing.T) {
+	for value, name := range csi.VolumeCapability_AccessMode_Mode_name {
+		mode := csi.VolumeCapability_AccessMode_Mode(value)
+		want := mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER ||
+			mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseExclusiveDevice(nil, mode)
+			if err != nil || got != want {
+				t.Errorf("ParseExclusiveDevice(%s) = %v, %v, want %v", name, got, err, want)
+			}
+			for _, override := range []bool{false, true} {
+				params := map[string]string{exclusiveDeviceKey: strconv.FormatBool(override)}
+				if got, err := ParseExclusiveDevice(params, mode); err != nil || got != override {
+					t.Errorf("ParseExclusiveDevice(%s, %v) = %v, %v, want %v", name, params, got, err, override)
+				}
+			}
+		})
+	}
+	params := map[string]string{exclusiveDeviceKey: "always"}
+	if _, err := ParseExclusiveDevice(params, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); err == nil {
+		t.Errorf("ParseExclusiveDevice(%v) accepted an invalid value", params)
+	}
+}
+
+func TestCheckDeviceExclusive(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "nvme0n1")
+	if err := os.WriteFile(device, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckDeviceExclusive(device); err != nil {
+		t.Errorf("CheckDeviceExclusive of an unused device: %v", err)
+	}
+	err := CheckDeviceExclusive(filepath.Join(t.TempDir(), "nvme1n1"))
+	if err == nil || errors.Is(err, ErrDeviceBusy) {
+		t.Errorf("CheckDeviceExclusive of a missing device: got %v, want an error other than ErrDeviceBusy", err)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// StorageClass parameter, passed on in the publish context, with nvme connect
+// options the driver doesn't model, e.g. "--keep-alive-tmo=30 --duplicate-connect".
+// Only long options listed by -extra-connect-args-allowlist are accepted.
+const extraConnectArgsKey = "extraConnectArgs"
+
+// an extra argument is --name or --name=value, values as one token only so
+// nothing can be smuggled in as a separate argument
+var extraConnectArgRe = regexp.MustCompile(`^--([a-z][a-z0-9_-]*)(=[A-Za-z0-9._:/-]+)?$`)
+
+// options set by the driver from the publish context and secrets, they can't
+// be allowlisted
+var reservedConnectArgs = map[string]struct{}{
+	"transport": {}, "traddr": {}, "trsvcid": {}, "nqn": {}, "host-traddr": {},
+	"hostnqn": {}, "hostid": {}, "hdr-digest": {}, "data-digest": {}, "nr-poll-queues": {},
+	"dhchap-secret": {}, "dhchap-ctrl-secret": {}, "tls": {}, "tls-key": {}, "keyring": {},
+	"config": {}, "raw": {}, "device": {}, "output-format": {},
+}
+
+// setExtraConnectArgsAllowlist sets the option names, without dashes, the
+// extraConnectArgs parameter may use from a comma separated list
+func setExtraConnectArgsAllowlist(list string) {
+	allowlist := map[string]struct{}{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimLeft(strings.TrimSpace(name), "-")
+		if name == "" {
+			continue
+		}
+		if _, ok := reservedConnectArgs[name]; ok {
+			klog.Warningf("nvme connect option --%s is set by the driver, ignoring it in the extra connect args allowlist", name)
+			continue
+		}
+		allowlist[name] = struct{}{}
+	}
+	initiatorConf.extraConnectArgsAllowlist = allowlist
+}
+
+// ParseExtraConnectArgs returns the arguments of the extraConnectArgs
+// parameter in params, failing on any option that isn't allowlisted
+func ParseExtraConnectArgs(params map[string]string) ([]string, error) {
+	value, ok := params[extraConnectArgsKey]
+	if !ok {
+		return nil, nil
+	}
+	args := strings.Fields(value)
+	for _, arg := range args {
+		match := extraConnectArgRe.FindStringSubmatch(arg)
+		if match == nil {
+			return nil, fmt.Errorf("%s: invalid argument %q, expected --option or --option=value", extraConnectArgsKey, arg)
+		}
+		if _, ok := initiatorConf.extraConnectArgsAllowlist[match[1]]; !ok {
+			return nil, fmt.Errorf("%s: option --%s isn't allowed, see -extra-connect-args-allowlist", extraConnectArgsKey, match[1])
+		}
+	}
+	if len(args) > 0 && params[connectModeKey] == connectModeConfig {
+		return nil, fmt.Errorf("%s can't be used with %s %s", extraConnectArgsKey, connectModeKey, connectModeConfig)
+	}
+	return args, nil
+}
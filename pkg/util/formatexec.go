@@ -0,0 +1,152 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+	utilexec "k8s.io/utils/exec"
+)
+
+// ErrFormatTimedOut means mkfs didn't finish in time, the device was wiped so a retry formats it again
+var ErrFormatTimedOut = errors.New("format timed out")
+
+// FormatExec runs the commands issued by mount.SafeFormatAndMount (blkid, fsck,
+// mkfs) under the request context, applying the FsckMode and bounding mkfs by
+// a timeout
+type FormatExec struct {
+	utilexec.Interface
+	ctx           context.Context
+	fsckMode      FsckMode
+	formatTimeout time.Duration
+	mkfsArgs      []string
+	formatAllowed atomic.Bool
+	timedOut      atomic.Bool
+}
+
+// NewFormatExec returns a command runner for mount.SafeFormatAndMount running
+// the commands through exec, a zero formatTimeout leaves mkfs bounded by ctx
+// only. mkfsArgs, validated by ParseMkfsArgs, are prepended to the mkfs
+// arguments.
+func NewFormatExec(ctx context.Context, exec utilexec.Interface, fsckMode FsckMode, formatTimeout time.Duration, mkfsArgs []string) *FormatExec {
+	return &FormatExec{
+		Interface:     exec,
+		ctx:           ctx,
+		fsckMode:      fsckMode,
+		formatTimeout: formatTimeout,
+		mkfsArgs:      mkfsArgs,
+	}
+}
+
+func (e *FormatExec) Command(cmd string, args ...string) utilexec.Cmd {
+	switch {
+	case cmd == "fsck" && e.fsckMode == FsckSkip:
+		klog.Infof("skipping fsck %v", args)
+		return e.Interface.CommandContext(e.ctx, "true")
+	case cmd == "fsck" && e.fsckMode == FsckForce:
+		return e.Interface.CommandContext(e.ctx, cmd, append([]string{"-f"}, args...)...)
+	case strings.HasPrefix(cmd, "mkfs.") && !e.formatAllowed.Load():
+		// second line of defense against formatting a device holding data
+		klog.Errorf("REFUSING to run %s %v, the device wasn't found blank", cmd, args)
+		return e.Interface.CommandContext(e.ctx, "false")
+	case strings.HasPrefix(cmd, "mkfs."):
+		// SafeFormatAndMount only formats blank devices, and passes the device last
+		args = append(append([]string{}, e.mkfsArgs...), args...)
+		ctx, cancel := e.formatContext()
+		return &formatCmd{Cmd: e.Interface.CommandContext(ctx, cmd, args...), ctx: ctx, cancel: cancel, exec: e}
+	}
+	return e.Interface.CommandContext(e.ctx, cmd, args...)
+}
+
+// AllowFormat lets e run mkfs, call it once the device is known to be blank
+func (e *FormatExec) AllowFormat() {
+	e.formatAllowed.Store(true)
+}
+
+func (e *FormatExec) formatContext() (context.Context, context.CancelFunc) {
+	if e.formatTimeout > 0 {
+		return context.WithTimeout(e.ctx, e.formatTimeout)
+	}
+	return context.WithCancel(e.ctx)
+}
+
+// FormatTimedOut tells if a mkfs run by e was killed before it completed
+func (e *FormatExec) FormatTimedOut() bool {
+	return e.timedOut.Load()
+}
+
+// WipeDevice erases the filesystem signatures of a half formatted device, so
+// the next SafeFormatAndMount sees it blank and formats it again
+func WipeDevice(ctx context.Context, devicePath string) error {
+	cmdLine := []string{"wipefs", "-a", devicePath}
+	output, err := execWithTimeout(ctx, cmdLine, 30)
+	if err != nil {
+		return fmt.Errorf("command %v failed: %w: %s", cmdLine, err, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// mkfs messages of a device failing IO, other failures are genuine, e.g. a bad option
+var deviceNotReadyMessages = []string{
+	"No such device",
+	"No such file or directory",
+	"Input/output error",
+	"No medium found",
+	"Device or resource busy",
+}
+
+// IsDeviceNotReadyFormatError tells if a failed mkfs of devicePath is worth a
+// retry: its output reports an IO failure of the device, or the device can't
+// be read or reports size 0 right now. A mkfs rejecting its arguments or the
+// device size isn't.
+func IsDeviceNotReadyFormatError(devicePath string, err error) bool {
+	for _, msg := range deviceNotReadyMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+	if readErr := readDeviceBlock(devicePath, true); readErr != nil {
+		V(LogNode, 4).Infof("device %s isn't ready after mkfs failed: %v", devicePath, readErr)
+		return true
+	}
+	return false
+}
+
+// formatCmd is a mkfs command bounded by the format timeout
+type formatCmd struct {
+	utilexec.Cmd
+	ctx    context.Context
+	cancel context.CancelFunc
+	exec   *FormatExec
+}
+
+// CombinedOutput is how SafeFormatAndMount runs mkfs
+func (c *formatCmd) CombinedOutput() ([]byte, error) {
+	defer c.cancel()
+	output, err := c.Cmd.CombinedOutput()
+	// killed by the format timeout or by the end of the request, either way half formatted
+	if err != nil && c.ctx.Err() != nil {
+		c.exec.timedOut.Store(true)
+	}
+	return output, err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	utilexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+// recordingExec records the command lines it's asked for, which all succeed
+type recordingExec struct {
+	cmdLines [][]string
+}
+
+func (e *recordingExec) Command(cmd string, args ...string) utilexec.Cmd {
+	return e.CommandContext(context.Background(), cmd, args...)
+}
+
+func (e *recordingExec) CommandContext(_ context.Context, cmd string, args ...string) utilexec.Cmd {
+	e.cmdLines = append(e.cmdLines, append([]string{cmd}, args...))
+	fake := &testingexec.FakeCmd{CombinedOutputScript: []testingexec.FakeAction{
+		func() ([]byte, []byte, error) { return nil, nil, nil },
+	}}
+	return testingexec.InitFakeCmd(fake, cmd, args...)
+}
+
+func (e *recordingExec) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+func TestFormatExecRefusesMkfsUntilAllowed(t *testing.T) {
+	exec := &recordingExec{}
+	formatExec := NewFormatExec(context.Background(), exec, FsckAuto, 0, []string{"-b", "4096"})
+
+	if _, err := formatExec.Command("mkfs.ext4", "-F", "/dev/nvme0n1").CombinedOutput(); err != nil {
+		t.Fatalf("refused mkfs: %v", err)
+	}
+	if got := exec.cmdLines[0]; !slices.Equal(got, []string{"false"}) {
+		t.Errorf("mkfs before AllowFormat ran %v, want false", got)
+	}
+
+	formatExec.AllowFormat()
+	if _, err := formatExec.Command("mkfs.ext4", "-F", "/dev/nvme0n1").CombinedOutput(); err != nil {
+		t.Fatalf("mkfs: %v", err)
+	}
+	if got, want := exec.cmdLines[1], []string{"mkfs.ext4", "-b", "4096", "-F", "/dev/nvme0n1"}; !slices.Equal(got, want) {
+		t.Errorf("mkfs ran %v, want %v", got, want)
+	}
+}
+
+func TestFormatExecFsckMode(t *testing.T) {
+	tests := []struct {
+		mode FsckMode
+		want []string
+	}{
+		{FsckAuto, []string{"fsck", "-a", "/dev/nvme0n1"}},
+		{FsckSkip, []string{"true"}},
+		{FsckForce, []string{"fsck", "-f", "-a", "/dev/nvme0n1"}},
+	}
+	for _, tt := range tests {
+		exec := &recordingExec{}
+		formatExec := NewFormatExec(context.Background(), exec, tt.mode, 0, nil)
+		// how SafeFormatAndMount checks a device before mounting it rw
+		if _, err := formatExec.Command("fsck", "-a", "/dev/nvme0n1").CombinedOutput(); err != nil {
+			t.Fatalf("fsck: %v", err)
+		}
+		if got := exec.cmdLines[0]; !slices.Equal(got, tt.want) {
+			t.Errorf("fsck mode %d ran %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
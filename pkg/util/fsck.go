@@ -0,0 +1,78 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// FsckMode controls the filesystem check SafeFormatAndMount runs before
+// mounting an already formatted device read-write.
+//
+// The check is done by fsck(8) and only does real work for ext2/ext3/ext4,
+// fsck.xfs is a no-op since xfs replays its log on mount, use xfs_repair
+// offline to check xfs.
+type FsckMode int
+
+const (
+	// FsckAuto lets the mounter decide, it runs `fsck -a` on rw mounts
+	FsckAuto FsckMode = iota
+	// FsckSkip never runs fsck, for fast startup of trusted volumes
+	FsckSkip
+	// FsckForce runs `fsck -f -a` so clean filesystems are checked too
+	FsckForce
+)
+
+// StorageClass parameters selecting the FsckMode
+const (
+	skipFsckKey  = "skipFsck"
+	forceFsckKey = "forceFsck"
+)
+
+// ParseFsckMode reads the fsck StorageClass parameters from the volume context
+func ParseFsckMode(volumeContext map[string]string) (FsckMode, error) {
+	skip, err := parseBoolParameter(volumeContext, skipFsckKey)
+	if err != nil {
+		return FsckAuto, err
+	}
+	force, err := parseBoolParameter(volumeContext, forceFsckKey)
+	if err != nil {
+		return FsckAuto, err
+	}
+	switch {
+	case skip && force:
+		return FsckAuto, fmt.Errorf("%s and %s can't be both set", skipFsckKey, forceFsckKey)
+	case skip:
+		return FsckSkip, nil
+	case force:
+		return FsckForce, nil
+	}
+	return FsckAuto, nil
+}
+
+func parseBoolParameter(parameters map[string]string, key string) (bool, error) {
+	value, ok := parameters[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for parameter %s: %w", value, key, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseFsckMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    FsckMode
+		wantErr bool
+	}{
+		{"unset", nil, FsckAuto, false},
+		{"empty", map[string]string{skipFsckKey: ""}, FsckAuto, false},
+		{"skip", map[string]string{skipFsckKey: "true"}, FsckSkip, false},
+		{"force", map[string]string{forceFsckKey: "true"}, FsckForce, false},
+		{"both false", map[string]string{skipFsckKey: "false", forceFsckKey: "false"}, FsckAuto, false},
+		{"both true", map[string]string{skipFsckKey: "true", forceFsckKey: "true"}, FsckAuto, true},
+		{"not a bool", map[string]string{skipFsckKey: "yes"}, FsckAuto, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseFsckMode(tt.params)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("ParseFsckMode(%v) = %d, %v, want %d, error %v", tt.params, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
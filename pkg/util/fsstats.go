@@ -0,0 +1,62 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// statfs f_type of xfs
+const xfsSuperMagic = 0x58465342
+
+// FsStats are the space and inode figures of a mounted filesystem
+type FsStats struct {
+	TotalBytes, AvailableBytes, UsedBytes int64
+	// 0 for filesystems without an inode limit
+	TotalInodes, FreeInodes, UsedInodes int64
+	XFS                                 bool
+}
+
+// FilesystemStats returns the statfs figures of the filesystem mounted at path
+// as the filesystem reports them. ext4 has a fixed inode table, its total
+// never changes. xfs allocates inodes dynamically: its total is the inodes in
+// use plus those the free space still allows, capped by imaxpct, so it shrinks
+// as data fills the volume and the free inodes are what's left of it. Either
+// way free inodes running out means inode exhaustion, alerts must use them
+// rather than the total.
+func FilesystemStats(path string) (*FsStats, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, fmt.Errorf("statfs of %s: %w", path, err)
+	}
+	return statfsStats(&st), nil
+}
+
+// statfsStats converts the statfs figures of a filesystem
+func statfsStats(st *syscall.Statfs_t) *FsStats {
+	bsize := st.Bsize
+	return &FsStats{
+		TotalBytes:     int64(st.Blocks) * bsize,
+		AvailableBytes: int64(st.Bavail) * bsize,
+		UsedBytes:      int64(st.Blocks-st.Bfree) * bsize,
+		TotalInodes:    int64(st.Files),
+		FreeInodes:     int64(st.Ffree),
+		UsedInodes:     int64(st.Files - st.Ffree),
+		XFS:            st.Type == xfsSuperMagic,
+	}
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"syscall"
+	"testing"
+)
+
+// statfs of ext4
+const ext4SuperMagic = 0xef53
+
+// the statfs figures are those of 1GiB volumes formatted with the mkfs
+// defaults, empty and with data written
+func TestStatfsStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		statfs syscall.Statfs_t
+		want   FsStats
+	}{
+		{
+			name:   "ext4 empty",
+			statfs: syscall.Statfs_t{Type: ext4SuperMagic, Bsize: 4096, Blocks: 253920, Bfree: 253664, Bavail: 236832, Files: 65536, Ffree: 65525},
+			want:   FsStats{TotalBytes: 1040056320, AvailableBytes: 970063872, UsedBytes: 1048576, TotalInodes: 65536, FreeInodes: 65525, UsedInodes: 11},
+		},
+		{
+			// the inode table is fixed, data doesn't change the total
+			name:   "ext4 filled",
+			statfs: syscall.Statfs_t{Type: ext4SuperMagic, Bsize: 4096, Blocks: 253920, Bfree: 20000, Bavail: 3168, Files: 65536, Ffree: 65524},
+			want:   FsStats{TotalBytes: 1040056320, AvailableBytes: 12976128, UsedBytes: 958136320, TotalInodes: 65536, FreeInodes: 65524, UsedInodes: 12},
+		},
+		{
+			// capped by imaxpct, 25% of the blocks at 8 inodes a block
+			name:   "xfs empty",
+			statfs: syscall.Statfs_t{Type: xfsSuperMagic, Bsize: 4096, Blocks: 258475, Bfree: 251540, Bavail: 251540, Files: 524288, Ffree: 524285},
+			want:   FsStats{TotalBytes: 1058713600, AvailableBytes: 1030307840, UsedBytes: 28405760, TotalInodes: 524288, FreeInodes: 524285, UsedInodes: 3, XFS: true},
+		},
+		{
+			// the inodes in use plus those the free blocks still allow
+			name:   "xfs filled",
+			statfs: syscall.Statfs_t{Type: xfsSuperMagic, Bsize: 4096, Blocks: 258475, Bfree: 20000, Bavail: 20000, Files: 160064, Ffree: 160000},
+			want:   FsStats{TotalBytes: 1058713600, AvailableBytes: 81920000, UsedBytes: 976793600, TotalInodes: 160064, FreeInodes: 160000, UsedInodes: 64, XFS: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statfsStats(&tt.statfs); *got != tt.want {
+				t.Errorf("statfsStats = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+)
+
+// filesystems filesystem volumes can be formatted with
+var supportedFsTypes = []string{"ext4", "xfs"}
+
+// ValidateFsType fails for filesystems staging doesn't support
+func ValidateFsType(fsType string) error {
+	for _, supported := range supportedFsTypes {
+		if fsType == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("filesystem %q isn't supported, expected one of %v", fsType, supportedFsTypes)
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// host tooling run through -command-prefix when set, mkfs and fsck keep
+// running in the container next to the mounts they work on. cat reads the
+// hostnqn file of the host, see readHostNQN.
+var hostCommands = map[string]struct{}{"nvme": {}, "udevadm": {}, "cat": {}}
+
+// ParseCommandPrefix splits the -command-prefix value into the arguments put
+// before host commands, e.g. "nsenter --target 1 --mount --net --". The
+// program must be found in the container, its arguments are passed as is,
+// no shell is involved.
+func ParseCommandPrefix(value string) ([]string, error) {
+	prefix := strings.Fields(value)
+	if len(prefix) == 0 {
+		return nil, nil
+	}
+	if _, err := exec.LookPath(prefix[0]); err != nil {
+		return nil, fmt.Errorf("command prefix %q: %w", value, err)
+	}
+	return prefix, nil
+}
+
+// hostCommand returns cmdLine behind the command prefix if it runs host
+// tooling, as is otherwise
+func hostCommand(cmdLine []string) []string {
+	if len(initiatorConf.commandPrefix) == 0 {
+		return cmdLine
+	}
+	if _, ok := hostCommands[cmdLine[0]]; !ok {
+		return cmdLine
+	}
+	return append(append([]string{}, initiatorConf.commandPrefix...), cmdLine...)
+}
@@ -17,23 +17,106 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"sync"
 )
 
+// KeyMutex is a set of mutexes identified by arbitrary string keys, a key
+// only takes memory while its lock is held or waited for
+type KeyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	// the lock is held while ch is full
+	ch chan struct{}
+	// holder and waiters, the key is removed when it drops to 0
+	refs int
+}
+
+// NewKeyMutex returns new KeyMutex.
+func NewKeyMutex() *KeyMutex {
+	return &KeyMutex{locks: make(map[string]*keyLock)}
+}
+
+func (km *KeyMutex) acquire(key string) *keyLock {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyLock{ch: make(chan struct{}, 1)}
+		km.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (km *KeyMutex) release(key string, l *keyLock) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(km.locks, key)
+	}
+}
+
+// Lock obtain the lock corresponding to the key, call the returned func to release it
+func (km *KeyMutex) Lock(key string) func() {
+	l := km.acquire(key)
+	l.ch <- struct{}{}
+	return func() {
+		<-l.ch
+		km.release(key, l)
+	}
+}
+
+// LockNoWait is Lock failing right away when the lock is held
+func (km *KeyMutex) LockNoWait(key string) (func(), bool) {
+	l := km.acquire(key)
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			km.release(key, l)
+		}, true
+	default:
+		km.release(key, l)
+		return nil, false
+	}
+}
+
+// TryLock is Lock giving up with ctx.Err() when ctx is done before the lock is obtained
+func (km *KeyMutex) TryLock(ctx context.Context, key string) (func(), error) {
+	l := km.acquire(key)
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			km.release(key, l)
+		}, nil
+	case <-ctx.Done():
+		km.release(key, l)
+		return nil, ctx.Err()
+	}
+}
+
 // VolumeLocks simple locks that can be acquired by volumeID
 type VolumeLocks struct {
-	mutexes sync.Map
+	keys *KeyMutex
 }
 
 // NewVolumeLocks returns new VolumeLocks.
 func NewVolumeLocks() *VolumeLocks {
-	return &VolumeLocks{}
+	return &VolumeLocks{keys: NewKeyMutex()}
 }
 
 // Lock obtain the lock corresponding to the volumeID
 func (vl *VolumeLocks) Lock(volumeID string) func() {
-	value, _ := vl.mutexes.LoadOrStore(volumeID, &sync.Mutex{})
-	mtx, _ := value.(*sync.Mutex) //nolint:errcheck // will not fail to convert
-	mtx.Lock()
-	return func() { mtx.Unlock() }
+	return vl.keys.Lock(volumeID)
+}
+
+// TryAcquire obtains the lock of volumeID if no other operation holds it
+func (vl *VolumeLocks) TryAcquire(volumeID string) (func(), bool) {
+	return vl.keys.LockNoWait(volumeID)
 }
@@ -0,0 +1,129 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// lockedKeys returns how many keys km holds memory for
+func lockedKeys(km *KeyMutex) int {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	return len(km.locks)
+}
+
+func TestKeyMutexExclusive(t *testing.T) {
+	const goroutines, rounds = 50, 100
+	km := NewKeyMutex()
+	keys := []string{"nqn.2016-06.io.spdk:cnode1", "nqn.2016-06.io.spdk:cnode2", "nqn.2016-06.io.spdk:cnode3"}
+	// only written with the lock of the key held, a second holder is a race
+	counts := make(map[string]*int, len(keys))
+	for _, key := range keys {
+		counts[key] = new(int)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				key := keys[(g+r)%len(keys)]
+				unlock := km.Lock(key)
+				*counts[key]++
+				unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, count := range counts {
+		total += *count
+	}
+	if total != goroutines*rounds {
+		t.Errorf("%d locked increments, want %d", total, goroutines*rounds)
+	}
+	if n := lockedKeys(km); n != 0 {
+		t.Errorf("%d keys left after every lock was released", n)
+	}
+}
+
+func TestKeyMutexReleasesFailedLocks(t *testing.T) {
+	km := NewKeyMutex()
+	unlock := km.Lock("vol-1")
+	if _, ok := km.LockNoWait("vol-1"); ok {
+		t.Fatal("LockNoWait obtained a held lock")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := km.TryLock(ctx, "vol-1"); err == nil {
+		t.Fatal("TryLock obtained a held lock")
+	}
+	unlock()
+	if n := lockedKeys(km); n != 0 {
+		t.Errorf("%d keys left after the failed locks", n)
+	}
+	unlock, ok := km.LockNoWait("vol-1")
+	if !ok {
+		t.Fatal("LockNoWait failed on a released lock")
+	}
+	unlock()
+	if n := lockedKeys(km); n != 0 {
+		t.Errorf("%d keys left after every lock was released", n)
+	}
+}
+
+// TestKeyMutexDistinctKeys locks thousands of distinct keys concurrently,
+// as many volumes staged at once do, and checks none is leaked. Run with -race.
+func TestKeyMutexDistinctKeys(t *testing.T) {
+	const keys, lockers = 5000, 4
+	km := NewKeyMutex()
+	var wg sync.WaitGroup
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("vol-%d", i)
+		for l := 0; l < lockers; l++ {
+			wg.Add(1)
+			go func(l int) {
+				defer wg.Done()
+				switch l % 3 {
+				case 0:
+					unlock := km.Lock(key)
+					unlock()
+				case 1:
+					if unlock, ok := km.LockNoWait(key); ok {
+						unlock()
+					}
+				default:
+					unlock, err := km.TryLock(context.Background(), key)
+					if err != nil {
+						t.Errorf("TryLock %s: %v", key, err)
+						return
+					}
+					unlock()
+				}
+			}(l)
+		}
+	}
+	wg.Wait()
+	if n := lockedKeys(km); n != 0 {
+		t.Errorf("%d of %d keys left after every lock was released", n, keys)
+	}
+}
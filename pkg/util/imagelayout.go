@@ -0,0 +1,91 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// StorageClass parameters of the RBD image layout, in bytes but stripeCount
+const (
+	objectSizeKey  = "objectSize"
+	stripeUnitKey  = "stripeUnit"
+	stripeCountKey = "stripeCount"
+)
+
+// RBD objects are a power of two from 4KiB (order 12) to 32MiB (order 25)
+const (
+	minObjectSize = 4 << 10
+	maxObjectSize = 32 << 20
+)
+
+// DefaultObjectSize is the object size of images created with the Ceph
+// defaults, rbd_default_order 22
+const DefaultObjectSize = 4 << 20
+
+// ImageLayout is how an RBD image spreads its data over objects: StripeCount
+// objects take StripeUnit bytes in turn until ObjectSize bytes each are
+// written. Without striping the unit is the object size and the count 1.
+type ImageLayout struct {
+	ObjectSize  uint64
+	StripeUnit  uint64
+	StripeCount uint64
+}
+
+// IsDefault tells whether the layout is the one of images created with the
+// Ceph defaults, 4MiB objects without striping
+func (l ImageLayout) IsDefault() bool {
+	return l == ImageLayout{ObjectSize: DefaultObjectSize, StripeUnit: DefaultObjectSize, StripeCount: 1}
+}
+
+// ParseImageLayout reads the objectSize, stripeUnit and stripeCount
+// parameters, checked the way librbd checks them at image creation:
+//   - objectSize is a power of two from 4KiB to 32MiB, 4MiB when unset
+//   - stripeUnit and stripeCount are set both or neither, without striping
+//     when neither is
+//   - stripeUnit divides objectSize, so it's at most objectSize
+//   - stripeCount is at least 1
+func ParseImageLayout(params map[string]string) (ImageLayout, error) {
+	layout := ImageLayout{ObjectSize: DefaultObjectSize, StripeCount: 1}
+	var err error
+	if value, ok := params[objectSizeKey]; ok {
+		layout.ObjectSize, err = strconv.ParseUint(value, 10, 64)
+		if err != nil || layout.ObjectSize < minObjectSize || layout.ObjectSize > maxObjectSize || layout.ObjectSize&(layout.ObjectSize-1) != 0 {
+			return ImageLayout{}, fmt.Errorf("invalid %s %q, expected a power of two from %d to %d bytes", objectSizeKey, value, minObjectSize, maxObjectSize)
+		}
+	}
+	layout.StripeUnit = layout.ObjectSize
+
+	unit, hasUnit := params[stripeUnitKey]
+	count, hasCount := params[stripeCountKey]
+	if hasUnit != hasCount {
+		return ImageLayout{}, fmt.Errorf("%s and %s must be set together", stripeUnitKey, stripeCountKey)
+	}
+	if !hasUnit {
+		return layout, nil
+	}
+	layout.StripeUnit, err = strconv.ParseUint(unit, 10, 64)
+	if err != nil || layout.StripeUnit == 0 || layout.ObjectSize%layout.StripeUnit != 0 {
+		return ImageLayout{}, fmt.Errorf("invalid %s %q, expected bytes dividing the %s of %d", stripeUnitKey, unit, objectSizeKey, layout.ObjectSize)
+	}
+	layout.StripeCount, err = strconv.ParseUint(count, 10, 64)
+	if err != nil || layout.StripeCount == 0 {
+		return ImageLayout{}, fmt.Errorf("invalid %s %q, expected at least 1", stripeCountKey, count)
+	}
+	return layout, nil
+}
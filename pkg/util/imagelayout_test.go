@@ -0,0 +1,66 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseImageLayout(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   ImageLayout
+		valid  bool
+	}{
+		{"unset", nil, ImageLayout{4 << 20, 4 << 20, 1}, true},
+		{"smallest object", map[string]string{objectSizeKey: "4096"}, ImageLayout{4096, 4096, 1}, true},
+		{"object below 4KiB", map[string]string{objectSizeKey: "2048"}, ImageLayout{}, false},
+		{"largest object", map[string]string{objectSizeKey: "33554432"}, ImageLayout{32 << 20, 32 << 20, 1}, true},
+		{"object above 32MiB", map[string]string{objectSizeKey: "67108864"}, ImageLayout{}, false},
+		{"object not a power of two", map[string]string{objectSizeKey: "3145728"}, ImageLayout{}, false},
+		{"object of 0", map[string]string{objectSizeKey: "0"}, ImageLayout{}, false},
+		{"negative object", map[string]string{objectSizeKey: "-4096"}, ImageLayout{}, false},
+		{"object with unit", map[string]string{objectSizeKey: "4Mi"}, ImageLayout{}, false},
+		{"striped", map[string]string{stripeUnitKey: "65536", stripeCountKey: "16"}, ImageLayout{4 << 20, 64 << 10, 16}, true},
+		{"unit of the object size", map[string]string{objectSizeKey: "8388608", stripeUnitKey: "8388608", stripeCountKey: "4"}, ImageLayout{8 << 20, 8 << 20, 4}, true},
+		{"unit of 1 byte", map[string]string{objectSizeKey: "4096", stripeUnitKey: "1", stripeCountKey: "1"}, ImageLayout{4096, 1, 1}, true},
+		{"unit above the object size", map[string]string{objectSizeKey: "4096", stripeUnitKey: "8192", stripeCountKey: "2"}, ImageLayout{}, false},
+		{"unit not dividing the object size", map[string]string{stripeUnitKey: "3000", stripeCountKey: "2"}, ImageLayout{}, false},
+		{"unit of 0", map[string]string{stripeUnitKey: "0", stripeCountKey: "2"}, ImageLayout{}, false},
+		{"count of 0", map[string]string{stripeUnitKey: "65536", stripeCountKey: "0"}, ImageLayout{}, false},
+		{"negative count", map[string]string{stripeUnitKey: "65536", stripeCountKey: "-1"}, ImageLayout{}, false},
+		{"unit without count", map[string]string{stripeUnitKey: "65536"}, ImageLayout{}, false},
+		{"count without unit", map[string]string{stripeCountKey: "4"}, ImageLayout{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseImageLayout(tt.params)
+			if tt.valid != (err == nil) {
+				t.Fatalf("ParseImageLayout(%v) error %v, want valid %v", tt.params, err, tt.valid)
+			}
+			if got != tt.want {
+				t.Errorf("ParseImageLayout(%v) = %+v, want %+v", tt.params, got, tt.want)
+			}
+		})
+	}
+
+	layout, _ := ParseImageLayout(map[string]string{objectSizeKey: "4194304", stripeUnitKey: "4194304", stripeCountKey: "1"})
+	if !layout.IsDefault() {
+		t.Errorf("layout %+v set to the Ceph defaults isn't the default", layout)
+	}
+}
@@ -20,8 +20,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -32,124 +36,734 @@ import (
 //   - Connect initiates target connection and returns local block device filename
 //     e.g., /dev/disk/by-id/nvme-SPDK_Controller1_SPDK00000000000001
 //   - Disconnect terminates target connection
+//   - Reconnect forces a Disconnect/Connect cycle and returns the new local block device filename
 //   - Caller(node service) should serialize calls to same initiator
 //   - Implementation should be idempotent to duplicated requests
+//   - Waiting for the device stops as soon as ctx is done
 type NvmeofCsiInitiator interface {
-	Connect() (string, error)
-	Disconnect() error
+	Connect(ctx context.Context) (string, error)
+	Disconnect(ctx context.Context) error
+	Reconnect(ctx context.Context) (string, error)
 }
 
-func NewNvmeofCsiInitiator(publishContext map[string]string) (NvmeofCsiInitiator, error) {
+// initiator settings from the command line, see SetInitiatorConfig
+var initiatorConf struct {
+	udevSettleTimeout    time.Duration
+	disconnectStableTime time.Duration
+	disconnectCheckDelay time.Duration
+	deviceResolver       string
+	// accept local devices, see localDeviceKey
+	allowLocalDevice bool
+	// bytes of command output logged, see truncateOutput
+	maxLoggedOutput int
+	// put before host commands, see hostCommand
+	commandPrefix []string
+	// option names extraConnectArgs may use, see ParseExtraConnectArgs
+	extraConnectArgsAllowlist map[string]struct{}
+	// connect parameters per transport, see withTransportDefaults
+	transportDefaults map[string]map[string]string
+}
+
+// SetInitiatorConfig applies the initiator settings of the parsed config, it
+// must be called before any initiator is used
+func SetInitiatorConfig(conf *Config) {
+	initiatorConf.udevSettleTimeout = conf.UdevSettleTimeout
+	initiatorConf.disconnectStableTime = conf.DisconnectStableTime
+	initiatorConf.disconnectCheckDelay = conf.DisconnectCheckDelay
+	initiatorConf.deviceResolver = conf.DeviceResolver
+	initiatorConf.allowLocalDevice = conf.AllowLocalDevice
+	initiatorConf.maxLoggedOutput = conf.MaxLoggedOutput
+	initiatorConf.commandPrefix = conf.CommandPrefix
+	initiatorConf.transportDefaults = conf.TransportDefaults
+	setExtraConnectArgsAllowlist(conf.ExtraConnectArgsAllowlist)
+}
+
+const (
+	transportFC   = "fc"
+	transportTCP  = "tcp"
+	transportRDMA = "rdma"
+)
+
+// StorageClass parameters, passed on in the publish context, enabling NVMe/TCP PDU digests
+const (
+	hdrDigestKey  = "hdrDigest"
+	dataDigestKey = "dataDigest"
+)
+
+// StorageClass parameters, passed on in the publish context, of the discovery
+// controller to find the target with, instead of traddr and trsvcid
+const (
+	discoveryTraddrKey  = "discovery_traddr"
+	discoveryTrsvcidKey = "discovery_trsvcid"
+	// NVMe-oF discovery service port, used when discovery_trsvcid isn't set
+	defaultDiscoveryPort = "8009"
+)
+
+// StorageClass parameter, passed on in the publish context, setting the
+// number of poll queues of the controller, nvme connect -P
+const nrPollQueuesKey = "nrPollQueues"
+
+// Secrets of NodeStageVolume used by the initiator, they come from a Kubernetes
+// Secret and must never be persisted with the publish context
+const (
+	dhchapSecretKey     = "dhchapSecret"     // host DH-HMAC-CHAP key, nvme connect -S
+	dhchapCtrlSecretKey = "dhchapCtrlSecret" // controller key for bidirectional auth, nvme connect -C
+)
+
+// options of nvme connect whose value is a secret, hidden from logs and errors
+var secretOptions = map[string]struct{}{"-S": {}, "-C": {}}
+
+// redactCmdLine returns cmdLine with the values of secret options masked
+func redactCmdLine(cmdLine []string) []string {
+	redacted := make([]string, len(cmdLine))
+	copy(redacted, cmdLine)
+	for i := 1; i < len(redacted); i++ {
+		if _, ok := secretOptions[redacted[i-1]]; ok {
+			redacted[i] = "***"
+		}
+	}
+	return redacted
+}
+
+// HasAuthSecrets tells if secrets enable DH-HMAC-CHAP or hold a TLS key
+func HasAuthSecrets(secrets map[string]string) bool {
+	return secrets[dhchapSecretKey] != "" || secrets[tlsSecretKey] != ""
+}
+
+// ParseDigests reads the NVMe/TCP digest parameters, they're rejected for other transports
+func ParseDigests(params map[string]string) (hdrDigest, dataDigest bool, err error) {
+	if hdrDigest, err = parseBoolParameter(params, hdrDigestKey); err != nil {
+		return false, false, err
+	}
+	if dataDigest, err = parseBoolParameter(params, dataDigestKey); err != nil {
+		return false, false, err
+	}
+	if transport := strings.ToLower(params["transport"]); (hdrDigest || dataDigest) && transport != transportTCP {
+		return false, false, fmt.Errorf("%s and %s are only supported by the tcp transport, not %q",
+			hdrDigestKey, dataDigestKey, transport)
+	}
+	return hdrDigest, dataDigest, nil
+}
+
+// ParseNrPollQueues reads the poll queues parameter, 0 when unset. Poll
+// queues are only supported by the tcp and rdma transports.
+func ParseNrPollQueues(params map[string]string) (int, error) {
+	value, ok := params[nrPollQueuesKey]
+	if !ok {
+		return 0, nil
+	}
+	queues, err := strconv.Atoi(value)
+	if err != nil || queues < 0 {
+		return 0, fmt.Errorf("invalid %s %q, expected a non-negative integer", nrPollQueuesKey, value)
+	}
+	if transport := strings.ToLower(params["transport"]); queues > 0 && transport != transportTCP && transport != transportRDMA {
+		return 0, fmt.Errorf("%s is only supported by the tcp and rdma transports, not %q", nrPollQueuesKey, transport)
+	}
+	return queues, nil
+}
+
+// ConnectPublishContext returns the connect tuning parameters set in params,
+// digests, poll queues, controller loss timeout, connect mode, minimum paths,
+// extra arguments and the preferred port, to pass on to the node
+func ConnectPublishContext(params map[string]string) map[string]string {
+	connectParams := map[string]string{}
+	for _, key := range []string{hdrDigestKey, dataDigestKey, nrPollQueuesKey, ctrlLossTmoKey, connectModeKey, tlsKey, minPathsKey, extraConnectArgsKey, preferredTraddrKey} {
+		if value, ok := params[key]; ok {
+			connectParams[key] = value
+		}
+	}
+	return connectParams
+}
+
+// FC addresses are the WWNN and WWPN of the port, e.g. nn-0x20000090fa942779:pn-0x10000090fa942779
+var fcAddrRe = regexp.MustCompile(`^nn-0x[0-9a-fA-F]{16}:pn-0x[0-9a-fA-F]{16}$`)
+
+// NQNs are nqn.yyyy-mm.<reverse domain>[:<name>], the NVMe base spec limits them to 223 bytes
+var nqnRe = regexp.MustCompile(`^nqn\.[0-9]{4}-(0[1-9]|1[0-2])\.[a-zA-Z0-9][a-zA-Z0-9.-]*[a-zA-Z0-9](:.+)?$`)
+
+const maxNQNLength = 223
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// DNS names, for targets given by host name rather than IP
+var hostnameRe = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validatePublishContext checks the connection fields are well formed, so a
+// bad StorageClass or gateway reply is reported instead of failing in nvme-cli.
+// The target is either given by traddr, or found through a discovery controller.
+func validatePublishContext(publishContext map[string]string) error {
+	transport := strings.ToLower(publishContext["transport"])
+	discoveryAddr := publishContext[discoveryTraddrKey]
+	if transport == "" || publishContext["nqn"] == "" || publishContext["uuid"] == "" ||
+		(publishContext["traddr"] == "" && discoveryAddr == "") {
+		return fmt.Errorf("%w: missing required fields: %v", ErrInvalidPublishContext, publishContext)
+	}
+	if nqn := publishContext["nqn"]; len(nqn) > maxNQNLength || !nqnRe.MatchString(nqn) {
+		return fmt.Errorf("%w: invalid nqn %q, expected nqn.yyyy-mm.<reverse domain>[:<name>] of at most %d bytes",
+			ErrInvalidPublishContext, nqn, maxNQNLength)
+	}
+	if uuid := publishContext["uuid"]; !uuidRe.MatchString(uuid) {
+		return fmt.Errorf("%w: invalid uuid %q", ErrInvalidPublishContext, uuid)
+	}
+	if transport == transportFC {
+		if discoveryAddr != "" {
+			return fmt.Errorf("%w: %s isn't supported by the fc transport", ErrInvalidPublishContext, discoveryTraddrKey)
+		}
+		if !fcAddrRe.MatchString(publishContext["traddr"]) {
+			return fmt.Errorf("%w: invalid FC traddr %q, expected nn-0x<WWNN>:pn-0x<WWPN>", ErrInvalidPublishContext, publishContext["traddr"])
+		}
+		if hostAddr := publishContext["host_traddr"]; hostAddr != "" && !fcAddrRe.MatchString(hostAddr) {
+			return fmt.Errorf("%w: invalid FC host_traddr %q, expected nn-0x<WWNN>:pn-0x<WWPN>", ErrInvalidPublishContext, hostAddr)
+		}
+		return nil
+	}
+	if discoveryAddr != "" {
+		if publishContext["traddr"] != "" {
+			return fmt.Errorf("%w: set either traddr or %s, not both", ErrInvalidPublishContext, discoveryTraddrKey)
+		}
+		if err := validateAddress(discoveryTraddrKey, discoveryAddr); err != nil {
+			return err
+		}
+		if port := publishContext[discoveryTrsvcidKey]; port != "" {
+			if err := validatePort(discoveryTrsvcidKey, port); err != nil {
+				return err
+			}
+		}
+	} else {
+		// FC has no service id, the port is part of traddr
+		if publishContext["trsvcid"] == "" {
+			return fmt.Errorf("%w: missing required fields: %v", ErrInvalidPublishContext, publishContext)
+		}
+		if err := validateAddress("traddr", publishContext["traddr"]); err != nil {
+			return err
+		}
+		if err := validatePort("trsvcid", publishContext["trsvcid"]); err != nil {
+			return err
+		}
+	}
+	if hostAddr := publishContext["host_traddr"]; hostAddr != "" && net.ParseIP(hostAddr) == nil {
+		// the local address the connection is made from, to pin it to a NIC
+		return fmt.Errorf("%w: invalid host_traddr %q, expected an IP address", ErrInvalidPublishContext, hostAddr)
+	}
+	return nil
+}
+
+func validateAddress(key, addr string) error {
+	if net.ParseIP(addr) == nil && !hostnameRe.MatchString(addr) {
+		return fmt.Errorf("%w: invalid %s %q, expected an IP address or host name", ErrInvalidPublishContext, key, addr)
+	}
+	return nil
+}
+
+func validatePort(key, port string) error {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("%w: invalid %s %q, expected a port number", ErrInvalidPublishContext, key, port)
+	}
+	return nil
+}
+
+// NewNvmeofCsiInitiator returns the initiator of the target described by
+// publishContext, secrets holds the optional DH-HMAC-CHAP keys. The commands
+// it runs are logged tagged with volumeID and the NQN.
+func NewNvmeofCsiInitiator(volumeID string, publishContext, secrets map[string]string) (NvmeofCsiInitiator, error) {
 	if publishContext == nil {
-		return nil, fmt.Errorf("publishContext is nil")
+		return nil, fmt.Errorf("%w: publishContext is nil", ErrInvalidPublishContext)
+	}
+	if IsLocalDevice(publishContext) {
+		return newLocalInitiator(volumeID, publishContext)
+	}
+	if err := validatePublishContext(publishContext); err != nil {
+		return nil, err
+	}
+	publishContext = withTransportDefaults(publishContext)
+	hdrDigest, dataDigest, err := ParseDigests(publishContext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublishContext, err)
+	}
+	nrPollQueues, err := ParseNrPollQueues(publishContext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublishContext, err)
+	}
+	useConfig, tls, err := ParseConnectMode(publishContext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublishContext, err)
+	}
+	ctrlLossTmo, err := ParseCtrlLossTmo(publishContext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublishContext, err)
+	}
+	minPaths, err := ParseMinPaths(publishContext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublishContext, err)
+	}
+	// checked again against the allowlist of this node
+	extraArgs, err := ParseExtraConnectArgs(publishContext)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPublishContext, err)
 	}
-	if publishContext["transport"] == "" || publishContext["traddr"] == "" ||
-		publishContext["trsvcid"] == "" || publishContext["nqn"] == "" || publishContext["uuid"] == "" {
-		return nil, fmt.Errorf("publishContext missing required fields: %v", publishContext)
+	preferredAddr, err := ParsePreferredTraddr(publishContext)
+	if err != nil {
+		return nil, err
+	}
+	nsid, err := ParseNsid(publishContext)
+	if err != nil {
+		return nil, err
 	}
 	return &initiatorNVMf{
 		// see util/nvmf.go VolumeInfo()
-		targetType: publishContext["transport"],
-		targetAddr: publishContext["traddr"],
-		targetPort: publishContext["trsvcid"],
-		nqn:        publishContext["nqn"],
-		uuid:       publishContext["uuid"],
+		volumeID:      volumeID,
+		targetType:    publishContext["transport"],
+		targetAddr:    publishContext["traddr"],
+		targetPort:    publishContext["trsvcid"],
+		hostAddr:      publishContext["host_traddr"],
+		nqn:           publishContext["nqn"],
+		uuid:          publishContext["uuid"],
+		nsid:          nsid,
+		hdrDigest:     hdrDigest,
+		dataDigest:    dataDigest,
+		pollQueues:    nrPollQueues,
+		ctrlLossTmo:   ctrlLossTmo,
+		minPaths:      minPaths,
+		extraArgs:     extraArgs,
+		preferredAddr: preferredAddr,
+		discoveryAddr: publishContext[discoveryTraddrKey],
+		discoveryPort: publishContext[discoveryTrsvcidKey],
+		useConfig:     useConfig,
+		tls:           tls,
+		// only kept by this short lived initiator, callers don't store secrets
+		dhchapSecret:     secrets[dhchapSecretKey],
+		dhchapCtrlSecret: secrets[dhchapCtrlSecretKey],
+		tlsKey:           secrets[tlsSecretKey],
 	}, nil
 }
 
 // NVMf initiator implementation
 type initiatorNVMf struct {
+	volumeID   string // only tags the logs
 	targetType string
 	targetAddr string
 	targetPort string
+	hostAddr   string
 	nqn        string
 	uuid       string
+	// the device must also have this namespace ID when set, see NsidKey
+	nsid       uint32
+	hdrDigest  bool
+	dataDigest bool
+	pollQueues int
+	// seconds a lost controller is reconnected, nvme connect -l
+	ctrlLossTmo int
+	minPaths    int      // paths a connect must leave connected
+	extraArgs   []string // allowlisted options of extraConnectArgs
+	// port of the subsystem used first, see preferredTraddrKey
+	preferredAddr string
+	// discovery controller the target is looked up from, targetAddr and
+	// targetPort are unset until Connect resolves them
+	discoveryAddr string
+	discoveryPort string
+	// connect from a generated nvme-cli config rather than options, see writeConnectConfig
+	useConfig bool
+	tls       bool
+
+	dhchapSecret     string
+	dhchapCtrlSecret string
+	tlsKey           string
 }
 
-func (nvmf *initiatorNVMf) Connect() (string, error) {
+// connectCmdLine builds the nvme connect-all command line for the target, or
+// the nvme connect one of the subsystem once found by discovery
+func (nvmf *initiatorNVMf) connectCmdLine() []string {
 	cmdLine := []string{
 		"nvme", "connect-all", "-t", strings.ToLower(nvmf.targetType),
-		"-a", nvmf.targetAddr, "-q", nvmf.nqn, "-l", "1800",
+		"-a", nvmf.targetAddr, "-q", nvmf.nqn, "-l", strconv.Itoa(nvmf.ctrlLossTmo),
+	}
+	if nvmf.discoveryAddr != "" {
+		cmdLine = []string{
+			"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
+			"-a", nvmf.targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn, "-l", strconv.Itoa(nvmf.ctrlLossTmo),
+		}
+	}
+	if nvmf.hostAddr != "" {
+		cmdLine = append(cmdLine, "-w", nvmf.hostAddr)
+	}
+	// short options, the long ones changed spelling across nvme-cli versions
+	if nvmf.hdrDigest {
+		cmdLine = append(cmdLine, "-g")
+	}
+	if nvmf.dataDigest {
+		cmdLine = append(cmdLine, "-G")
 	}
-	output, err := execWithTimeout(cmdLine, 40)
+	if nvmf.pollQueues > 0 {
+		cmdLine = append(cmdLine, "-P", strconv.Itoa(nvmf.pollQueues))
+	}
+	if nvmf.dhchapSecret != "" {
+		cmdLine = append(cmdLine, "-S", nvmf.dhchapSecret)
+	}
+	if nvmf.dhchapCtrlSecret != "" {
+		cmdLine = append(cmdLine, "-C", nvmf.dhchapCtrlSecret)
+	}
+	return append(cmdLine, nvmf.extraArgs...)
+}
 
+// logContext returns ctx tagging the commands run for this initiator
+func (nvmf *initiatorNVMf) logContext(ctx context.Context) context.Context {
+	tags := fmt.Sprintf("volume %s nqn %s", nvmf.volumeID, nvmf.nqn)
+	// e.g. the pvc set by WithK8sObjects
+	if outer, ok := ctx.Value(logTagsKey{}).(string); ok && outer != "" {
+		tags = outer + " " + tags
+	}
+	return withLogTags(ctx, tags)
+}
+
+func (nvmf *initiatorNVMf) Connect(ctx context.Context) (string, error) {
+	ctx = nvmf.logContext(ctx)
+	if nvmf.hostAddr != "" && !strings.EqualFold(nvmf.targetType, transportFC) && !isLocalAddress(nvmf.hostAddr) {
+		klog.Warningf("host_traddr %s isn't an address of this node, nvme connect to %s will likely fail", nvmf.hostAddr, nvmf.nqn)
+	}
+	if nvmf.discoveryAddr != "" {
+		if err := nvmf.discoverTarget(ctx); err != nil {
+			return "", err
+		}
+	}
+	cmdLine := nvmf.connectCmdLine()
+	if nvmf.useConfig {
+		configPath, err := nvmf.writeConnectConfig(ctx)
+		if err != nil {
+			return "", err
+		}
+		defer removeConnectConfig(configPath)
+		cmdLine = []string{"nvme", "connect-all", "--config", configPath}
+	}
+	if len(nvmf.extraArgs) > 0 {
+		// logged for auditing, the arguments come from the StorageClass
+		klog.Infof("connecting to %s with extra connect args: %v", nvmf.nqn, redactCmdLine(cmdLine))
+	}
+	output, err := execWithTimeout(ctx, cmdLine, 40)
+
+	// the device may show up anyway, the connect error explains why it didn't
+	var connectErr error
 	if err != nil {
-		if strings.Contains(output, "already connected") {
+		result := parseConnectOutput(output)
+		switch {
+		case result.alreadyConnected > 0 && len(result.devices) == 0 && len(result.failures) == 0:
 			klog.Warningf("nvme connect: already connected to volume %s, continuing", nvmf.nqn)
-		} else {
-			klog.Errorf("command %v failed: %s", cmdLine, err)
-
+		case result.paths() > 0:
+			klog.Warningf("nvme connect to %s partially failed, %d paths connected, %d failed, continuing: %s",
+				nvmf.nqn, result.paths(), len(result.failures), strings.Join(result.failures, "; "))
+		case strings.EqualFold(nvmf.targetType, transportFC):
+			// the FC fabric may have connected the controller on its own, go on resolving the device
+			klog.Warningf("nvme connect over fc to %s failed, trying to resolve the device anyway: %s", nvmf.nqn, err)
+		default:
+			connectErr = classifyNvmeError(cmdLine, output, err)
+			klog.Errorf("%v", connectErr)
+		}
+	}
+	if connectErr == nil && nvmf.minPaths > 1 {
+		if err := nvmf.checkPaths(); err != nil {
+			return "", err
 		}
 	}
 
-	deviceGlob := fmt.Sprintf("/dev/disk/by-id/nvme-uuid.*%s*", nvmf.uuid)
-	devicePath, err := waitForDeviceReady(deviceGlob, 20)
+	if initiatorConf.udevSettleTimeout > 0 {
+		udevSettle(ctx, initiatorConf.udevSettleTimeout)
+	}
+	var devicePath string
+	if initiatorConf.deviceResolver == DeviceResolverNvmeList {
+		devicePath, err = waitForDeviceByUUID(ctx, nvmf.uuid, nvmf.nsid, 20)
+	} else {
+		deviceGlob := fmt.Sprintf("/dev/disk/by-id/nvme-uuid.*%s*", nvmf.uuid)
+		devicePath, err = waitForNamespaceDevice(ctx, deviceGlob, nvmf.nsid, 20)
+		if err == nil && nvmf.preferredAddr != "" {
+			devicePath = preferDevice(deviceGlob, nvmf.preferredAddr, devicePath)
+		}
+	}
 	if err != nil {
+		if connectErr != nil {
+			return "", connectErr
+		}
 		return "", err
 	}
-	return devicePath, nil
+	return selectMultipathHead(devicePath), nil
+}
+
+// checkPaths fails when the subsystem has fewer controllers than minPaths
+func (nvmf *initiatorNVMf) checkPaths() error {
+	states, err := ControllerStates(nvmf.nqn)
+	if err != nil {
+		return fmt.Errorf("failed to read the controllers of %s: %w", nvmf.nqn, err)
+	}
+	if len(states) < nvmf.minPaths {
+		return fmt.Errorf("%w: %d of the %d required paths of %s connected", ErrNoPath, len(states), nvmf.minPaths, nvmf.nqn)
+	}
+	return nil
 }
 
-func (nvmf *initiatorNVMf) Disconnect() error {
+func (nvmf *initiatorNVMf) Disconnect(ctx context.Context) error {
+	ctx = nvmf.logContext(ctx)
 	// nvme disconnect -n "nqn"
 	cmdLine := []string{"nvme", "disconnect", "-n", nvmf.nqn}
-	_, err := execWithTimeout(cmdLine, 40)
+	if nvmf.useConfig {
+		// left behind if the node server died during connect
+		removeConnectConfig(nvmf.connectConfigPath())
+	}
+	output, err := execWithTimeout(ctx, cmdLine, 40)
 	if err != nil {
 		// go on checking device status in case caused by duplicate request
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+		klog.Errorf("%v", classifyNvmeError(cmdLine, output, err))
 	}
 
 	deviceGlob := fmt.Sprintf("/dev/disk/by-id/nvme-uuid.*%s*", nvmf.uuid)
-	return waitForDeviceGone(deviceGlob)
+	if delay := initiatorConf.disconnectCheckDelay; delay > 0 {
+		// checks right after the disconnect find the device still there
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting device gone: %s: %w", deviceGlob, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	return waitForDeviceGone(ctx, deviceGlob, nvmf.nqn, initiatorConf.disconnectStableTime)
+}
+
+// Reconnect disconnects the whole subsystem and connects it again, every
+// namespace of the subsystem loses its controllers meanwhile. The caller
+// makes sure no other namespace of the subsystem is in use.
+func (nvmf *initiatorNVMf) Reconnect(ctx context.Context) (string, error) {
+	// a failed disconnect is not fatal, the controller may already be gone
+	if err := nvmf.Disconnect(ctx); err != nil {
+		klog.Warningf("reconnect: disconnect from %s failed, continuing: %v", nvmf.nqn, err)
+	}
+	return nvmf.Connect(ctx)
+}
+
+// ConnectedSubsystems returns the NQNs of the subsystems this host currently has a controller for
+func ConnectedSubsystems() (map[string]struct{}, error) {
+	nqnFiles, err := filepath.Glob("/sys/class/nvme/nvme*/subsysnqn")
+	if err != nil {
+		return nil, err
+	}
+	nqns := make(map[string]struct{}, len(nqnFiles))
+	for _, nqnFile := range nqnFiles {
+		data, err := os.ReadFile(nqnFile) // #nosec - sysfs path from a fixed glob
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) { // controller went away
+				continue
+			}
+			return nil, err
+		}
+		nqns[strings.TrimSpace(string(data))] = struct{}{}
+	}
+	return nqns, nil
+}
+
+// udevSettle waits for udev to process the events of a connect, so the device
+// links aren't used before the device is ready. Failures are only logged.
+func udevSettle(ctx context.Context, timeout time.Duration) {
+	// behind a command prefix udevadm runs on the host
+	if _, err := exec.LookPath("udevadm"); err != nil && len(initiatorConf.commandPrefix) == 0 {
+		klog.Warningf("udevadm not found, not waiting for udev to settle: %v", err)
+		return
+	}
+	seconds := int(timeout.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	cmdLine := []string{"udevadm", "settle", fmt.Sprintf("--timeout=%d", seconds)}
+	// udevadm gives up on its own first
+	if output, err := execWithTimeout(ctx, cmdLine, seconds+5); err != nil {
+		klog.Warningf("command %v failed, resolving the device anyway: %v: %s", cmdLine, err, truncateOutput(strings.TrimSpace(output)))
+	}
+}
+
+// ControllerStates returns the state, e.g. live or connecting, of each
+// controller this host has for the subsystem nqn
+func ControllerStates(nqn string) ([]string, error) {
+	nqnFiles, err := filepath.Glob("/sys/class/nvme/nvme*/subsysnqn")
+	if err != nil {
+		return nil, err
+	}
+	var states []string
+	for _, nqnFile := range nqnFiles {
+		data, err := os.ReadFile(nqnFile) // #nosec - sysfs path from a fixed glob
+		if err != nil {
+			continue // controller went away
+		}
+		if strings.TrimSpace(string(data)) != nqn {
+			continue
+		}
+		state, err := os.ReadFile(filepath.Join(filepath.Dir(nqnFile), "state")) // #nosec - sysfs path from a fixed glob
+		if err != nil {
+			continue
+		}
+		states = append(states, strings.TrimSpace(string(state)))
+	}
+	return states, nil
+}
+
+// CountControllerStates returns the number of NVMe controllers of this host by
+// state, local and fabrics ones, empty if there's no /sys/class/nvme
+func CountControllerStates() (map[string]int, error) {
+	stateFiles, err := filepath.Glob("/sys/class/nvme/nvme*/state")
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, stateFile := range stateFiles {
+		state, err := os.ReadFile(stateFile) // #nosec - sysfs path from a fixed glob
+		if err != nil {
+			continue // controller went away
+		}
+		counts[strings.TrimSpace(string(state))]++
+	}
+	return counts, nil
+}
+
+// isLocalAddress tells if ip is assigned to an interface of this node
+func isLocalAddress(ip string) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		klog.Warningf("failed to list interface addresses: %v", err)
+		return false
+	}
+	want := net.ParseIP(ip)
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(want) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountControllers returns the number of NVMe controllers of this host, local and fabrics ones
+func CountControllers() (int, error) {
+	controllers, err := filepath.Glob("/sys/class/nvme/nvme*")
+	if err != nil {
+		return 0, err
+	}
+	return len(controllers), nil
 }
 
 // when timeout is set as 0, try to find the device file immediately
-// otherwise, wait for device file comes up or timeout
-func waitForDeviceReady(deviceGlob string, seconds int) (string, error) {
-	for i := 0; i <= seconds; i++ {
+// otherwise, wait for device file comes up, timeout or ctx is done, polling
+// with backoff, see PollWithBackoff
+func waitForDeviceReady(ctx context.Context, deviceGlob string, seconds int) (string, error) {
+	return waitForNamespaceDevice(ctx, deviceGlob, 0, seconds)
+}
+
+// waitForNamespaceDevice is waitForDeviceReady only taking the devices with
+// namespace ID nsid, any device when nsid is 0
+func waitForNamespaceDevice(ctx context.Context, deviceGlob string, nsid uint32, seconds int) (string, error) {
+	var devicePath string
+	err := PollWithBackoff(ctx, time.Duration(seconds)*time.Second, func() (bool, error) {
 		matches, err := filepath.Glob(deviceGlob)
 		if err != nil {
-			return "", err
+			return false, err
 		}
 		// two symbol links under /dev/disk/by-id/ to same device
-		if len(matches) >= 1 {
-			return matches[0], nil
+		for _, match := range matches {
+			if nsid == 0 || deviceHasNsid(match, nsid) {
+				devicePath = match
+				return true, nil
+			}
 		}
-		time.Sleep(time.Second)
+		if len(matches) > 0 {
+			V(LogInitiator, 2).Infof("devices %v don't have nsid %d yet", matches, nsid)
+		}
+		return false, nil
+	})
+	switch {
+	case errors.Is(err, ErrPollTimedOut):
+		return "", fmt.Errorf("%w waiting device ready: %s", ErrTimeout, deviceGlob)
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		return "", fmt.Errorf("stopped waiting device ready: %s: %w", deviceGlob, err)
+	case err != nil:
+		return "", err
 	}
-	return "", fmt.Errorf("timed out waiting device ready: %s", deviceGlob)
+	return devicePath, nil
 }
 
-// wait for device file gone or timeout
-func waitForDeviceGone(deviceGlob string) error {
-	for i := 0; i <= 20; i++ {
-		matches, err := filepath.Glob(deviceGlob)
+// wait for device file gone, timeout or ctx is done
+// udev may re-add the link briefly while the controller is torn down, so the
+// link and the controllers of nqn must stay gone for stable before it's done
+func waitForDeviceGone(ctx context.Context, deviceGlob, nqn string, stable time.Duration) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.Now().Add(20*time.Second + stable)
+	var goneSince time.Time
+	for {
+		gone, err := deviceGone(deviceGlob, nqn)
 		if err != nil {
 			return err
 		}
-		if len(matches) == 0 {
+		now := time.Now()
+		switch {
+		case !gone:
+			if !goneSince.IsZero() {
+				V(LogInitiator, 2).Infof("device %s came back after %v, waiting again", deviceGlob, now.Sub(goneSince))
+			}
+			goneSince = time.Time{}
+		case goneSince.IsZero():
+			goneSince = now
+		}
+		if gone && now.Sub(goneSince) >= stable {
 			return nil
 		}
-		time.Sleep(time.Second)
+		if now.After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting device gone: %s: %w", deviceGlob, ctx.Err())
+		case <-ticker.C:
+		}
 	}
-	return fmt.Errorf("timed out waiting device gone: %s", deviceGlob)
+	return fmt.Errorf("%w waiting device gone: %s", ErrTimeout, deviceGlob)
+}
+
+// deviceGone tells if no link matches deviceGlob and no controller of nqn is left
+func deviceGone(deviceGlob, nqn string) (bool, error) {
+	matches, err := filepath.Glob(deviceGlob)
+	if err != nil {
+		return false, err
+	}
+	if len(matches) > 0 {
+		return false, nil
+	}
+	states, err := ControllerStates(nqn)
+	if err != nil {
+		return false, err
+	}
+	return len(states) == 0, nil
 }
 
 // exec shell command with timeout(in seconds)
-func execWithTimeout(cmdLine []string, timeout int) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+func execWithTimeout(ctx context.Context, cmdLine []string, timeout int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	defer cancel()
 
-	klog.Infof("running command: %v", cmdLine)
+	cmdLine = hostCommand(cmdLine)
+	V(LogInitiator, 4).Infof("%srunning command: %v", logPrefix(ctx), redactCmdLine(cmdLine))
 	//nolint:gosec // execWithTimeout assumes valid cmd arguments
 	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
 	output, err := cmd.CombinedOutput()
 	outputStr := string(output)
 	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return outputStr, fmt.Errorf("timed out")
+		return outputStr, fmt.Errorf("%w after %ds", ErrTimeout, timeout)
 	}
 	if output != nil {
-		klog.Infof("command returned: %s", output)
+		V(LogInitiator, 4).Infof("%scommand returned: %s", logPrefix(ctx), truncateOutput(outputStr))
 	}
 	return outputStr, err
 }
+
+// truncateOutput cuts command output to be logged to -max-logged-output bytes,
+// e.g. nvme list -o json of a node with many namespaces, callers still get all
+// of it
+func truncateOutput(output string) string {
+	limit := initiatorConf.maxLoggedOutput
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+	return fmt.Sprintf("%s... (%d more bytes truncated)", output[:limit], len(output)-limit)
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Initiator errors, match them with errors.Is
+var (
+	// ErrInvalidPublishContext means the publish context can't describe a target, retrying won't help
+	ErrInvalidPublishContext = errors.New("invalid publish context")
+	// ErrAuthFailed means the target refused the host, permanent until the gateway config changes
+	ErrAuthFailed = errors.New("nvme authentication failed")
+	// ErrTimeout means an nvme command or the device took too long, worth retrying
+	ErrTimeout = errors.New("nvme timed out")
+	// ErrNoPath means the target couldn't be reached, worth retrying
+	ErrNoPath = errors.New("no path to nvme target")
+)
+
+// nvme-cli and kernel messages of each error category, matched lowercase
+var nvmeErrorPatterns = []struct {
+	err      error
+	patterns []string
+}{
+	{ErrAuthFailed, []string{"authentication", "dhchap", "operation not permitted", "permission denied"}},
+	{ErrNoPath, []string{
+		"connection refused", "no route to host", "network is unreachable",
+		"connection timed out", "host is down", "failed to add controller",
+	}},
+}
+
+// classifyNvmeError wraps the error of an nvme command with the category its output falls in
+func classifyNvmeError(cmdLine []string, output string, err error) error {
+	cmdLine = redactCmdLine(cmdLine)
+	if errors.Is(err, ErrTimeout) {
+		return fmt.Errorf("command %v: %w", cmdLine, err)
+	}
+	lower := strings.ToLower(output)
+	for _, category := range nvmeErrorPatterns {
+		for _, pattern := range category.patterns {
+			if strings.Contains(lower, pattern) {
+				return fmt.Errorf("command %v: %w: %s", cmdLine, category.err, strings.TrimSpace(output))
+			}
+		}
+	}
+	return fmt.Errorf("command %v failed: %w: %s", cmdLine, err, strings.TrimSpace(output))
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPublishContext returns a valid tcp publish context with changes applied,
+// an empty value deletes the key
+func testPublishContext(changes map[string]string) map[string]string {
+	publishContext := map[string]string{
+		"nqn":       "nqn.2016-06.io.spdk:cnode1",
+		"uuid":      "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c",
+		"traddr":    "192.168.1.10",
+		"trsvcid":   "4420",
+		"transport": "tcp",
+	}
+	for k, v := range changes {
+		if v == "" {
+			delete(publishContext, k)
+			continue
+		}
+		publishContext[k] = v
+	}
+	return publishContext
+}
+
+func TestValidatePublishContext(t *testing.T) {
+	const wwn = "nn-0x20000090fa942779:pn-0x10000090fa942779"
+	tests := []struct {
+		name    string
+		changes map[string]string
+		valid   bool
+	}{
+		{"tcp", nil, true},
+		{"host name", map[string]string{"traddr": "gw1.storage.example.com"}, true},
+		{"ipv6", map[string]string{"traddr": "fd00::10"}, true},
+		{"host_traddr", map[string]string{"host_traddr": "192.168.1.20"}, true},
+		{"missing nqn", map[string]string{"nqn": ""}, false},
+		{"missing uuid", map[string]string{"uuid": ""}, false},
+		{"missing transport", map[string]string{"transport": ""}, false},
+		{"missing traddr", map[string]string{"traddr": ""}, false},
+		{"missing trsvcid", map[string]string{"trsvcid": ""}, false},
+		{"longest nqn", map[string]string{"nqn": "nqn.2016-06.io.spdk:" + strings.Repeat("a", maxNQNLength-len("nqn.2016-06.io.spdk:"))}, true},
+		{"nqn too long", map[string]string{"nqn": "nqn.2016-06.io.spdk:" + strings.Repeat("a", maxNQNLength-len("nqn.2016-06.io.spdk:")+1)}, false},
+		{"nqn without prefix", map[string]string{"nqn": "iqn.2016-06.io.spdk:cnode1"}, false},
+		{"nqn bad month", map[string]string{"nqn": "nqn.2016-13.io.spdk:cnode1"}, false},
+		{"nqn bad domain", map[string]string{"nqn": "nqn.2016-06.-spdk:cnode1"}, false},
+		{"nqn without name", map[string]string{"nqn": "nqn.2016-06.io.spdk"}, true},
+		{"uuid too short", map[string]string{"uuid": "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6"}, false},
+		{"uuid not hex", map[string]string{"uuid": "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5bzz"}, false},
+		{"uuid without dashes", map[string]string{"uuid": "8a3c5b1e2f4d4e6a9b7c1d2e3f4a5b6c"}, false},
+		{"port 0", map[string]string{"trsvcid": "0"}, false},
+		{"port 65535", map[string]string{"trsvcid": "65535"}, true},
+		{"port 65536", map[string]string{"trsvcid": "65536"}, false},
+		{"port not a number", map[string]string{"trsvcid": "nvme"}, false},
+		{"traddr with a port", map[string]string{"traddr": "192.168.1.10:4420"}, false},
+		{"traddr with a space", map[string]string{"traddr": "gw1 gw2"}, false},
+		{"host_traddr not an ip", map[string]string{"host_traddr": "eth0"}, false},
+		{"discovery", map[string]string{"traddr": "", "trsvcid": "", "discovery_traddr": "192.168.1.10"}, true},
+		{"discovery port", map[string]string{"traddr": "", "trsvcid": "", "discovery_traddr": "192.168.1.10", "discovery_trsvcid": "8009"}, true},
+		{"discovery bad port", map[string]string{"traddr": "", "trsvcid": "", "discovery_traddr": "192.168.1.10", "discovery_trsvcid": "0"}, false},
+		{"discovery bad address", map[string]string{"traddr": "", "trsvcid": "", "discovery_traddr": "192.168.1.10:8009"}, false},
+		{"discovery and traddr", map[string]string{"discovery_traddr": "192.168.1.10"}, false},
+		{"fc", map[string]string{"transport": "fc", "traddr": wwn, "trsvcid": ""}, true},
+		{"fc upper case prefix", map[string]string{"transport": "FC", "traddr": strings.ToUpper(wwn[:3]) + wwn[3:], "trsvcid": ""}, false},
+		{"fc host_traddr", map[string]string{"transport": "fc", "traddr": wwn, "trsvcid": "", "host_traddr": wwn}, true},
+		{"fc short wwnn", map[string]string{"transport": "fc", "traddr": "nn-0x20000090fa94277:pn-0x10000090fa942779", "trsvcid": ""}, false},
+		{"fc bad wwpn", map[string]string{"transport": "fc", "traddr": "nn-0x20000090fa942779:pn-0x10000090fa94277g", "trsvcid": ""}, false},
+		{"fc ip traddr", map[string]string{"transport": "fc", "traddr": "192.168.1.10", "trsvcid": ""}, false},
+		{"fc ip host_traddr", map[string]string{"transport": "fc", "traddr": wwn, "trsvcid": "", "host_traddr": "192.168.1.20"}, false},
+		{"fc discovery", map[string]string{"transport": "fc", "traddr": wwn, "trsvcid": "", "discovery_traddr": "192.168.1.10"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePublishContext(testPublishContext(tt.changes))
+			if tt.valid && err != nil {
+				t.Errorf("got %v, want valid", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidPublishContext) {
+				t.Errorf("got %v, want ErrInvalidPublishContext", err)
+			}
+		})
+	}
+}
+
+func TestConnectCmdLine(t *testing.T) {
+	const wwnn, hostWwnn = "nn-0x20000090fa942779:pn-0x10000090fa942779", "nn-0x20000090fa94277a:pn-0x10000090fa94277a"
+	tests := []struct {
+		name    string
+		changes map[string]string
+		want    []string
+	}{
+		{
+			name: "tcp",
+			want: []string{"nvme", "connect-all", "-t", "tcp", "-a", "192.168.1.10", "-q", "nqn.2016-06.io.spdk:cnode1", "-l", "1800"},
+		},
+		{
+			name:    "fc",
+			changes: map[string]string{"transport": "fc", "traddr": wwnn, "trsvcid": ""},
+			want:    []string{"nvme", "connect-all", "-t", "fc", "-a", wwnn, "-q", "nqn.2016-06.io.spdk:cnode1", "-l", "1800"},
+		},
+		{
+			name:    "fc upper case transport and host_traddr",
+			changes: map[string]string{"transport": "FC", "traddr": wwnn, "trsvcid": "", "host_traddr": hostWwnn},
+			want:    []string{"nvme", "connect-all", "-t", "fc", "-a", wwnn, "-q", "nqn.2016-06.io.spdk:cnode1", "-l", "1800", "-w", hostWwnn},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			initiator, err := NewNvmeofCsiInitiator("vol-1", testPublishContext(tt.changes), nil)
+			if err != nil {
+				t.Fatalf("NewNvmeofCsiInitiator: %v", err)
+			}
+			nvmf, ok := initiator.(*initiatorNVMf)
+			if !ok {
+				t.Fatalf("got a %T initiator", initiator)
+			}
+			if got := nvmf.connectCmdLine(); !slices.Equal(got, tt.want) {
+				t.Errorf("connect command line %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDeviceWaitsCancelled cancels the waits for a device that never shows
+// up and one that never goes, both must return right away
+func TestDeviceWaitsCancelled(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "nvme-uuid.8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c")
+	if err := os.WriteFile(present, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waits := map[string]func(ctx context.Context) error{
+		"device ready": func(ctx context.Context) error {
+			_, err := waitForDeviceReady(ctx, filepath.Join(dir, "nvme-uuid.*missing*"), 60)
+			return err
+		},
+		"device gone": func(ctx context.Context) error {
+			return waitForDeviceGone(ctx, present, "nqn.2016-06.io.spdk:cnode1", 0)
+		},
+	}
+	for name, wait := range waits {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(50*time.Millisecond, cancel)
+			start := time.Now()
+			err := wait(ctx)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("got %v, want context.Canceled", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("returned %v after the cancel", elapsed)
+			}
+		})
+	}
+}
+
+// TestWaitForDeviceGoneFlapping has the by-id link of a disconnected device
+// go, come back while udev re-adds it, then go for good. The wait must only
+// return once the link stayed gone for the stable time.
+func TestWaitForDeviceGoneFlapping(t *testing.T) {
+	link := filepath.Join(t.TempDir(), "nvme-uuid.8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c")
+	if err := os.WriteFile(link, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	const stable = 1500 * time.Millisecond
+	// checked every second: present, gone, back, then gone for good
+	gone := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.Remove(link) //nolint:errcheck // checked by the wait
+		time.Sleep(time.Second)
+		os.WriteFile(link, nil, 0o600) //nolint:errcheck // checked by the wait
+		time.Sleep(1200 * time.Millisecond)
+		os.Remove(link) //nolint:errcheck // checked by the wait
+		gone <- time.Now()
+	}()
+
+	if err := waitForDeviceGone(context.Background(), link, "nqn.2016-06.io.spdk:cnode1", stable); err != nil {
+		t.Fatalf("waitForDeviceGone: %v", err)
+	}
+	select {
+	case goneForGood := <-gone:
+		if elapsed := time.Since(goneForGood); elapsed < stable {
+			t.Errorf("returned %v after the link went for good, want at least %v", elapsed, stable)
+		}
+	default:
+		t.Fatal("returned before the link went for good")
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"strings"
+)
+
+// keys added by the external-provisioner with --extra-create-metadata to the
+// CreateVolume parameters, which CreateVolume passes on in the volume context,
+// and by the kubelet to the NodePublishVolume volume context with podInfoOnMount
+const (
+	pvcNameKey      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+	pvNameKey       = "csi.storage.k8s.io/pv/name"
+	podNameKey      = "csi.storage.k8s.io/pod.name"
+	podNamespaceKey = "csi.storage.k8s.io/pod.namespace"
+)
+
+// K8sObjects are the Kubernetes objects a volume belongs to, as far as the
+// request tells
+type K8sObjects struct {
+	PVCName, PVCNamespace, PVName string
+	PodName, PodNamespace         string
+}
+
+// ParseK8sObjects returns the Kubernetes objects named by the
+// csi.storage.k8s.io/ keys of params, empty fields for missing ones
+func ParseK8sObjects(params map[string]string) K8sObjects {
+	return K8sObjects{
+		PVCName:      params[pvcNameKey],
+		PVCNamespace: params[pvcNamespaceKey],
+		PVName:       params[pvNameKey],
+		PodName:      params[podNameKey],
+		PodNamespace: params[podNamespaceKey],
+	}
+}
+
+// String returns e.g. "pvc default/data pv pvc-1234 pod default/app-0", "pvc
+// unknown" if no object is known, e.g. without --extra-create-metadata
+func (o K8sObjects) String() string {
+	if o == (K8sObjects{}) {
+		return "pvc unknown"
+	}
+	var parts []string
+	if o.PVCName != "" {
+		parts = append(parts, "pvc "+qualifiedName(o.PVCNamespace, o.PVCName))
+	}
+	if o.PVName != "" {
+		parts = append(parts, "pv "+o.PVName)
+	}
+	if o.PodName != "" {
+		parts = append(parts, "pod "+qualifiedName(o.PodNamespace, o.PodName))
+	}
+	return strings.Join(parts, " ")
+}
+
+func qualifiedName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "/" + name
+}
+
+// WithK8sObjects returns ctx tagging the command logs of the initiators used
+// with it with the Kubernetes objects of volumeContext, see withLogTags
+func WithK8sObjects(ctx context.Context, volumeContext map[string]string) context.Context {
+	objects := ParseK8sObjects(volumeContext)
+	if objects == (K8sObjects{}) {
+		return ctx
+	}
+	return withLogTags(ctx, objects.String())
+}
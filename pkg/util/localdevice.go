@@ -0,0 +1,84 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+)
+
+// publish context key of a local block device staged as is, without
+// connecting to any target, for development and csi-sanity against e.g. a
+// loop device. Only accepted by nodes started with -allow-local-device.
+const localDeviceKey = "device_path"
+
+// IsLocalDevice tells if publishContext stages a local device, see localDeviceKey
+func IsLocalDevice(publishContext map[string]string) bool {
+	return publishContext[localDeviceKey] != ""
+}
+
+// initiatorLocal is the initiator of a local device, connecting checks it's
+// there and disconnecting does nothing
+type initiatorLocal struct {
+	volumeID   string
+	devicePath string
+}
+
+// newLocalInitiator returns the initiator of the local device of
+// publishContext. The nqn and uuid are still required, the node server keeps
+// track of volumes by them.
+func newLocalInitiator(volumeID string, publishContext map[string]string) (NvmeofCsiInitiator, error) {
+	if !initiatorConf.allowLocalDevice {
+		return nil, fmt.Errorf("%w: %s requires a node started with -allow-local-device", ErrInvalidPublishContext, localDeviceKey)
+	}
+	if nqn := publishContext["nqn"]; !nqnRe.MatchString(nqn) {
+		return nil, fmt.Errorf("%w: invalid nqn %q", ErrInvalidPublishContext, nqn)
+	}
+	if uuid := publishContext["uuid"]; !uuidRe.MatchString(uuid) {
+		return nil, fmt.Errorf("%w: invalid uuid %q", ErrInvalidPublishContext, uuid)
+	}
+	devicePath := publishContext[localDeviceKey]
+	if !filepath.IsAbs(devicePath) {
+		return nil, fmt.Errorf("%w: %s %q isn't an absolute path", ErrInvalidPublishContext, localDeviceKey, devicePath)
+	}
+	return &initiatorLocal{volumeID: volumeID, devicePath: filepath.Clean(devicePath)}, nil
+}
+
+func (local *initiatorLocal) Connect(_ context.Context) (string, error) {
+	info, err := os.Stat(local.devicePath)
+	if err != nil {
+		return "", fmt.Errorf("local device of volume %s: %w", local.volumeID, err)
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return "", fmt.Errorf("%w: local device %s of volume %s isn't a block device", ErrInvalidPublishContext, local.devicePath, local.volumeID)
+	}
+	klog.Warningf("using local device %s for volume %s, no target is connected", local.devicePath, local.volumeID)
+	return local.devicePath, nil
+}
+
+func (local *initiatorLocal) Disconnect(_ context.Context) error {
+	return nil
+}
+
+// Reconnect resolves the local device again, there's nothing to disconnect
+func (local *initiatorLocal) Reconnect(ctx context.Context) (string, error) {
+	return local.Connect(ctx)
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"sync/atomic"
+
+	"k8s.io/klog"
+)
+
+// LogSubsystem identifies a part of the driver with its own log verbosity
+type LogSubsystem int
+
+const (
+	LogInitiator LogSubsystem = iota
+	LogNode
+	LogController
+	numLogSubsystems
+)
+
+// per subsystem verbosity, negative means fall back to the global -v
+var logLevels [numLogSubsystems]atomic.Int32
+
+func init() {
+	for i := range logLevels {
+		logLevels[i].Store(-1)
+	}
+}
+
+// SetLogLevels applies the per subsystem verbosity from the parsed config
+func SetLogLevels(conf *Config) {
+	logLevels[LogInitiator].Store(int32(conf.InitiatorLogLevel))
+	logLevels[LogNode].Store(int32(conf.NodeLogLevel))
+	logLevels[LogController].Store(int32(conf.ControllerLogLevel))
+}
+
+// V is klog.V gated by the subsystem verbosity, when the subsystem has no
+// level configured the global -v level is used
+func V(subsystem LogSubsystem, level klog.Level) klog.Verbose {
+	subsystemLevel := logLevels[subsystem].Load()
+	if subsystemLevel < 0 {
+		return klog.V(level)
+	}
+	return klog.Verbose(int32(level) <= subsystemLevel)
+}
+
+type logTagsKey struct{}
+
+// withLogTags returns ctx tagging the command logs of execWithTimeout with
+// tags, e.g. the volume and NQN an initiator acts on, so the logs of
+// concurrent operations can be told apart
+func withLogTags(ctx context.Context, tags string) context.Context {
+	return context.WithValue(ctx, logTagsKey{}, tags)
+}
+
+// logPrefix returns the tags set by withLogTags as a log line prefix
+func logPrefix(ctx context.Context) string {
+	if tags, ok := ctx.Value(logTagsKey{}).(string); ok && tags != "" {
+		return "[" + tags + "] "
+	}
+	return ""
+}
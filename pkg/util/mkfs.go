@@ -0,0 +1,108 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// StorageClass parameter with extra mkfs arguments, e.g. "-b 4096 -E stride=16,stripe_width=64".
+// Only the options of mkfsAllowlist are accepted, they're used when the device is formatted.
+const mkfsArgsKey = "mkfsArgs"
+
+// mkfsOption is an allowed mkfs option, subOptions lists the keys allowed in
+// its key[=value],... argument, nil when it takes a plain size
+type mkfsOption struct {
+	hasValue   bool
+	subOptions []string
+}
+
+var ext4MkfsOptions = map[string]mkfsOption{
+	"-b": {hasValue: true}, // block size
+	"-i": {hasValue: true}, // bytes per inode
+	"-I": {hasValue: true}, // inode size
+	"-E": {hasValue: true, subOptions: []string{
+		"stride", "stripe_width", "stripe-width", "lazy_itable_init", "lazy_journal_init", "discard", "nodiscard",
+	}},
+}
+
+// mkfsAllowlist lists the mkfs options accepted in mkfsArgs per filesystem type
+var mkfsAllowlist = map[string]map[string]mkfsOption{
+	"ext3": ext4MkfsOptions,
+	"ext4": ext4MkfsOptions,
+	"xfs": {
+		"-b": {hasValue: true, subOptions: []string{"size"}},
+		"-d": {hasValue: true, subOptions: []string{"su", "sw", "sunit", "swidth"}},
+		"-i": {hasValue: true, subOptions: []string{"size"}},
+		"-K": {}, // don't discard at mkfs time
+	},
+}
+
+// sizes and counts, optionally with a unit suffix
+var mkfsValueRe = regexp.MustCompile(`^[0-9]+[kKmMgGsb]?$`)
+
+// ParseMkfsArgs reads the mkfsArgs StorageClass parameter from the volume
+// context, rejecting anything not in the allowlist of fsType
+func ParseMkfsArgs(volumeContext map[string]string, fsType string) ([]string, error) {
+	args := strings.Fields(volumeContext[mkfsArgsKey])
+	if len(args) == 0 {
+		return nil, nil
+	}
+	allowed, ok := mkfsAllowlist[fsType]
+	if !ok {
+		return nil, fmt.Errorf("%s isn't supported for filesystem %s", mkfsArgsKey, fsType)
+	}
+	for i := 0; i < len(args); i++ {
+		option, ok := allowed[args[i]]
+		if !ok {
+			return nil, fmt.Errorf("%s: option %q isn't allowed for filesystem %s", mkfsArgsKey, args[i], fsType)
+		}
+		if !option.hasValue {
+			continue
+		}
+		i++
+		if i == len(args) {
+			return nil, fmt.Errorf("%s: option %q needs a value", mkfsArgsKey, args[i-1])
+		}
+		if err := validateMkfsValue(args[i], option); err != nil {
+			return nil, fmt.Errorf("%s: option %q: %w", mkfsArgsKey, args[i-1], err)
+		}
+	}
+	return args, nil
+}
+
+func validateMkfsValue(value string, option mkfsOption) error {
+	if option.subOptions == nil {
+		if !mkfsValueRe.MatchString(value) {
+			return fmt.Errorf("invalid value %q", value)
+		}
+		return nil
+	}
+	for _, subOption := range strings.Split(value, ",") {
+		key, subValue, hasValue := strings.Cut(subOption, "=")
+		if !slices.Contains(option.subOptions, key) {
+			return fmt.Errorf("sub-option %q isn't allowed", key)
+		}
+		if hasValue && !mkfsValueRe.MatchString(subValue) {
+			return fmt.Errorf("invalid value %q for sub-option %s", subValue, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseMkfsArgs(t *testing.T) {
+	tests := []struct {
+		name     string
+		fsType   string
+		mkfsArgs string
+		want     []string
+		wantErr  bool
+	}{
+		{"unset", "ext4", "", nil, false},
+		{"ext4 block size", "ext4", "-b 4096", []string{"-b", "4096"}, false},
+		{"ext4 stripe", "ext4", "-b 4096  -E stride=16,stripe_width=64", []string{"-b", "4096", "-E", "stride=16,stripe_width=64"}, false},
+		{"ext4 flag sub-option", "ext4", "-E nodiscard", []string{"-E", "nodiscard"}, false},
+		{"ext4 size unit", "ext4", "-i 16k", []string{"-i", "16k"}, false},
+		{"xfs stripe", "xfs", "-d su=4m,sw=1 -K", []string{"-d", "su=4m,sw=1", "-K"}, false},
+		{"xfs block size", "xfs", "-b size=4096", []string{"-b", "size=4096"}, false},
+		{"option of another filesystem", "xfs", "-E stride=16", nil, true},
+		{"option not allowed", "ext4", "-F", nil, true},
+		{"device argument", "ext4", "-b 4096 /dev/nvme1n1", nil, true},
+		{"missing value", "ext4", "-b", nil, true},
+		{"value not a size", "ext4", "-b 4096;reboot", nil, true},
+		{"value an option", "ext4", "-b -F", nil, true},
+		{"sub-option not allowed", "ext4", "-E root_owner=0:0", nil, true},
+		{"sub-option value not a size", "xfs", "-d su=$(id)", nil, true},
+		{"xfs plain size", "xfs", "-b 4096", nil, true},
+		{"unsupported filesystem", "btrfs", "-b 4096", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMkfsArgs(map[string]string{mkfsArgsKey: tt.mkfsArgs}, tt.fsType)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
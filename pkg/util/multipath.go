@@ -0,0 +1,98 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// sysfs of the block devices, and the nvme_core parameter telling if native
+// multipath is on
+const (
+	sysBlockDir            = "/sys/block"
+	nvmeMultipathParameter = "/sys/module/nvme_core/parameters/multipath"
+)
+
+// nvme<subsystem>c<controller>n<namespace> is a single path of a native
+// multipath namespace, whose head device is nvme<subsystem>n<namespace>.
+// Kernels list the paths in sysfs, some nvme-cli versions list them too, but
+// there's no /dev node to mount for them.
+var nvmePathDeviceRe = regexp.MustCompile(`^nvme([0-9]+)c[0-9]+n([0-9]+)$`)
+
+// nativeMultipathEnabled tells if nvme_core creates a head device per
+// namespace, reaching it through all the controllers of its subsystem
+func nativeMultipathEnabled() bool {
+	data, err := os.ReadFile(nvmeMultipathParameter)
+	return err == nil && strings.TrimSpace(string(data)) == "Y"
+}
+
+// multipathHead returns the head device of the native multipath namespace
+// devicePath belongs to, looked up in the sysfs block dir sysBlock, and
+// whether there's one. A head is devicePath itself on kernels listing its
+// paths in a multipath dir, and on older ones when its device is the
+// subsystem rather than a controller with an address. A path nvmeXcYnZ maps
+// to its head nvmeXnZ.
+func multipathHead(sysBlock, devicePath string) (string, bool) {
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		device = devicePath
+	}
+	name := filepath.Base(device)
+	if m := nvmePathDeviceRe.FindStringSubmatch(name); m != nil {
+		head := "nvme" + m[1] + "n" + m[2]
+		if _, err := os.Stat(filepath.Join(sysBlock, head)); err == nil {
+			return filepath.Join("/dev", head), true
+		}
+		return devicePath, false
+	}
+	if _, err := os.Stat(filepath.Join(sysBlock, name, "multipath")); err == nil {
+		return devicePath, true
+	}
+	deviceDir := filepath.Join(sysBlock, name, "device")
+	if _, err := os.Stat(filepath.Join(deviceDir, "address")); err == nil {
+		return devicePath, false // the namespace of a single controller
+	}
+	if _, err := os.Stat(filepath.Join(deviceDir, "subsysnqn")); err == nil {
+		return devicePath, true
+	}
+	return devicePath, false
+}
+
+// selectMultipathHead returns the device to stage for the resolved
+// devicePath: with native multipath the head device, mounting a single path
+// would lose the others, else devicePath
+func selectMultipathHead(devicePath string) string {
+	if !nativeMultipathEnabled() {
+		V(LogInitiator, 4).Infof("native multipath is off, using the device %s of a single controller", devicePath)
+		return devicePath
+	}
+	head, ok := multipathHead(sysBlockDir, devicePath)
+	switch {
+	case !ok:
+		klog.Warningf("native multipath is on but %s has no multipath head device, using it as is", devicePath)
+	case head != devicePath:
+		klog.Infof("device %s is a single path of a multipath namespace, using its head device %s", devicePath, head)
+	default:
+		V(LogInitiator, 2).Infof("using the multipath head device %s", devicePath)
+	}
+	return head
+}
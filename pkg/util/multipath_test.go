@@ -0,0 +1,113 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestMultipathHead looks up devices in simulated /sys/block trees, each
+// file listed is created, with its parent dirs
+func TestMultipathHead(t *testing.T) {
+	tests := []struct {
+		name       string
+		sysfs      []string
+		devicePath string
+		wantHead   string
+		wantOK     bool
+	}{
+		{
+			name:       "head listing its paths",
+			sysfs:      []string{"nvme0n1/multipath/nvme0c0n1", "nvme0n1/multipath/nvme0c1n1", "nvme0c0n1/device/address", "nvme0c1n1/device/address"},
+			devicePath: "/dev/nvme0n1",
+			wantHead:   "/dev/nvme0n1",
+			wantOK:     true,
+		},
+		{
+			name:       "path of a head",
+			sysfs:      []string{"nvme0n1/multipath/nvme0c1n1", "nvme0c1n1/device/address"},
+			devicePath: "/dev/nvme0c1n1",
+			wantHead:   "/dev/nvme0n1",
+			wantOK:     true,
+		},
+		{
+			name:       "path without a head",
+			sysfs:      []string{"nvme0c1n1/device/address"},
+			devicePath: "/dev/nvme0c1n1",
+			wantHead:   "/dev/nvme0c1n1",
+		},
+		{
+			name:       "head of an older kernel",
+			sysfs:      []string{"nvme1n2/device/subsysnqn"},
+			devicePath: "/dev/nvme1n2",
+			wantHead:   "/dev/nvme1n2",
+			wantOK:     true,
+		},
+		{
+			name:       "namespace of a single controller",
+			sysfs:      []string{"nvme0n1/device/address", "nvme0n1/device/subsysnqn"},
+			devicePath: "/dev/nvme0n1",
+			wantHead:   "/dev/nvme0n1",
+		},
+		{
+			name:       "device not in sysfs",
+			sysfs:      []string{"nvme0n1/multipath/nvme0c0n1"},
+			devicePath: "/dev/nvme3n1",
+			wantHead:   "/dev/nvme3n1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sysBlock := t.TempDir()
+			for _, file := range tt.sysfs {
+				path := filepath.Join(sysBlock, file)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, nil, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			head, ok := multipathHead(sysBlock, tt.devicePath)
+			if head != tt.wantHead || ok != tt.wantOK {
+				t.Errorf("multipathHead(%s) = %s, %v, want %s, %v", tt.devicePath, head, ok, tt.wantHead, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestMultipathHeadResolvesLinks finds the head of a path given by a link,
+// as the by-id links of udev are
+func TestMultipathHeadResolvesLinks(t *testing.T) {
+	sysBlock := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(sysBlock, "nvme0n1", "multipath"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	dev := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dev, "nvme0c1n1"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dev, "nvme-uuid.8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c")
+	if err := os.Symlink("nvme0c1n1", link); err != nil {
+		t.Fatal(err)
+	}
+	if head, ok := multipathHead(sysBlock, link); head != "/dev/nvme0n1" || !ok {
+		t.Errorf("multipathHead(%s) = %s, %v, want /dev/nvme0n1, true", link, head, ok)
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+
+	gatewaypb "github.com/ceph/ceph-nvmeof-csi/proto"
+)
+
+// ErrNamespaceNotFound is returned when the gateway has no namespace for a volume
+var ErrNamespaceNotFound = errors.New("namespace not found")
+
+// LookupNamespace returns namespace nsid of subsystemNQN from the gateway.
+// Volumes of static PVs are bound to namespaces created out of band, this
+// resolves what their PV leaves out, e.g. the uuid the node connects by.
+func LookupNamespace(ctx context.Context, gateway gatewaypb.GatewayClient, subsystemNQN string, nsid uint32) (*gatewaypb.NamespaceCli, error) {
+	resp, err := gateway.ListNamespaces(ctx, &gatewaypb.ListNamespacesReq{
+		Subsystem: subsystemNQN,
+		Nsid:      proto.Uint32(nsid),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gateway ListNamespaces failed: %w", err)
+	}
+	if resp.GetStatus() != 0 {
+		return nil, fmt.Errorf("gateway ListNamespaces returned error: %s", resp.GetErrorMessage())
+	}
+	// the gateway may ignore the nsid filter, match it here too
+	for _, ns := range resp.GetNamespaces() {
+		if ns.GetNsid() == nsid {
+			return ns, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: nsid %d of %s", ErrNamespaceNotFound, nsid, subsystemNQN)
+}
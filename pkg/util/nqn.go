@@ -0,0 +1,62 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultNQNPrefix is the prefix of the NQNs of the subsystems created by the
+// gateway when not told otherwise, e.g. nqn.2016-06.io.spdk:cnode1
+const DefaultNQNPrefix = "nqn.2016-06.io.spdk"
+
+// StorageClass parameter naming the subsystem of the volumes below
+// -nqn-prefix, the NQN is <prefix>:<subsystemName>. SubsystemNqn, the full
+// NQN, takes precedence.
+const (
+	subsystemNQNKey  = "SubsystemNqn"
+	subsystemNameKey = "subsystemName"
+)
+
+// an NQN without the :<name> part
+var nqnPrefixRe = regexp.MustCompile(`^nqn\.[0-9]{4}-(0[1-9]|1[0-2])\.[a-zA-Z0-9][a-zA-Z0-9.-]*[a-zA-Z0-9]$`)
+
+// ValidateNQNPrefix checks prefix is nqn.yyyy-mm.<reverse domain>
+func ValidateNQNPrefix(prefix string) error {
+	if !nqnPrefixRe.MatchString(prefix) {
+		return fmt.Errorf("invalid NQN prefix %q, expected nqn.yyyy-mm.<reverse domain>, e.g. nqn.2025-01.com.example.storage", prefix)
+	}
+	return nil
+}
+
+// SubsystemNQN returns the NQN of the subsystem of a volume, SubsystemNqn if
+// set, <prefix>:<subsystemName> otherwise
+func SubsystemNQN(params map[string]string, prefix string) (string, error) {
+	if nqn := params[subsystemNQNKey]; nqn != "" {
+		return nqn, nil
+	}
+	name := params[subsystemNameKey]
+	if name == "" {
+		return "", fmt.Errorf("%s or %s is required", subsystemNQNKey, subsystemNameKey)
+	}
+	nqn := prefix + ":" + name
+	if len(nqn) > maxNQNLength || !nqnRe.MatchString(nqn) {
+		return "", fmt.Errorf("invalid %s %q, %s isn't a valid NQN of at most %d bytes", subsystemNameKey, name, nqn, maxNQNLength)
+	}
+	return nqn, nil
+}
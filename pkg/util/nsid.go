@@ -0,0 +1,63 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NsidKey is the volume and publish context key of the namespace ID the
+// gateway assigned, matched with the uuid when resolving the device. It's
+// optional, volumes created by older versions don't have it.
+const NsidKey = "nsid"
+
+// ParseNsid returns the nsid of params, 0 when unset
+func ParseNsid(params map[string]string) (uint32, error) {
+	value, ok := params[NsidKey]
+	if !ok {
+		return 0, nil
+	}
+	nsid, err := strconv.ParseUint(value, 10, 32)
+	// 0 and 0xffffffff, all namespaces, aren't valid IDs of a namespace
+	if err != nil || nsid == 0 || nsid == 0xffffffff {
+		return 0, fmt.Errorf("%w: invalid %s %q", ErrInvalidPublishContext, NsidKey, value)
+	}
+	return uint32(nsid), nil
+}
+
+// deviceHasNsid tells if the namespace block device devicePath has nsid, by
+// its sysfs nsid attribute. A device whose nsid can't be read matches, the
+// uuid is then all that tells it.
+func deviceHasNsid(devicePath string, nsid uint32) bool {
+	device, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		device = devicePath
+	}
+	data, err := os.ReadFile(filepath.Join(sysBlockDir, filepath.Base(device), "nsid")) // #nosec - sysfs path of a listed device
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			V(LogInitiator, 2).Infof("failed to read the nsid of %s: %v", devicePath, err)
+		}
+		return true
+	}
+	return strings.TrimSpace(string(data)) == strconv.FormatUint(uint64(nsid), 10)
+}
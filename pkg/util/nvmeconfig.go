@@ -0,0 +1,185 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// StorageClass parameters, passed on in the publish context, selecting how
+// nvme connect-all gets the connection settings: from command line options,
+// or from a JSON config generated for the connect, which is needed for TLS
+const (
+	connectModeKey    = "connectMode"
+	connectModeCLI    = "cli"
+	connectModeConfig = "config"
+	tlsKey            = "tls" // config mode only
+)
+
+// NodeStageVolume secret of the TLS PSK in interchange format, written to the config as tls_key
+const tlsSecretKey = "tlsKey"
+
+// connect configs live here only while nvme connect-all runs, they may hold secrets
+const (
+	connectConfigDir = "/run/nvmeof-csi"
+	hostNQNFile      = "/etc/nvme/hostnqn"
+)
+
+// ParseConnectMode reads the connect mode and TLS parameters, TLS needs the config mode
+func ParseConnectMode(params map[string]string) (useConfig, tls bool, err error) {
+	switch mode := params[connectModeKey]; mode {
+	case "", connectModeCLI:
+	case connectModeConfig:
+		useConfig = true
+	default:
+		return false, false, fmt.Errorf("invalid %s %q, expected %s or %s", connectModeKey, mode, connectModeCLI, connectModeConfig)
+	}
+	if tls, err = parseBoolParameter(params, tlsKey); err != nil {
+		return false, false, err
+	}
+	if tls && !useConfig {
+		return false, false, fmt.Errorf("%s needs %s %s", tlsKey, connectModeKey, connectModeConfig)
+	}
+	if useConfig && params[discoveryTraddrKey] != "" {
+		return false, false, fmt.Errorf("%s %s can't be used with %s", connectModeKey, connectModeConfig, discoveryTraddrKey)
+	}
+	return useConfig, tls, nil
+}
+
+// the subset of the nvme-cli JSON config written for a connect
+type nvmeHostConfig struct {
+	HostNQN    string                `json:"hostnqn"`
+	Subsystems []nvmeSubsystemConfig `json:"subsystems"`
+}
+
+type nvmeSubsystemConfig struct {
+	NQN   string           `json:"nqn"`
+	Ports []nvmePortConfig `json:"ports"`
+}
+
+type nvmePortConfig struct {
+	Transport     string `json:"transport"`
+	Traddr        string `json:"traddr"`
+	Trsvcid       string `json:"trsvcid,omitempty"`
+	HostTraddr    string `json:"host_traddr,omitempty"`
+	CtrlLossTmo   int    `json:"ctrl_loss_tmo"`
+	HdrDigest     bool   `json:"hdr_digest,omitempty"`
+	DataDigest    bool   `json:"data_digest,omitempty"`
+	NrPollQueues  int    `json:"nr_poll_queues,omitempty"`
+	DhchapKey     string `json:"dhchap_key,omitempty"`
+	DhchapCtrlKey string `json:"dhchap_ctrl_key,omitempty"`
+	TLS           bool   `json:"tls,omitempty"`
+	TLSKey        string `json:"tls_key,omitempty"`
+}
+
+// connectConfigPath is the config of the volume, fixed so a disconnect can
+// remove one left behind by a crash during connect
+func (nvmf *initiatorNVMf) connectConfigPath() string {
+	return filepath.Join(connectConfigDir, nvmf.uuid+".json")
+}
+
+// readHostNQN reads the host NQN nvme connect-all uses. Behind -command-prefix
+// nvme runs on the host, whose hostnqn file isn't the one of the container, so
+// it's read through the prefix too.
+func readHostNQN(ctx context.Context) (string, error) {
+	var hostNQN string
+	if len(initiatorConf.commandPrefix) == 0 {
+		data, err := os.ReadFile(hostNQNFile)
+		if err != nil {
+			return "", err
+		}
+		hostNQN = string(data)
+	} else {
+		output, err := execWithTimeout(ctx, []string{"cat", hostNQNFile}, 10)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(output))
+		}
+		hostNQN = output
+	}
+	hostNQN = strings.TrimSpace(hostNQN)
+	if hostNQN == "" {
+		return "", fmt.Errorf("%s is empty", hostNQNFile)
+	}
+	return hostNQN, nil
+}
+
+// writeConnectConfig writes the nvme-cli config of the target, readable by
+// root only. The caller removes it once the connect is done.
+func (nvmf *initiatorNVMf) writeConnectConfig(ctx context.Context) (string, error) {
+	hostNQN, err := readHostNQN(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the host NQN for the connect config: %w", err)
+	}
+	config := []nvmeHostConfig{{
+		HostNQN: hostNQN,
+		Subsystems: []nvmeSubsystemConfig{{
+			NQN: nvmf.nqn,
+			Ports: []nvmePortConfig{{
+				Transport:     strings.ToLower(nvmf.targetType),
+				Traddr:        nvmf.targetAddr,
+				Trsvcid:       nvmf.targetPort,
+				HostTraddr:    nvmf.hostAddr,
+				CtrlLossTmo:   nvmf.ctrlLossTmo,
+				HdrDigest:     nvmf.hdrDigest,
+				DataDigest:    nvmf.dataDigest,
+				NrPollQueues:  nvmf.pollQueues,
+				DhchapKey:     nvmf.dhchapSecret,
+				DhchapCtrlKey: nvmf.dhchapCtrlSecret,
+				TLS:           nvmf.tls,
+				TLSKey:        nvmf.tlsKey,
+			}},
+		}},
+	}}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the connect config: %w", err)
+	}
+	if err := os.MkdirAll(connectConfigDir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", connectConfigDir, err)
+	}
+	path := nvmf.connectConfigPath()
+	removeConnectConfig(path)
+	// O_EXCL, never write secrets through a file someone else created
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600) // #nosec - path built from a validated uuid
+	if err != nil {
+		return "", fmt.Errorf("failed to create the connect config: %w", err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		removeConnectConfig(path)
+		return "", fmt.Errorf("failed to write the connect config %s: %w", path, err)
+	}
+	return path, nil
+}
+
+// removeConnectConfig deletes a connect config, failures are only logged
+func removeConnectConfig(path string) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.Errorf("failed to remove connect config %s, it may hold secrets: %v", path, err)
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"testing"
+)
+
+// TestReadHostNQNThroughPrefix checks the host NQN is read behind the command
+// prefix, the prefix stands in for nsenter and answers as the host would
+func TestReadHostNQNThroughPrefix(t *testing.T) {
+	saved := initiatorConf.commandPrefix
+	t.Cleanup(func() { initiatorConf.commandPrefix = saved })
+
+	const hostNQN = "nqn.2014-08.org.nvmexpress:uuid:5c3b7a8e-0b1e-4c39-9d5c-0d2b8e1f6a11"
+	// sh -c <script> <$0> <args>: the script ignores the cat command line it's given
+	initiatorConf.commandPrefix = []string{"sh", "-c", "echo " + hostNQN, "prefix"}
+	got, err := readHostNQN(context.Background())
+	if err != nil {
+		t.Fatalf("readHostNQN: %v", err)
+	}
+	if got != hostNQN {
+		t.Errorf("host NQN %q, want %q", got, hostNQN)
+	}
+
+	initiatorConf.commandPrefix = []string{"sh", "-c", "echo 'No such file or directory' >&2; exit 1", "prefix"}
+	if _, err := readHostNQN(context.Background()); err == nil {
+		t.Error("readHostNQN of a missing host file succeeded")
+	}
+	initiatorConf.commandPrefix = []string{"sh", "-c", "true", "prefix"}
+	if _, err := readHostNQN(context.Background()); err == nil {
+		t.Error("readHostNQN of an empty host file succeeded")
+	}
+}
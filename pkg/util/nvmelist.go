@@ -0,0 +1,155 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// how the device of a namespace is found after connecting, see -device-resolver
+const (
+	// the /dev/disk/by-id/nvme-uuid.* link created by udev
+	DeviceResolverByID = "by-id"
+	// the namespaces listed by nvme list -o json, no udev rules needed
+	DeviceResolverNvmeList = "nvme-list"
+)
+
+// ValidateDeviceResolver fails for unknown device resolution strategies
+func ValidateDeviceResolver(resolver string) error {
+	switch resolver {
+	case DeviceResolverByID, DeviceResolverNvmeList:
+		return nil
+	}
+	return fmt.Errorf("invalid device resolver %q, expected %s or %s", resolver, DeviceResolverByID, DeviceResolverNvmeList)
+}
+
+// nvmeListNamespace is a namespace block device listed by nvme list
+type nvmeListNamespace struct {
+	devicePath string
+	uuid       string // empty unless nvme-cli reports it
+}
+
+// parseNvmeList returns the namespaces in the output of nvme list -o json.
+// The schema changed across nvme-cli versions: 1.x and 2.x list devices as
+// {"Devices":[{"DevicePath":"/dev/nvme0n1",...}]}, the 2.x verbose output
+// nests them as {"Devices":[{"Subsystems":[{"Namespaces":[{"NameSpace":"nvme0n1"}]}]}]}
+// and later versions may move them again, so any object naming a device
+// path or a namespace block device is taken. nvme-cli prints no JSON when
+// there's no device.
+func parseNvmeList(output []byte) ([]nvmeListNamespace, error) {
+	start := bytes.IndexByte(output, '{')
+	if start < 0 {
+		return nil, nil
+	}
+	var data interface{}
+	if err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to parse nvme list output: %w", err)
+	}
+	var namespaces []nvmeListNamespace
+	seen := map[string]struct{}{}
+	var walk func(value interface{})
+	walk = func(value interface{}) {
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]interface{}:
+			devicePath, _ := v["DevicePath"].(string) //nolint:errcheck // missing in the verbose schema
+			if name, ok := v["NameSpace"].(string); ok && devicePath == "" && strings.HasPrefix(name, "nvme") {
+				devicePath = "/dev/" + name
+			}
+			if devicePath != "" {
+				if _, ok := seen[devicePath]; !ok {
+					seen[devicePath] = struct{}{}
+					uuid, _ := v["UUID"].(string) //nolint:errcheck // reported by few versions
+					namespaces = append(namespaces, nvmeListNamespace{devicePath: devicePath, uuid: uuid})
+				}
+			}
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	walk(data)
+	return namespaces, nil
+}
+
+// namespaceUUID returns the UUID of the namespace block device devicePath,
+// from sysfs as nvme list doesn't report it in most nvme-cli versions
+func namespaceUUID(devicePath string) (string, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(devicePath), "uuid")) // #nosec - path of a listed device
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// findDeviceByUUID returns the block device of the namespace with uuid, and
+// nsid unless 0, listed by nvme list, empty if none is
+func findDeviceByUUID(ctx context.Context, uuid string, nsid uint32) (string, error) {
+	output, err := execWithTimeout(ctx, []string{"nvme", "list", "-o", "json"}, 10)
+	if err != nil {
+		return "", fmt.Errorf("nvme list failed: %w: %s", err, output)
+	}
+	namespaces, err := parseNvmeList([]byte(output))
+	if err != nil {
+		return "", err
+	}
+	for _, ns := range namespaces {
+		nsUUID := ns.uuid
+		if nsUUID == "" {
+			if nsUUID, err = namespaceUUID(ns.devicePath); err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					V(LogInitiator, 2).Infof("failed to read the uuid of %s: %v", ns.devicePath, err)
+				}
+				continue
+			}
+		}
+		if strings.EqualFold(nsUUID, uuid) && (nsid == 0 || deviceHasNsid(ns.devicePath, nsid)) {
+			return ns.devicePath, nil
+		}
+	}
+	return "", nil
+}
+
+// waitForDeviceByUUID is waitForDeviceReady finding the device with nvme list
+func waitForDeviceByUUID(ctx context.Context, uuid string, nsid uint32, seconds int) (string, error) {
+	var devicePath string
+	err := PollWithBackoff(ctx, time.Duration(seconds)*time.Second, func() (bool, error) {
+		var err error
+		devicePath, err = findDeviceByUUID(ctx, uuid, nsid)
+		return devicePath != "", err
+	})
+	switch {
+	case errors.Is(err, ErrPollTimedOut):
+		return "", fmt.Errorf("%w waiting device ready: namespace %s not listed by nvme list", ErrTimeout, uuid)
+	case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+		return "", fmt.Errorf("stopped waiting device ready: namespace %s: %w", uuid, err)
+	case err != nil:
+		return "", err
+	}
+	return devicePath, nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// the fixtures in testdata/nvmelist are nvme list -o json outputs of
+// namespaces of a Ceph gateway, in the schemas of several nvme-cli versions
+func TestParseNvmeList(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    []nvmeListNamespace
+	}{
+		{"nvme-cli-1.16.json", []nvmeListNamespace{{devicePath: "/dev/nvme0n1"}, {devicePath: "/dev/nvme0n2"}}},
+		{"nvme-cli-1.16-empty.txt", nil},
+		{"nvme-cli-2.4.json", []nvmeListNamespace{{devicePath: "/dev/nvme0n1"}, {devicePath: "/dev/nvme1n1"}}},
+		{"nvme-cli-2.4-empty.json", nil},
+		// the multipath path devices nvme0c0n1 and nvme0c1n1 aren't namespaces
+		{"nvme-cli-2.4-verbose.json", []nvmeListNamespace{{devicePath: "/dev/nvme0n1"}, {devicePath: "/dev/nvme0n2"}}},
+		// a warning printed before the JSON
+		{"nvme-cli-2.4-warning.txt", []nvmeListNamespace{{devicePath: "/dev/nvme0n1"}}},
+		// namespaces listed per controller, with their uuid
+		{"nvme-cli-2.11-private.json", []nvmeListNamespace{{devicePath: "/dev/nvme0n1", uuid: "8a3c5b1e-2f4d-4e6a-9b7c-1d2e3f4a5b6c"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			output, err := os.ReadFile(filepath.Join("testdata", "nvmelist", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseNvmeList(output)
+			if err != nil {
+				t.Fatalf("parseNvmeList: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNvmeListMalformed(t *testing.T) {
+	if _, err := parseNvmeList([]byte(`{"Devices":[{"DevicePath":"/dev/nvme0n1"`)); err == nil {
+		t.Error("truncated output parsed without error")
+	}
+}
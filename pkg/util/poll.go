@@ -0,0 +1,66 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// device polling starts tight for fast devices and backs off up to
+// maxPollInterval, each wait jittered so volumes and nodes don't poll in lockstep
+const (
+	initialPollInterval = 100 * time.Millisecond
+	maxPollInterval     = 2 * time.Second
+	pollJitter          = 0.2 // fraction of the interval a wait is moved by at most
+)
+
+// ErrPollTimedOut is returned by PollWithBackoff when timeout elapses
+var ErrPollTimedOut = errors.New("poll timed out")
+
+// PollWithBackoff calls poll until it reports done or fails, waiting longer
+// between calls as time passes. It gives up with ErrPollTimedOut once timeout
+// elapsed, after a last call at the deadline, or with the error of ctx. A
+// timeout of 0 calls poll once.
+func PollWithBackoff(ctx context.Context, timeout time.Duration, poll func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	interval := initialPollInterval
+	for {
+		done, err := poll()
+		if err != nil || done {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return ErrPollTimedOut
+		}
+		wait := time.Duration(float64(interval) * (1 + pollJitter*(2*rand.Float64()-1))) // #nosec - jitter only
+		if wait > remaining {
+			wait = remaining
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		interval = min(2*interval, maxPollInterval)
+	}
+}
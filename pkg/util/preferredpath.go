@@ -0,0 +1,86 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// StorageClass parameter, passed on in the publish context, with the address
+// of the port of the subsystem to use first. Discovery connects to it rather
+// than to the first port reported, and without native multipath the device
+// going through its controller is staged. Any other port is used when it's
+// not one of the subsystem or it's down.
+const preferredTraddrKey = "preferred_traddr"
+
+// ParsePreferredTraddr returns the preferred_traddr of params, empty if unset
+func ParsePreferredTraddr(params map[string]string) (string, error) {
+	addr := params[preferredTraddrKey]
+	if addr == "" {
+		return "", nil
+	}
+	if err := validateAddress(preferredTraddrKey, addr); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// preferDevice returns the device among the links matching deviceGlob whose
+// controller is live and connected to addr, fallback if there's none. With
+// native multipath there's a single device for all the controllers, the
+// kernel picks the path then.
+func preferDevice(deviceGlob, addr, fallback string) string {
+	matches, err := filepath.Glob(deviceGlob)
+	if err != nil {
+		return fallback
+	}
+	for _, match := range matches {
+		device, err := filepath.EvalSymlinks(match)
+		if err != nil {
+			continue
+		}
+		controllerDir := filepath.Join("/sys/block", filepath.Base(device), "device")
+		address, err := os.ReadFile(filepath.Join(controllerDir, "address")) // #nosec - sysfs path of a listed device
+		if err != nil {
+			continue // a multipath head, its device is the subsystem
+		}
+		state, err := os.ReadFile(filepath.Join(controllerDir, "state")) // #nosec - sysfs path of a listed device
+		if err != nil || strings.TrimSpace(string(state)) != "live" {
+			continue
+		}
+		if controllerTraddr(string(address)) == addr {
+			return match
+		}
+	}
+	klog.Warningf("no live device of %s goes through preferred_traddr %s, using %s", deviceGlob, addr, fallback)
+	return fallback
+}
+
+// controllerTraddr returns the traddr of the sysfs address of a controller,
+// e.g. traddr=10.0.0.1,trsvcid=4420,src_addr=10.0.0.2
+func controllerTraddr(address string) string {
+	for _, field := range strings.Split(strings.TrimSpace(address), ",") {
+		if value, ok := strings.CutPrefix(field, "traddr="); ok {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"k8s.io/klog"
+	utilexec "k8s.io/utils/exec"
+)
+
+// DeviceSize returns the size in bytes of devicePath
+func DeviceSize(devicePath string) (int64, error) {
+	f, err := os.Open(devicePath) // #nosec - device of a staged volume
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the size of %s: %w", devicePath, err)
+	}
+	return size, nil
+}
+
+// WaitForDeviceSize polls devicePath until it's at least size bytes and
+// returns its size, the kernel updates it once the target reports the
+// namespace changed, which may lag the resize on the gateway
+func WaitForDeviceSize(ctx context.Context, devicePath string, size int64, timeout time.Duration) (int64, error) {
+	var current int64
+	err := PollWithBackoff(ctx, timeout, func() (bool, error) {
+		var err error
+		if current, err = DeviceSize(devicePath); err != nil {
+			return false, err
+		}
+		if current < size {
+			V(LogNode, 4).Infof("device %s is %d bytes, waiting for %d", devicePath, current, size)
+			return false, nil
+		}
+		return true, nil
+	})
+	if errors.Is(err, ErrPollTimedOut) {
+		return current, fmt.Errorf("%w: device %s is still %d bytes after %v, expected %d", context.DeadlineExceeded, devicePath, current, timeout, size)
+	}
+	return current, err
+}
+
+// ResizeFilesystem grows the fsType filesystem of devicePath mounted at
+// mountPath to the size of the device
+func ResizeFilesystem(ctx context.Context, fsType, devicePath, mountPath string) error {
+	var args []string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		args = []string{"resize2fs", devicePath}
+	case "xfs":
+		// xfs grows through its mount point only
+		args = []string{"xfs_growfs", mountPath}
+	default:
+		return fmt.Errorf("resizing a %q filesystem isn't supported", fsType)
+	}
+	klog.Infof("Growing %s filesystem of device %s: %v", fsType, devicePath, args)
+	out, err := utilexec.New().CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s of device %s failed: %w, output: %s", args[0], devicePath, err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"slices"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// StagedAccessKey is the key of the stashed volume context recording the
+// access a volume was staged for, StagedReadOnly or StagedReadWrite
+const StagedAccessKey = "stagedAccess"
+
+const (
+	StagedReadOnly  = "ro"
+	StagedReadWrite = "rw"
+)
+
+// StageAccess returns the access a volume staged with capability is for,
+// read-only with a reader only access mode or the ro mount flag. It's the
+// access requested, not how the staging path is mounted: staging always
+// mounts read-write, ro is only applied to the bind mounts of publish.
+func StageAccess(capability *csi.VolumeCapability) string {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return StagedReadOnly
+	}
+	if slices.Contains(capability.GetMount().GetMountFlags(), "ro") {
+		return StagedReadOnly
+	}
+	return StagedReadWrite
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// SubsystemManager counts the namespaces in use of each connected subsystem.
+// nvme connect and disconnect act on a whole subsystem, so it must stay
+// connected until the last of its namespaces is released.
+//
+// With a state file the references survive restarts of the node server, the
+// file holds the namespace uuids of each subsystem NQN:
+//
+//	{"nqn.2016-06.io.spdk:cnode1": ["0b8a3c4e-...", "5f2d7e10-..."]}
+type SubsystemManager struct {
+	stateFile string // not persisted when empty
+
+	mu   sync.Mutex
+	refs map[string]map[string]struct{} // nqn -> namespace uuids
+}
+
+// NewSubsystemManager returns a manager loading its references from stateFile, if it exists
+func NewSubsystemManager(stateFile string) (*SubsystemManager, error) {
+	m := &SubsystemManager{
+		stateFile: stateFile,
+		refs:      map[string]map[string]struct{}{},
+	}
+	if stateFile == "" {
+		return m, nil
+	}
+	var state map[string][]string
+	if err := ParseJSONFile(stateFile, &state); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return nil, fmt.Errorf("failed to load subsystem references: %w", err)
+	}
+	for nqn, uuids := range state {
+		for _, uuid := range uuids {
+			m.add(nqn, uuid)
+		}
+	}
+	return m, nil
+}
+
+// Acquire records namespace uuid of nqn in use, the reference is dropped
+// again when it can't be persisted
+func (m *SubsystemManager) Acquire(nqn, uuid string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.refs[nqn][uuid]; ok {
+		return nil
+	}
+	m.add(nqn, uuid)
+	if err := m.save(); err != nil {
+		m.remove(nqn, uuid)
+		return err
+	}
+	return nil
+}
+
+// Release drops the reference of namespace uuid of nqn and returns how many
+// namespaces of nqn are still in use. The reference is dropped even if it
+// can't be persisted, releasing it again retries saving.
+func (m *SubsystemManager) Release(nqn, uuid string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(nqn, uuid)
+	return len(m.refs[nqn]), m.save()
+}
+
+// Namespaces returns how many namespaces of nqn are in use
+func (m *SubsystemManager) Namespaces(nqn string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.refs[nqn])
+}
+
+// InUse tells if a namespace of nqn is in use
+func (m *SubsystemManager) InUse(nqn string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.refs[nqn]) > 0
+}
+
+func (m *SubsystemManager) add(nqn, uuid string) {
+	if m.refs[nqn] == nil {
+		m.refs[nqn] = map[string]struct{}{}
+	}
+	m.refs[nqn][uuid] = struct{}{}
+}
+
+func (m *SubsystemManager) remove(nqn, uuid string) {
+	delete(m.refs[nqn], uuid)
+	if len(m.refs[nqn]) == 0 {
+		delete(m.refs, nqn)
+	}
+}
+
+// save replaces the state file atomically, the caller holds mu
+func (m *SubsystemManager) save() error {
+	if m.stateFile == "" {
+		return nil
+	}
+	state := make(map[string][]string, len(m.refs))
+	for nqn, uuids := range m.refs {
+		for uuid := range uuids {
+			state[nqn] = append(state[nqn], uuid)
+		}
+		sort.Strings(state[nqn])
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal subsystem references: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(m.stateFile), filepath.Base(m.stateFile)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save subsystem references: %w", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write subsystem references to %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), m.stateFile); err != nil {
+		return fmt.Errorf("failed to save subsystem references to %s: %w", m.stateFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameter, passed on in the publish context, with the seconds
+// the kernel keeps reconnecting a lost controller before failing its IO,
+// nvme connect -l, -1 reconnects forever
+const ctrlLossTmoKey = "ctrlLossTmo"
+
+// ctrl_loss_tmo when neither the StorageClass nor -transport-default set one
+const defaultCtrlLossTmo = 1800
+
+// ParseCtrlLossTmo reads the controller loss timeout, defaultCtrlLossTmo when unset
+func ParseCtrlLossTmo(params map[string]string) (int, error) {
+	value, ok := params[ctrlLossTmoKey]
+	if !ok {
+		return defaultCtrlLossTmo, nil
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < -1 {
+		return 0, fmt.Errorf("invalid %s %q, expected seconds or -1", ctrlLossTmoKey, value)
+	}
+	return seconds, nil
+}
+
+// connect parameters -transport-default may set
+var transportDefaultKeys = []string{hdrDigestKey, dataDigestKey, nrPollQueuesKey, ctrlLossTmoKey}
+
+// ParseTransportDefault adds a -transport-default value,
+// <transport>:<key>=<value>[,<key>=<value>...], to defaults, the connect
+// parameters of each transport. The parameters are checked as they would be
+// in a StorageClass of that transport.
+func ParseTransportDefault(value string, defaults map[string]map[string]string) error {
+	transport, settings, ok := strings.Cut(value, ":")
+	transport = strings.ToLower(transport)
+	if !ok || settings == "" {
+		return fmt.Errorf("invalid transport default %q, expected <transport>:<key>=<value>[,...]", value)
+	}
+	if transport != transportTCP && transport != transportRDMA && transport != transportFC {
+		return fmt.Errorf("invalid transport %q, expected %s, %s or %s", transport, transportTCP, transportRDMA, transportFC)
+	}
+	params := map[string]string{"transport": transport}
+	for key, value := range defaults[transport] {
+		params[key] = value
+	}
+	for _, setting := range strings.Split(settings, ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok || !slices.Contains(transportDefaultKeys, key) {
+			return fmt.Errorf("invalid transport default %q, expected one of %v set to a value", setting, transportDefaultKeys)
+		}
+		params[key] = value
+	}
+	if _, _, err := ParseDigests(params); err != nil {
+		return err
+	}
+	if _, err := ParseNrPollQueues(params); err != nil {
+		return err
+	}
+	if _, err := ParseCtrlLossTmo(params); err != nil {
+		return err
+	}
+	delete(params, "transport")
+	defaults[transport] = params
+	return nil
+}
+
+// withTransportDefaults returns publishContext completed with the defaults of
+// its transport. A parameter set in the StorageClass wins over the default
+// of its transport, which wins over the built-in default.
+func withTransportDefaults(publishContext map[string]string) map[string]string {
+	defaults := initiatorConf.transportDefaults[strings.ToLower(publishContext["transport"])]
+	if len(defaults) == 0 {
+		return publishContext
+	}
+	params := make(map[string]string, len(publishContext)+len(defaults))
+	for key, value := range publishContext {
+		params[key] = value
+	}
+	for key, value := range defaults {
+		if _, ok := params[key]; !ok {
+			params[key] = value
+		}
+	}
+	return params
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+)
+
+// TestTransportDefaultPrecedence checks a StorageClass parameter wins over
+// the -transport-default of its transport, which wins over the built-in default
+func TestTransportDefaultPrecedence(t *testing.T) {
+	defaults := map[string]map[string]string{}
+	if err := ParseTransportDefault("tcp:ctrlLossTmo=600,nrPollQueues=2", defaults); err != nil {
+		t.Fatal(err)
+	}
+	saved := initiatorConf.transportDefaults
+	initiatorConf.transportDefaults = defaults
+	t.Cleanup(func() { initiatorConf.transportDefaults = saved })
+
+	tests := []struct {
+		name           string
+		publishContext map[string]string
+		want           int
+	}{
+		{"parameter", map[string]string{"transport": "tcp", ctrlLossTmoKey: "60"}, 60},
+		{"transport default", map[string]string{"transport": "tcp"}, 600},
+		{"transport default of upper case transport", map[string]string{"transport": "TCP"}, 600},
+		{"built-in default", map[string]string{"transport": "rdma"}, defaultCtrlLossTmo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCtrlLossTmo(withTransportDefaults(tt.publishContext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("ctrl_loss_tmo %d, want %d", got, tt.want)
+			}
+		})
+	}
+	if params := withTransportDefaults(map[string]string{"transport": "tcp", nrPollQueuesKey: "0"}); params[nrPollQueuesKey] != "0" {
+		t.Errorf("nrPollQueues %s, want the parameter 0 over the default", params[nrPollQueuesKey])
+	}
+}
+
+func TestParseTransportDefault(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"tcp:ctrlLossTmo=-1", true},
+		{"RDMA:nrPollQueues=4", true},
+		{"fc:ctrlLossTmo=600", true},
+		{"tcp:hdrDigest=true,dataDigest=true", true},
+		{"rdma:hdrDigest=true", false},
+		{"fc:nrPollQueues=2", false},
+		{"tcp:ctrlLossTmo=-2", false},
+		{"tcp:traddr=192.168.1.10", false},
+		{"tcp:ctrlLossTmo", false},
+		{"tcp:", false},
+		{"loop:ctrlLossTmo=600", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			err := ParseTransportDefault(tt.value, map[string]map[string]string{})
+			if tt.valid != (err == nil) {
+				t.Errorf("got %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
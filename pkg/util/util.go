@@ -17,9 +17,11 @@ limitations under the License.
 package util
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -32,6 +34,7 @@ import (
 
 const (
 	volumeContextFileName = "volume-context.json" // file name in which volume context is stashed.
+	devicePathFileName    = ".device"             // file name in which the staged device path is stashed.
 )
 
 // classID, vendorID and deviceID and  which are used to detect QEMU KVM PCI-PCI bridge
@@ -125,7 +128,7 @@ func CheckIfNvmeDeviceExists(nvmeModel string, ignorePaths map[string]struct{})
 		}
 		deviceName, err := getNvmeDeviceName(filePath, nvmeModel)
 		if err != nil {
-			klog.Infof("Ignoring err: %v", err)
+			V(LogInitiator, 4).Infof("Ignoring err: %v", err)
 		}
 		if deviceName != "" {
 			return deviceName, nil
@@ -135,39 +138,45 @@ func CheckIfNvmeDeviceExists(nvmeModel string, ignorePaths map[string]struct{})
 }
 
 // detectNvemeDeviceName detects the device name in sysfs for given nvmeModel
-func detectNvmeDeviceName(nvmeModel string) (string, error) {
+func detectNvmeDeviceName(ctx context.Context, nvmeModel string) (string, error) {
 	uuidFilePathsReadFlag := make(map[string]struct{})
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
 	// Set 20 seconds timeout at maximum to try to find the exact device name for SMA Nvme
 	for second := 0; second < 20; second++ {
 		deviceName, err := CheckIfNvmeDeviceExists(nvmeModel, uuidFilePathsReadFlag)
 		if err != nil {
-			klog.Infof("detect nvme device '%s': %v", nvmeModel, err)
+			V(LogInitiator, 4).Infof("detect nvme device '%s': %v", nvmeModel, err)
 		} else {
 			return deviceName, nil
 		}
 		// Wait a second before retry
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
 	}
 
 	return "", os.ErrDeadlineExceeded
 }
 
 // get the Nvme block device
-func GetNvmeDeviceName(nvmeModel, bdf string) (string, error) {
+func GetNvmeDeviceName(ctx context.Context, nvmeModel, bdf string) (string, error) {
 	var deviceName string
 	var err error
 	if bdf != "" {
 		var uuidFilePath string
 		// find the uuid file path for the nvme device based on the bdf
-		uuidFilePath, err = waitForDeviceReady(fmt.Sprintf("/sys/bus/pci/devices/%s/nvme/nvme*/nvme*n*/uuid", bdf), 20)
+		uuidFilePath, err = waitForDeviceReady(ctx, fmt.Sprintf("/sys/bus/pci/devices/%s/nvme/nvme*/nvme*n*/uuid", bdf), 20)
 		if err != nil {
 			return "", fmt.Errorf("failed find device at %s: %w", uuidFilePath, err)
 		}
-		klog.Infof("uuidFilePath is %s", uuidFilePath)
+		V(LogInitiator, 4).Infof("uuidFilePath is %s", uuidFilePath)
 		deviceName, err = getNvmeDeviceName(uuidFilePath, nvmeModel)
 	} else {
-		deviceName, err = detectNvmeDeviceName(nvmeModel)
+		deviceName, err = detectNvmeDeviceName(ctx, nvmeModel)
 	}
 	if err != nil {
 		return "", fmt.Errorf("failed to find nvme device name: %w", err)
@@ -175,22 +184,22 @@ func GetNvmeDeviceName(nvmeModel, bdf string) (string, error) {
 
 	deviceGlob := fmt.Sprintf("/dev/%s", deviceName)
 
-	return waitForDeviceReady(deviceGlob, 20)
+	return waitForDeviceReady(ctx, deviceGlob, 20)
 }
 
 // GetVirtioBlkDevice returns a block device available at the
 // given bdf path. If wait is true then it wait till a device
 // appear at the bdf path.
-func GetVirtioBlkDeviceName(bdf string, wait bool) (string, error) {
+func GetVirtioBlkDeviceName(ctx context.Context, bdf string, wait bool) (string, error) {
 	// The parent dir path of the block device for VirtioBlk should be
 	// in the form of "/sys/bus/pci/devices/0000:01:01.0/virtio2/block"
 	sysBusGlob := fmt.Sprintf("/sys/bus/pci/devices/%s/virtio*/block", bdf)
 	var deviceParentDirPath string
 	var err error
 	if wait {
-		deviceParentDirPath, err = waitForDeviceReady(sysBusGlob, 20)
+		deviceParentDirPath, err = waitForDeviceReady(ctx, sysBusGlob, 20)
 	} else {
-		deviceParentDirPath, err = waitForDeviceReady(sysBusGlob, 0)
+		deviceParentDirPath, err = waitForDeviceReady(ctx, sysBusGlob, 0)
 	}
 	if err != nil {
 		klog.Errorf("could not find the deviceParentDirPath (%s): %s", sysBusGlob, err)
@@ -211,7 +220,7 @@ func GetVirtioBlkDeviceName(bdf string, wait bool) (string, error) {
 	// wait for the block device ready for VirtioBlk, eg, in the form of "/dev/vda"
 	deviceGlob := fmt.Sprintf("/dev/%s", deviceName[0].Name())
 
-	return waitForDeviceReady(deviceGlob, 20)
+	return waitForDeviceReady(ctx, deviceGlob, 20)
 }
 
 // ConvertInterfaceToMap converts an interface to a map[string]string
@@ -270,7 +279,7 @@ func lookupContext(folder, fileName string) (interface{}, error) {
 			return data,
 				fmt.Errorf("failed to read stashed context JSON from path (%s): %w", fPath, err)
 		}
-		return data, fmt.Errorf("volume context JSON file not found")
+		return data, fmt.Errorf("volume context JSON file not found: %w", err)
 	}
 	err = json.Unmarshal(encodedBytes, &data)
 	if err != nil {
@@ -307,3 +316,112 @@ func LookupVolumeContext(path string) (map[string]string, error) {
 func CleanUpVolumeContext(path string) error {
 	return cleanUpContext(path, volumeContextFileName)
 }
+
+// StashDevicePath records the device staged at path in devicePathFileName, for
+// tooling that needs the device without resolving it again. The file is replaced
+// atomically so readers never see a partial path.
+func StashDevicePath(devicePath, path string) error {
+	tmp, err := os.CreateTemp(path, devicePathFileName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create device path stash in %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone after the rename
+	_, err = tmp.WriteString(devicePath + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write device path stash %s: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to chmod device path stash %s: %w", tmp.Name(), err)
+	}
+	fPath := filepath.Join(path, devicePathFileName)
+	if err := os.Rename(tmp.Name(), fPath); err != nil {
+		return fmt.Errorf("failed to stash device path at %s: %w", fPath, err)
+	}
+	return nil
+}
+
+// LookupDevicePath returns the device path stashed at path
+func LookupDevicePath(path string) (string, error) {
+	fPath := filepath.Join(path, devicePathFileName)
+	data, err := os.ReadFile(fPath) // #nosec - intended reading from fPath
+	if err != nil {
+		return "", fmt.Errorf("failed to read device path stash (%s): %w", fPath, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// CleanUpDevicePath removes the device path stashed at path, if any
+func CleanUpDevicePath(path string) error {
+	fPath := filepath.Join(path, devicePathFileName)
+	if err := os.Remove(fPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to cleanup device path stash (%s): %w", fPath, err)
+	}
+	return nil
+}
+
+// ContextDir returns the dir the volume context and device of volumeID are
+// stashed in, stagingParentPath if contextDir is empty. Volume IDs are base64,
+// whose "/" is replaced by "_", a character base64 doesn't use.
+func ContextDir(contextDir, volumeID, stagingParentPath string) string {
+	if contextDir == "" {
+		return stagingParentPath
+	}
+	return filepath.Join(contextDir, strings.ReplaceAll(volumeID, "/", "_"))
+}
+
+// StagedVolumeIDKey is the key of the stashed volume context recording the
+// ID of the staged volume, the staging dir of an unmounted volume may no
+// longer hold its mount point
+const StagedVolumeIDKey = "stagedVolumeID"
+
+// FindStagingDirs returns the dirs below root holding a stashed volume
+// context, the staging dirs of volumes, looking at most maxDepth levels down.
+// Staging dirs aren't descended into, their volumes may be mounted.
+func FindStagingDirs(root string, maxDepth int) ([]string, error) {
+	var dirs []string
+	rootDepth := strings.Count(filepath.Clean(root), string(filepath.Separator))
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !entry.IsDir() {
+			return nil
+		}
+		if _, err := os.Stat(filepath.Join(path, volumeContextFileName)); err == nil {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		if strings.Count(filepath.Clean(path), string(filepath.Separator))-rootDepth >= maxDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for staging dirs in %s: %w", root, err)
+	}
+	return dirs, nil
+}
+
+// StagedEntries returns the names in the staging dir path other than the
+// stashes, the staging target paths of volumes
+func StagedEntries(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == volumeContextFileName || strings.HasPrefix(name, devicePathFileName) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
@@ -17,6 +17,10 @@ limitations under the License.
 package util
 
 import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -51,3 +55,142 @@ func ValidateNodeStageVolumeRequest(req *csi.NodeStageVolumeRequest) error {
 
 	return nil
 }
+
+// ValidateNodeUnstageVolumeRequest validates the node unstage request.
+func ValidateNodeUnstageVolumeRequest(req *csi.NodeUnstageVolumeRequest) error {
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	return nil
+}
+
+// ValidateNodePublishVolumeRequest validates the node publish request.
+func ValidateNodePublishVolumeRequest(req *csi.NodePublishVolumeRequest) error {
+	if req.GetVolumeCapability() == nil {
+		return status.Error(codes.InvalidArgument, "volume capability missing in request")
+	}
+
+	if req.GetVolumeCapability().GetBlock() == nil && req.GetVolumeCapability().GetMount() == nil {
+		return status.Error(codes.InvalidArgument, "volume access type missing in request")
+	}
+
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if req.GetStagingTargetPath() == "" {
+		return status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+
+	if req.GetTargetPath() == "" {
+		return status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+
+	// the volume is staged below the staging target path, at <staging target path>/<volume ID>
+	if err := validateDistinctPaths(req.GetStagingTargetPath(), req.GetTargetPath()); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return nil
+}
+
+// validateDistinctPaths fails when the target path is the staging path, or
+// either is below the other, the bind mount of publish would then hide or
+// loop into the staged volume. Symlinks are resolved in the part of the paths
+// that exists.
+func validateDistinctPaths(stagingPath, targetPath string) error {
+	staging, target := resolvePath(stagingPath), resolvePath(targetPath)
+	switch {
+	case staging == target:
+		return fmt.Errorf("target path %s is the staging path", targetPath)
+	case isBelow(staging, target):
+		return fmt.Errorf("staging path %s is below target path %s", stagingPath, targetPath)
+	case isBelow(target, staging):
+		return fmt.Errorf("target path %s is below staging path %s", targetPath, stagingPath)
+	}
+	return nil
+}
+
+// resolvePath cleans path, resolving the symlinks of its longest existing
+// parent, the target path isn't created before publish
+func resolvePath(path string) string {
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path
+	}
+	return filepath.Join(resolvePath(parent), filepath.Base(path))
+}
+
+// isBelow tells if path is inside dir, both clean
+func isBelow(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ValidateNodeUnpublishVolumeRequest validates the node unpublish request.
+func ValidateNodeUnpublishVolumeRequest(req *csi.NodeUnpublishVolumeRequest) error {
+	if req.GetVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "volume ID missing in request")
+	}
+
+	if req.GetTargetPath() == "" {
+		return status.Error(codes.InvalidArgument, "target path missing in request")
+	}
+
+	return nil
+}
+
+// ValidateVolumeCapabilities checks each requested capability against the
+// access modes supported by the driver and the access type it is asked for.
+func ValidateVolumeCapabilities(caps []*csi.VolumeCapability, supported []*csi.VolumeCapability_AccessMode) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "volume capabilities missing in request")
+	}
+
+	for _, c := range caps {
+		mode := c.GetAccessMode().GetMode()
+		if mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+			return status.Error(codes.InvalidArgument, "volume access mode missing in request")
+		}
+		isSupported := false
+		for _, m := range supported {
+			if m.GetMode() == mode {
+				isSupported = true
+				break
+			}
+		}
+		if !isSupported {
+			return status.Errorf(codes.InvalidArgument, "access mode %s is not supported", mode)
+		}
+
+		switch {
+		case c.GetBlock() != nil:
+		case c.GetMount() != nil:
+			// a regular filesystem can't be written from more than one node
+			if mode == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER ||
+				mode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER {
+				return status.Errorf(codes.InvalidArgument,
+					"access type mount with access mode %s is not supported, use a block volume", mode)
+			}
+			// an empty fsType is left to -default-fstype of the node plugin
+			if fsType := c.GetMount().GetFsType(); fsType != "" {
+				if err := ValidateFsType(fsType); err != nil {
+					return status.Error(codes.InvalidArgument, err.Error())
+				}
+			}
+		default:
+			return status.Error(codes.InvalidArgument, "volume access type missing in request")
+		}
+	}
+
+	return nil
+}
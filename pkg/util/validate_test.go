@@ -0,0 +1,138 @@
+/*
+Copyright 2025 The ceph-nvmeof-csi Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	var modes, supported []*csi.VolumeCapability_AccessMode
+	for value := range csi.VolumeCapability_AccessMode_Mode_name {
+		mode := &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_Mode(value)}
+		modes = append(modes, mode)
+		if mode.GetMode() != csi.VolumeCapability_AccessMode_UNKNOWN {
+			supported = append(supported, mode)
+		}
+	}
+	accessTypes := []struct {
+		name string
+		set  func(*csi.VolumeCapability)
+		// filesystem volumes can't be written from more than one node
+		mount bool
+		valid bool
+	}{
+		{"block", func(c *csi.VolumeCapability) {
+			c.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+		}, false, true},
+		{"mount default fstype", func(c *csi.VolumeCapability) {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}
+		}, true, true},
+		{"mount ext4", func(c *csi.VolumeCapability) {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"}}
+		}, true, true},
+		{"mount xfs", func(c *csi.VolumeCapability) {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"}}
+		}, true, true},
+		{"mount btrfs", func(c *csi.VolumeCapability) {
+			c.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "btrfs"}}
+		}, true, false},
+		{"no access type", func(*csi.VolumeCapability) {}, false, false},
+	}
+	for _, mode := range modes {
+		for _, accessType := range accessTypes {
+			t.Run(mode.GetMode().String()+"/"+accessType.name, func(t *testing.T) {
+				c := &csi.VolumeCapability{AccessMode: mode}
+				accessType.set(c)
+				multiNodeWriter := mode.GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER ||
+					mode.GetMode() == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER
+				valid := accessType.valid && mode.GetMode() != csi.VolumeCapability_AccessMode_UNKNOWN &&
+					!(accessType.mount && multiNodeWriter)
+
+				err := ValidateVolumeCapabilities([]*csi.VolumeCapability{c}, supported)
+				if valid && err != nil {
+					t.Errorf("got %v, want valid", err)
+				}
+				if !valid && status.Code(err) != codes.InvalidArgument {
+					t.Errorf("got %v, want InvalidArgument", err)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateVolumeCapabilitiesUnsupportedMode(t *testing.T) {
+	supported := []*csi.VolumeCapability_AccessMode{{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}
+	caps := []*csi.VolumeCapability{
+		{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	}
+	if err := ValidateVolumeCapabilities(caps, supported); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument for an unsupported mode among supported ones", err)
+	}
+	if err := ValidateVolumeCapabilities(nil, supported); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, want InvalidArgument without capabilities", err)
+	}
+}
+
+func TestValidateDistinctPaths(t *testing.T) {
+	dir := t.TempDir()
+	staging := filepath.Join(dir, "plugins", "globalmount")
+	if err := os.MkdirAll(staging, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(staging, link); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		staging string
+		target  string
+		valid   bool
+	}{
+		{"distinct", staging, filepath.Join(dir, "pods", "mount"), true},
+		{"sibling with a common prefix", staging, staging + "-2", true},
+		{"identical", staging, staging, false},
+		{"identical but a trailing slash", staging, staging + "/", false},
+		{"identical through a symlink", staging, link, false},
+		{"identical after cleaning", staging, filepath.Join(staging, "..", "globalmount"), false},
+		{"target below staging", staging, filepath.Join(staging, "vol-1", "mount"), false},
+		{"target below staging through a symlink", staging, filepath.Join(link, "mount"), false},
+		{"staging below target", staging, filepath.Join(dir, "plugins"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateDistinctPaths(tt.staging, tt.target)
+			if tt.valid != (err == nil) {
+				t.Errorf("validateDistinctPaths(%s, %s) = %v, want valid %v", tt.staging, tt.target, err, tt.valid)
+			}
+		})
+	}
+}